@@ -1,6 +1,7 @@
 package chunker
 
 import (
+	"fmt"
 	"io"
 
 	"github.com/pranavdwivedi/aegis/pkg/hash"
@@ -20,6 +21,62 @@ type Chunker interface {
 	Next() (*Chunk, error)
 }
 
+// Chunking algorithms selectable per repository
+const (
+	AlgorithmFixed   = "fixed"
+	AlgorithmFastCDC = "fastcdc"
+)
+
+// Params selects and configures the chunking algorithm of a repository.
+// All snapshots of a repository should use the same params, otherwise
+// chunk boundaries differ and deduplication is lost.
+type Params struct {
+	Algorithm string `json:"algorithm"`          // "fixed" (default) or "fastcdc"
+	MinSize   int    `json:"min_size,omitempty"` // fastcdc only
+	AvgSize   int    `json:"avg_size,omitempty"` // fastcdc only; also the block size for "fixed"
+	MaxSize   int    `json:"max_size,omitempty"` // fastcdc only
+}
+
+// Normalize fills in the defaults New would apply, so params that chunk
+// identically compare equal. It rejects params New would reject.
+func (p Params) Normalize() (Params, error) {
+	switch p.Algorithm {
+	case "", AlgorithmFixed:
+		if p.AvgSize <= 0 {
+			p.AvgSize = DefaultChunkSize
+		}
+		return Params{Algorithm: AlgorithmFixed, AvgSize: p.AvgSize}, nil
+	case AlgorithmFastCDC:
+		minSize, avgSize, maxSize, err := fastCDCSizes(p.MinSize, p.AvgSize, p.MaxSize)
+		if err != nil {
+			return Params{}, err
+		}
+		return Params{Algorithm: AlgorithmFastCDC, MinSize: minSize, AvgSize: avgSize, MaxSize: maxSize}, nil
+	default:
+		return Params{}, fmt.Errorf("unknown chunker algorithm: %s", p.Algorithm)
+	}
+}
+
+// String describes p for error messages
+func (p Params) String() string {
+	if p.Algorithm == AlgorithmFastCDC {
+		return fmt.Sprintf("fastcdc %d/%d/%d", p.MinSize, p.AvgSize, p.MaxSize)
+	}
+	return fmt.Sprintf("%s %d", p.Algorithm, p.AvgSize)
+}
+
+// New creates the Chunker described by p
+func New(r io.Reader, p Params) (Chunker, error) {
+	switch p.Algorithm {
+	case "", AlgorithmFixed:
+		return NewFixedSizeChunker(r, p.AvgSize), nil
+	case AlgorithmFastCDC:
+		return NewFastCDCChunker(r, p.MinSize, p.AvgSize, p.MaxSize)
+	default:
+		return nil, fmt.Errorf("unknown chunker algorithm: %s", p.Algorithm)
+	}
+}
+
 // FixedSizeChunker implements the Chunker interface with fixed-size blocks
 type FixedSizeChunker struct {
 	reader io.Reader
@@ -0,0 +1,170 @@
+package chunker
+
+import (
+	"fmt"
+	"io"
+	"math/bits"
+
+	"github.com/pranavdwivedi/aegis/pkg/hash"
+)
+
+// Default FastCDC sizes. The average is a power of two so the cut masks
+// can be derived from it directly.
+const (
+	DefaultMinSize = 512 * 1024
+	DefaultAvgSize = 1024 * 1024
+	DefaultMaxSize = 8 * 1024 * 1024
+)
+
+// gearSeed seeds the gear table. It must never change: boundaries (and
+// therefore deduplication against existing snapshots) depend on it.
+const gearSeed = 0x6165676973636463 // "aegiscdc"
+
+var gear [256]uint64
+
+func init() {
+	// splitmix64 gives us a well-distributed, reproducible table without
+	// shipping 256 magic constants.
+	x := uint64(gearSeed)
+	for i := range gear {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gear[i] = z ^ (z >> 31)
+	}
+}
+
+// FastCDCChunker implements the Chunker interface with content-defined
+// boundaries (gear hash, normalized chunking as described in the FastCDC paper).
+// Inserting or removing bytes only moves the boundaries around the edit.
+type FastCDCChunker struct {
+	reader  io.Reader
+	buf     []byte
+	n       int // valid bytes in buf
+	eof     bool
+	minSize int
+	avgSize int
+	maxSize int
+	maskS   uint64 // stricter mask used before the average size
+	maskL   uint64 // looser mask used after the average size
+}
+
+// NewFastCDCChunker creates a new FastCDCChunker.
+// Zero sizes fall back to the defaults; avgSize is rounded to a power of two.
+func NewFastCDCChunker(r io.Reader, minSize, avgSize, maxSize int) (*FastCDCChunker, error) {
+	minSize, avgSize, maxSize, err := fastCDCSizes(minSize, avgSize, maxSize)
+	if err != nil {
+		return nil, err
+	}
+	avgBits := bits.Len(uint(avgSize)) - 1
+
+	return &FastCDCChunker{
+		reader:  r,
+		buf:     make([]byte, maxSize),
+		minSize: minSize,
+		avgSize: avgSize,
+		maxSize: maxSize,
+		maskS:   topMask(avgBits + 1),
+		maskL:   topMask(avgBits - 1),
+	}, nil
+}
+
+// fastCDCSizes applies the default sizes, rounds avg to the nearest
+// power of two (the masks can only express those) and checks them
+func fastCDCSizes(minSize, avgSize, maxSize int) (int, int, int, error) {
+	if minSize <= 0 {
+		minSize = DefaultMinSize
+	}
+	if avgSize <= 0 {
+		avgSize = DefaultAvgSize
+	}
+	if maxSize <= 0 {
+		maxSize = DefaultMaxSize
+	}
+	avgBits := bits.Len(uint(avgSize)) - 1
+	if avgSize-(1<<avgBits) > (1<<(avgBits+1))-avgSize {
+		avgBits++
+	}
+	avgSize = 1 << avgBits
+	if minSize < 64 || minSize >= avgSize || avgSize >= maxSize {
+		return 0, 0, 0, fmt.Errorf("invalid fastcdc sizes: need 64 <= min < avg < max (got %d/%d/%d)", minSize, avgSize, maxSize)
+	}
+	return minSize, avgSize, maxSize, nil
+}
+
+// topMask returns a mask with the n most significant bits set.
+// The gear hash shifts left, so the high bits cover the widest window.
+func topMask(n int) uint64 {
+	if n <= 0 {
+		return 0
+	}
+	if n >= 64 {
+		return ^uint64(0)
+	}
+	return ^uint64(0) << (64 - n)
+}
+
+// Next reads the next chunk from the underlying reader
+func (c *FastCDCChunker) Next() (*Chunk, error) {
+	// Top up the buffer so we can always look maxSize bytes ahead
+	for !c.eof && c.n < len(c.buf) {
+		m, err := c.reader.Read(c.buf[c.n:])
+		c.n += m
+		if err == io.EOF {
+			c.eof = true
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if c.n == 0 {
+		return nil, io.EOF
+	}
+
+	cut := c.cut(c.buf[:c.n])
+
+	data := make([]byte, cut)
+	copy(data, c.buf[:cut])
+
+	// Shift the remainder to the front for the next call
+	c.n = copy(c.buf, c.buf[cut:c.n])
+
+	return &Chunk{
+		Data: data,
+		Hash: hash.Sum(data),
+	}, nil
+}
+
+// cut returns the length of the next chunk in data
+func (c *FastCDCChunker) cut(data []byte) int {
+	n := len(data)
+	if n <= c.minSize {
+		return n
+	}
+	if n > c.maxSize {
+		n = c.maxSize
+	}
+	normal := c.avgSize
+	if n < normal {
+		normal = n
+	}
+
+	var fp uint64
+	i := c.minSize
+	for ; i < normal; i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp&c.maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp&c.maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
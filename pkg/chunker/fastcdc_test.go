@@ -0,0 +1,189 @@
+package chunker
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+	"testing/iotest"
+
+	"github.com/pranavdwivedi/aegis/pkg/hash"
+)
+
+const (
+	testMin = 2 * 1024
+	testAvg = 8 * 1024
+	testMax = 32 * 1024
+)
+
+func randomData(seed int64, n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+// chunkAll splits data with the test sizes, reading through r
+func chunkAll(t *testing.T, r io.Reader) []*Chunk {
+	t.Helper()
+	c, err := NewFastCDCChunker(r, testMin, testAvg, testMax)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var chunks []*Chunk
+	for {
+		ch, err := c.Next()
+		if err == io.EOF {
+			return chunks
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunks = append(chunks, ch)
+	}
+}
+
+func TestFastCDCBoundaries(t *testing.T) {
+	data := randomData(1, 4*1024*1024)
+	// Short reads must not move boundaries
+	chunks := chunkAll(t, iotest.HalfReader(bytes.NewReader(data)))
+
+	var joined []byte
+	for i, ch := range chunks {
+		last := i == len(chunks)-1
+		if len(ch.Data) > testMax {
+			t.Errorf("chunk %d is %d bytes, above the max of %d", i, len(ch.Data), testMax)
+		}
+		if !last && len(ch.Data) < testMin {
+			t.Errorf("chunk %d is %d bytes, below the min of %d", i, len(ch.Data), testMin)
+		}
+		if ch.Hash != hash.Sum(ch.Data) {
+			t.Errorf("chunk %d has the wrong hash", i)
+		}
+		joined = append(joined, ch.Data...)
+	}
+	if !bytes.Equal(joined, data) {
+		t.Fatal("chunks do not reassemble the input")
+	}
+
+	avg := len(data) / len(chunks)
+	if avg < testAvg/2 || avg > testAvg*2 {
+		t.Errorf("average chunk size %d is far from %d", avg, testAvg)
+	}
+
+	again := chunkAll(t, bytes.NewReader(data))
+	if len(again) != len(chunks) {
+		t.Fatalf("chunking is not deterministic: %d then %d chunks", len(chunks), len(again))
+	}
+	for i := range chunks {
+		if again[i].Hash != chunks[i].Hash {
+			t.Fatalf("chunking is not deterministic at chunk %d", i)
+		}
+	}
+}
+
+func TestFastCDCSmallInputs(t *testing.T) {
+	if chunks := chunkAll(t, bytes.NewReader(nil)); len(chunks) != 0 {
+		t.Errorf("empty input gave %d chunks", len(chunks))
+	}
+
+	data := randomData(2, testMin)
+	chunks := chunkAll(t, bytes.NewReader(data))
+	if len(chunks) != 1 || !bytes.Equal(chunks[0].Data, data) {
+		t.Errorf("input of min size should be a single chunk, got %d", len(chunks))
+	}
+
+	// Repetitive data still respects the bounds
+	zeros := make([]byte, 3*testMax+100)
+	chunks = chunkAll(t, bytes.NewReader(zeros))
+	total := 0
+	for i, ch := range chunks {
+		total += len(ch.Data)
+		if len(ch.Data) > testMax || (i < len(chunks)-1 && len(ch.Data) < testMin) {
+			t.Errorf("chunk %d of zeros is %d bytes", i, len(ch.Data))
+		}
+	}
+	if total != len(zeros) {
+		t.Errorf("chunks of zeros cover %d of %d bytes", total, len(zeros))
+	}
+}
+
+func TestFastCDCShiftResistance(t *testing.T) {
+	data := randomData(3, 2*1024*1024)
+	original := chunkAll(t, bytes.NewReader(data))
+
+	edits := map[string][]byte{
+		"insert at front":  append(randomData(4, 17), data...),
+		"delete at front":  data[1000:],
+		"insert in middle": append(append(append([]byte(nil), data[:len(data)/2]...), randomData(5, 333)...), data[len(data)/2:]...),
+	}
+	for name, edited := range edits {
+		seen := make(map[hash.Hash]bool)
+		for _, ch := range chunkAll(t, bytes.NewReader(edited)) {
+			seen[ch.Hash] = true
+		}
+		kept := 0
+		for _, ch := range original {
+			if seen[ch.Hash] {
+				kept++
+			}
+		}
+		// Only the chunks around the edit may change
+		if changed := len(original) - kept; changed > 3 {
+			t.Errorf("%s: %d of %d chunks changed", name, changed, len(original))
+		}
+	}
+}
+
+func TestFastCDCInvalidSizes(t *testing.T) {
+	for _, s := range [][3]int{
+		{32, 1024, 4096},   // min too small
+		{4096, 1024, 8192}, // min above avg
+		{1024, 8192, 8192}, // avg not below max
+	} {
+		if _, err := NewFastCDCChunker(nil, s[0], s[1], s[2]); err == nil {
+			t.Errorf("sizes %v accepted", s)
+		}
+	}
+}
+
+func TestParamsNormalize(t *testing.T) {
+	a, err := Params{Algorithm: AlgorithmFastCDC}.Normalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := Params{Algorithm: AlgorithmFastCDC, MinSize: DefaultMinSize, AvgSize: DefaultAvgSize, MaxSize: DefaultMaxSize}.Normalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a != b {
+		t.Errorf("defaults normalize differently: %v and %v", a, b)
+	}
+
+	// The chunker rounds avg to a power of two, so both chunk identically
+	odd, err := Params{Algorithm: AlgorithmFastCDC, MinSize: 2048, AvgSize: 7000, MaxSize: 32768}.Normalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	even, err := Params{Algorithm: AlgorithmFastCDC, MinSize: 2048, AvgSize: 8192, MaxSize: 32768}.Normalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if odd != even {
+		t.Errorf("avg 7000 and 8192 normalize differently: %v and %v", odd, even)
+	}
+
+	fixed, err := Params{}.Normalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fixed != (Params{Algorithm: AlgorithmFixed, AvgSize: DefaultChunkSize}) {
+		t.Errorf("zero params normalize to %v", fixed)
+	}
+	if fixed == a {
+		t.Error("fixed and fastcdc params compare equal")
+	}
+
+	if _, err := (Params{Algorithm: "rabin"}).Normalize(); err == nil {
+		t.Error("unknown algorithm accepted")
+	}
+}
@@ -10,16 +10,100 @@ type Config struct {
 	Jobs    []Job          `json:"jobs"`
 	Storage *Storage       `json:"storage,omitempty"`
 	Restore *RestoreConfig `json:"restore,omitempty"`
+	Chunker *Chunker       `json:"chunker,omitempty"`
+	Parity  *Parity        `json:"parity,omitempty"`
+	Server  *Server        `json:"server,omitempty"`
+	// WriteKey is the path of a write-only key (see engine.EnableWriteOnly).
+	// When set the daemon backs up without the passphrase but cannot read
+	// the repository or apply retention.
+	WriteKey string `json:"write_key,omitempty"`
+	// Hostname names this machine in its snapshots (default: the OS
+	// hostname). Retention only forgets snapshots taken under this name.
+	Hostname string `json:"hostname,omitempty"`
 }
 
 type Storage struct {
-	Type      string `json:"type"`       // "local" or "s3"
+	Type      string `json:"type"`       // "local", "s3", "sftp", "rest" or "mirror"
+	Path      string `json:"path"`       // for local (optional, defaults to the repository directory) and sftp
 	Bucket    string `json:"bucket"`     // for S3
 	Endpoint  string `json:"endpoint"`   // for S3
 	Region    string `json:"region"`     // for S3 (optional)
 	UseSSL    bool   `json:"use_ssl"`    // for S3
 	AccessKey string `json:"access_key"` // Env var override preferred
 	SecretKey string `json:"secret_key"` // Env var override preferred
+
+	// More S3 settings. Without access_key/secret_key the AWS environment
+	// variables, the shared credentials file and the instance role are tried.
+	SessionToken    string `json:"session_token,omitempty"`    // temporary STS credentials
+	CredentialsFile string `json:"credentials_file,omitempty"` // default ~/.aws/credentials
+	Profile         string `json:"profile,omitempty"`          // profile in the credentials file
+	AddressingStyle string `json:"addressing_style,omitempty"` // "auto" (default), "path" or "virtual"
+	CAFile          string `json:"ca_file,omitempty"`          // PEM bundle of a private CA
+	Prefix          string `json:"prefix,omitempty"`           // key prefix, to share a bucket
+
+	// S3 Object Lock: "governance" or "compliance" locks every object for
+	// LockDays after it is written; the bucket must have object lock enabled
+	LockMode string `json:"lock_mode,omitempty"`
+	LockDays int    `json:"lock_days,omitempty"`
+
+	// VerifyExisting makes a local backend check objects it already has
+	// instead of skipping them, replacing damaged copies
+	VerifyExisting bool `json:"verify_existing,omitempty"`
+
+	Host       string `json:"host,omitempty"`        // for SFTP, host:port
+	User       string `json:"user,omitempty"`        // for SFTP
+	KeyFile    string `json:"key_file,omitempty"`    // for SFTP, private key
+	KnownHosts string `json:"known_hosts,omitempty"` // for SFTP (default ~/.ssh/known_hosts)
+
+	URL   string `json:"url,omitempty"`   // for REST, e.g. https://backup.example.com:8000
+	Token string `json:"token,omitempty"` // for REST; Env var override preferred
+
+	// Retries of transient failures (default 5, -1 for none), bandwidth
+	// limits in KiB/s and a cap on concurrent requests; zero is unlimited.
+	// Mirrors apply the settings of each replica.
+	MaxRetries    int `json:"max_retries,omitempty"`
+	UploadKBps    int `json:"upload_kbps,omitempty"`
+	DownloadKBps  int `json:"download_kbps,omitempty"`
+	MaxConcurrent int `json:"max_concurrent,omitempty"`
+
+	// Replicas lists the backends of a mirror, in read preference order
+	Replicas []Storage `json:"replicas,omitempty"`
+	// WriteQuorum is how many replicas a write must reach (default all)
+	WriteQuorum int `json:"write_quorum,omitempty"`
+}
+
+// Chunker selects how files are split for the repository.
+// Changing it on an existing repository loses deduplication with older snapshots.
+type Chunker struct {
+	Algorithm string `json:"algorithm"`          // "fixed" (default) or "fastcdc"
+	MinSize   int    `json:"min_size,omitempty"` // bytes, fastcdc only
+	AvgSize   int    `json:"avg_size,omitempty"` // bytes
+	MaxSize   int    `json:"max_size,omitempty"` // bytes, fastcdc only
+}
+
+// Parity enables Reed-Solomon parity for new chunks, so audit can repair
+// up to ParityShards damaged chunks out of every DataShards
+type Parity struct {
+	DataShards   int `json:"data_shards"`   // default 10
+	ParityShards int `json:"parity_shards"` // default 2
+}
+
+// Server configures `aegis serve`, which exposes a local repository
+// directory to REST clients
+type Server struct {
+	Listen     string         `json:"listen"` // e.g. ":8000"
+	Path       string         `json:"path"`   // repository directory to serve
+	TLSCert    string         `json:"tls_cert,omitempty"`
+	TLSKey     string         `json:"tls_key,omitempty"`
+	AppendOnly bool           `json:"append_only,omitempty"` // refuse deletes and overwrites for all clients
+	Clients    []ServerClient `json:"clients"`
+}
+
+// ServerClient is a client allowed to use the server, identified by its token
+type ServerClient struct {
+	Name       string `json:"name"`
+	Token      string `json:"token"`
+	AppendOnly bool   `json:"append_only,omitempty"`
 }
 
 type RestoreConfig struct {
@@ -28,9 +112,21 @@ type RestoreConfig struct {
 }
 
 type Job struct {
-	Name     string `json:"name"`
-	Path     string `json:"path"`
-	Interval string `json:"interval"` // e.g., "1h", "10m"
+	Name      string     `json:"name"`
+	Path      string     `json:"path"`
+	Interval  string     `json:"interval"` // e.g., "1h", "10m"
+	Retention *Retention `json:"retention,omitempty"`
+}
+
+// Retention decides which snapshots of a job survive.
+// A snapshot is kept if any rule selects it; zero disables a rule.
+type Retention struct {
+	KeepLast    int `json:"keep_last,omitempty"`
+	KeepHourly  int `json:"keep_hourly,omitempty"`
+	KeepDaily   int `json:"keep_daily,omitempty"`
+	KeepWeekly  int `json:"keep_weekly,omitempty"`
+	KeepMonthly int `json:"keep_monthly,omitempty"`
+	KeepYearly  int `json:"keep_yearly,omitempty"`
 }
 
 func Load(path string) (*Config, error) {
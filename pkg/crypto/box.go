@@ -0,0 +1,158 @@
+package crypto
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/pranavdwivedi/aegis/pkg/hash"
+)
+
+// boxContext is the BLAKE3 derive-key context for sealed key encryption keys
+const boxContext = "aegis 2026-01 sealed master key"
+
+// boxVersion is the format written by PublicKey.Seal:
+//
+//	version (1) | ephemeral public key (32) | cipher (1) | nonce||ciphertext
+const boxVersion = 1
+
+// PublicKey is an X25519 public key. Holders can seal keys that only the
+// matching PrivateKey opens.
+type PublicKey [32]byte
+
+// MarshalText encodes the public key as hex
+func (pk PublicKey) MarshalText() ([]byte, error) {
+	return []byte(hex.EncodeToString(pk[:])), nil
+}
+
+// UnmarshalText decodes a public key written by MarshalText
+func (pk *PublicKey) UnmarshalText(text []byte) error {
+	b, err := hex.DecodeString(string(text))
+	if err != nil || len(b) != len(pk) {
+		return fmt.Errorf("invalid public key")
+	}
+	copy(pk[:], b)
+	return nil
+}
+
+// PrivateKey is an X25519 private key
+type PrivateKey [32]byte
+
+// MarshalText encodes the private key as hex
+func (sk PrivateKey) MarshalText() ([]byte, error) {
+	return []byte(hex.EncodeToString(sk[:])), nil
+}
+
+// UnmarshalText decodes a private key written by MarshalText
+func (sk *PrivateKey) UnmarshalText(text []byte) error {
+	b, err := hex.DecodeString(string(text))
+	if err != nil || len(b) != len(sk) {
+		return fmt.Errorf("invalid private key")
+	}
+	copy(sk[:], b)
+	return nil
+}
+
+// GenerateKeyPair returns a random X25519 private key
+func GenerateKeyPair() (PrivateKey, error) {
+	var sk PrivateKey
+	k, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return sk, err
+	}
+	copy(sk[:], k.Bytes())
+	return sk, nil
+}
+
+// Public returns the public key of sk
+func (sk PrivateKey) Public() (PublicKey, error) {
+	var pk PublicKey
+	k, err := ecdh.X25519().NewPrivateKey(sk[:])
+	if err != nil {
+		return pk, err
+	}
+	copy(pk[:], k.PublicKey().Bytes())
+	return pk, nil
+}
+
+// boxKey derives the key encryption key from the X25519 shared secret and
+// both public keys
+func boxKey(shared []byte, ephemeral, recipient PublicKey) (MasterKey, error) {
+	material := make([]byte, 0, len(shared)+64)
+	material = append(material, shared...)
+	material = append(material, ephemeral[:]...)
+	material = append(material, recipient[:]...)
+	return MasterKeyFromBytes(hash.DeriveKey(boxContext, material), CipherAES256GCM)
+}
+
+// Seal encrypts k (and its cipher) so that only the private key of pk can
+// recover it. A fresh ephemeral key is used for every call.
+func (pk PublicKey) Seal(k MasterKey) ([]byte, error) {
+	recipient, err := ecdh.X25519().NewPublicKey(pk[:])
+	if err != nil {
+		return nil, err
+	}
+	eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := eph.ECDH(recipient)
+	if err != nil {
+		return nil, err
+	}
+
+	var ephPub PublicKey
+	copy(ephPub[:], eph.PublicKey().Bytes())
+	kek, err := boxKey(shared, ephPub, pk)
+	if err != nil {
+		return nil, err
+	}
+
+	hdr := make([]byte, 0, 34)
+	hdr = append(hdr, boxVersion)
+	hdr = append(hdr, ephPub[:]...)
+	hdr = append(hdr, byte(k.Cipher()))
+	encrypted, err := kek.EncryptWithAD(k.key[:], hdr)
+	if err != nil {
+		return nil, err
+	}
+	return append(hdr, encrypted...), nil
+}
+
+// Open recovers a key sealed with the public key of sk
+func (sk PrivateKey) Open(sealed []byte) (MasterKey, error) {
+	if len(sealed) < 34 || sealed[0] != boxVersion {
+		return MasterKey{}, fmt.Errorf("unsupported sealed key format")
+	}
+	hdr, encrypted := sealed[:34], sealed[34:]
+
+	priv, err := ecdh.X25519().NewPrivateKey(sk[:])
+	if err != nil {
+		return MasterKey{}, err
+	}
+	var ephPub PublicKey
+	copy(ephPub[:], hdr[1:33])
+	eph, err := ecdh.X25519().NewPublicKey(ephPub[:])
+	if err != nil {
+		return MasterKey{}, err
+	}
+	shared, err := priv.ECDH(eph)
+	if err != nil {
+		return MasterKey{}, err
+	}
+
+	pk, err := sk.Public()
+	if err != nil {
+		return MasterKey{}, err
+	}
+	kek, err := boxKey(shared, ephPub, pk)
+	if err != nil {
+		return MasterKey{}, err
+	}
+	plain, err := kek.DecryptWithAD(encrypted, hdr)
+	if err != nil {
+		return MasterKey{}, fmt.Errorf("sealed key does not open with this private key: %w", err)
+	}
+	return MasterKeyFromBytes(plain, Cipher(hdr[33]))
+}
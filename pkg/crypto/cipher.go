@@ -0,0 +1,129 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Cipher selects the AEAD a repository encrypts with. It is chosen at init
+// and recorded in the key file.
+type Cipher uint8
+
+const (
+	// CipherAES256GCM is AES-256-GCM with random 96-bit nonces (the default)
+	CipherAES256GCM Cipher = 1
+	// CipherXChaCha20Poly1305 uses random 192-bit nonces, so one key can seal
+	// practically unlimited objects, and is fast without AES hardware (ARM)
+	CipherXChaCha20Poly1305 Cipher = 2
+)
+
+// DefaultCipher is used when no cipher is selected
+const DefaultCipher = CipherAES256GCM
+
+var cipherNames = map[Cipher]string{
+	CipherAES256GCM:         "aes-256-gcm",
+	CipherXChaCha20Poly1305: "xchacha20-poly1305",
+}
+
+// ParseCipher returns the cipher with the given name; "" selects DefaultCipher
+func ParseCipher(name string) (Cipher, error) {
+	if name == "" {
+		return DefaultCipher, nil
+	}
+	for c, n := range cipherNames {
+		if n == name {
+			return c, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown cipher %q", name)
+}
+
+// orDefault returns DefaultCipher for the zero value
+func (c Cipher) orDefault() Cipher {
+	if c == 0 {
+		return DefaultCipher
+	}
+	return c
+}
+
+// Valid reports whether c is a known cipher
+func (c Cipher) Valid() bool {
+	_, ok := cipherNames[c]
+	return ok
+}
+
+func (c Cipher) String() string {
+	if n, ok := cipherNames[c]; ok {
+		return n
+	}
+	return fmt.Sprintf("cipher(%d)", uint8(c))
+}
+
+// MarshalText records the cipher by name in key files
+func (c Cipher) MarshalText() ([]byte, error) {
+	if !c.Valid() {
+		return nil, fmt.Errorf("unknown cipher %d", uint8(c))
+	}
+	return []byte(c.String()), nil
+}
+
+// UnmarshalText parses a cipher name written by MarshalText
+func (c *Cipher) UnmarshalText(text []byte) error {
+	parsed, err := ParseCipher(string(text))
+	if err != nil {
+		return err
+	}
+	*c = parsed
+	return nil
+}
+
+// aead returns the AEAD for key
+func (c Cipher) aead(key []byte) (cipher.AEAD, error) {
+	switch c {
+	case CipherAES256GCM:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	case CipherXChaCha20Poly1305:
+		return chacha20poly1305.NewX(key)
+	default:
+		return nil, fmt.Errorf("unsupported cipher %d", uint8(c))
+	}
+}
+
+// seal encrypts plaintext with a random nonce, prepended to the ciphertext
+func (c Cipher) seal(key, plaintext, ad []byte) ([]byte, error) {
+	aead, err := c.aead(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, plaintext, ad), nil
+}
+
+// open decrypts data written by seal
+func (c Cipher) open(key, ciphertext, ad []byte) ([]byte, error) {
+	aead, err := c.aead(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+
+	nonce, encryptedData := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+	return aead.Open(nil, nonce, encryptedData, ad)
+}
@@ -0,0 +1,81 @@
+package crypto
+
+import (
+	"fmt"
+	"runtime"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// MaxKDFMemory caps the Argon2id memory (KiB) accepted from a key file, so a
+// tampered key file cannot make unlocking exhaust the machine's memory (4GB).
+const MaxKDFMemory = 4 * 1024 * 1024
+
+// KDFParams are the Argon2id parameters used to derive a key-encryption key
+type KDFParams struct {
+	Time    uint32 `json:"time"`
+	Memory  uint32 `json:"memory"` // KiB
+	Threads uint8  `json:"threads"`
+}
+
+// DefaultKDFParams are time=1, memory=64MB, threads=4.
+// Key slots that do not record their parameters were derived with these.
+var DefaultKDFParams = KDFParams{Time: 1, Memory: 64 * 1024, Threads: 4}
+
+// orDefault returns DefaultKDFParams for the zero value
+func (p KDFParams) orDefault() KDFParams {
+	if p == (KDFParams{}) {
+		return DefaultKDFParams
+	}
+	return p
+}
+
+// Validate rejects parameters that are unusable or unreasonably expensive
+func (p KDFParams) Validate() error {
+	if p.Time < 1 || p.Threads < 1 {
+		return fmt.Errorf("invalid kdf params: time and threads must be at least 1")
+	}
+	if p.Memory < 8*uint32(p.Threads) {
+		return fmt.Errorf("invalid kdf params: memory must be at least 8KiB per thread")
+	}
+	if p.Memory > MaxKDFMemory {
+		return fmt.Errorf("invalid kdf params: memory %dKiB exceeds limit of %dKiB", p.Memory, MaxKDFMemory)
+	}
+	return nil
+}
+
+// DeriveKey derives a 32 byte key from the passphrase using Argon2id
+func (p KDFParams) DeriveKey(passphrase string, salt []byte) []byte {
+	return argon2.IDKey([]byte(passphrase), salt, p.Time, p.Memory, p.Threads, KeySize)
+}
+
+// CalibrateKDF picks parameters that take about target to derive a key on
+// this machine, never weaker than DefaultKDFParams. Memory grows first (up
+// to maxMemory KiB, 0 for 1GB), then the number of passes.
+func CalibrateKDF(target time.Duration, maxMemory uint32) KDFParams {
+	if maxMemory == 0 {
+		maxMemory = 1024 * 1024
+	}
+	maxMemory = min(maxMemory, MaxKDFMemory)
+
+	p := DefaultKDFParams
+	p.Threads = uint8(min(runtime.NumCPU(), 4))
+	salt := make([]byte, 16)
+
+	measure := func() time.Duration {
+		start := time.Now()
+		p.DeriveKey("calibration", salt)
+		return time.Since(start)
+	}
+
+	elapsed := measure()
+	for elapsed < target/2 && p.Memory*2 <= maxMemory {
+		p.Memory *= 2
+		elapsed = measure()
+	}
+	if elapsed > 0 && elapsed < target {
+		p.Time = uint32((int64(target)*int64(p.Time) + int64(elapsed) - 1) / int64(elapsed))
+	}
+	return p
+}
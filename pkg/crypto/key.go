@@ -1,117 +1,142 @@
 package crypto
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
 	"crypto/rand"
-	"encoding/json"
 	"fmt"
 	"io"
 	"os"
 
-	"golang.org/x/crypto/argon2"
+	"github.com/pranavdwivedi/aegis/pkg/hash"
 )
 
 const (
 	KeySize   = 32
 	NonceSize = 12
+	KeyIDSize = 8
 )
 
-// MasterKey represents the 256-bit repository key
-type MasterKey [KeySize]byte
+// keyIDContext is the BLAKE3 derive-key context for master key ids
+const keyIDContext = "aegis 2026-01 master key id"
 
-// NewMasterKey generates a random master key
+// MasterKey represents the 256-bit repository key and the cipher the
+// repository encrypts with
+type MasterKey struct {
+	key    [KeySize]byte
+	cipher Cipher
+
+	// private opens the data keys of write-only backups, if the operator
+	// supplied it (see WithPrivateKey)
+	private *PrivateKey
+}
+
+// KeyID identifies a master key without revealing it
+type KeyID [KeyIDSize]byte
+
+// NewMasterKey generates a random master key using DefaultCipher
 func NewMasterKey() (MasterKey, error) {
-	var k MasterKey
-	if _, err := io.ReadFull(rand.Reader, k[:]); err != nil {
+	k := MasterKey{cipher: DefaultCipher}
+	if _, err := io.ReadFull(rand.Reader, k.key[:]); err != nil {
 		return k, err
 	}
 	return k, nil
 }
 
-// DeriveKeyFromPassphrase derives a key using Argon2id
+// MasterKeyFromBytes rebuilds a master key from Bytes and its cipher
+func MasterKeyFromBytes(b []byte, c Cipher) (MasterKey, error) {
+	var k MasterKey
+	if len(b) != KeySize {
+		return k, fmt.Errorf("master key must be %d bytes, got %d", KeySize, len(b))
+	}
+	if c = c.orDefault(); !c.Valid() {
+		return k, fmt.Errorf("unsupported cipher %d", uint8(c))
+	}
+	copy(k.key[:], b)
+	k.cipher = c
+	return k, nil
+}
+
+// Bytes returns a copy of the raw key material
+func (k MasterKey) Bytes() []byte {
+	return append([]byte(nil), k.key[:]...)
+}
+
+// Cipher returns the cipher Encrypt uses
+func (k MasterKey) Cipher() Cipher {
+	return k.cipher.orDefault()
+}
+
+// WithCipher returns the same key encrypting with c
+func (k MasterKey) WithCipher(c Cipher) MasterKey {
+	k.cipher = c.orDefault()
+	return k
+}
+
+// WithPrivateKey returns the same key, also holding the write-only private
+// key sk. It is kept by the operator, not in the repository.
+func (k MasterKey) WithPrivateKey(sk PrivateKey) MasterKey {
+	k.private = &sk
+	return k
+}
+
+// PrivateKey returns the write-only private key held with k, or nil
+func (k MasterKey) PrivateKey() *PrivateKey {
+	return k.private
+}
+
+// ID returns the id of the master key, recorded in every object it seals.
+// It does not depend on the cipher.
+func (k MasterKey) ID() KeyID {
+	var id KeyID
+	copy(id[:], hash.DeriveKey(keyIDContext, k.key[:]))
+	return id
+}
+
+// DeriveKeyFromPassphrase derives a key using Argon2id with DefaultKDFParams
 // salt must be 16 bytes
 func DeriveKeyFromPassphrase(passphrase string, salt []byte) []byte {
-	// Params: time=1, memory=64MB, threads=4, keyLen=32
-	return argon2.IDKey([]byte(passphrase), salt, 1, 64*1024, 4, 32)
+	return DefaultKDFParams.DeriveKey(passphrase, salt)
 }
 
-// Encrypt encrypts data using AES-256-GCM with a random nonce.
+// Encrypt encrypts data with the key's cipher and a random nonce.
 // The nonce is prepended to the ciphertext.
 func (k MasterKey) Encrypt(plaintext []byte) ([]byte, error) {
-	block, err := aes.NewCipher(k[:])
-	if err != nil {
-		return nil, err
-	}
-
-	gcm, err := cipher.NewGCM(block)
-	if err != nil {
-		return nil, err
-	}
+	return k.EncryptWithAD(plaintext, nil)
+}
 
-	nonce := make([]byte, gcm.NonceSize())
-	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
-		return nil, err
-	}
+// EncryptWithAD is Encrypt with associated data. The ciphertext only
+// decrypts when the same associated data is supplied, which binds it to
+// its context (e.g. the id it is stored under).
+func (k MasterKey) EncryptWithAD(plaintext, ad []byte) ([]byte, error) {
+	return k.EncryptWith(k.Cipher(), plaintext, ad)
+}
 
-	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+// EncryptWith is EncryptWithAD with an explicit cipher
+func (k MasterKey) EncryptWith(c Cipher, plaintext, ad []byte) ([]byte, error) {
+	return c.seal(k.key[:], plaintext, ad)
 }
 
-// Decrypt decrypts data using AES-256-GCM.
+// Decrypt decrypts data written by Encrypt.
 // Expects nonce prepended to ciphertext.
 func (k MasterKey) Decrypt(ciphertext []byte) ([]byte, error) {
-	block, err := aes.NewCipher(k[:])
-	if err != nil {
-		return nil, err
-	}
-
-	gcm, err := cipher.NewGCM(block)
-	if err != nil {
-		return nil, err
-	}
-
-	if len(ciphertext) < gcm.NonceSize() {
-		return nil, fmt.Errorf("ciphertext too short")
-	}
+	return k.DecryptWithAD(ciphertext, nil)
+}
 
-	nonce, encryptedData := ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():]
-	return gcm.Open(nil, nonce, encryptedData, nil)
+// DecryptWithAD decrypts data written by EncryptWithAD with the same associated data
+func (k MasterKey) DecryptWithAD(ciphertext, ad []byte) ([]byte, error) {
+	return k.DecryptWith(k.Cipher(), ciphertext, ad)
 }
 
-// KeyFile structure for storing the encrypted master key
-type KeyFile struct {
-	Salt         []byte `json:"salt"`
-	EncryptedKey []byte `json:"encrypted_key"`
-	Algorithm    string `json:"algo"` // "argon2id_aes256gcm"
+// DecryptWith decrypts data written by EncryptWith with the same cipher and associated data
+func (k MasterKey) DecryptWith(c Cipher, ciphertext, ad []byte) ([]byte, error) {
+	return c.open(k.key[:], ciphertext, ad)
 }
 
 // SaveKey stores the master key to disk, encrypted by the passphrase
 func SaveKey(path string, mk MasterKey, passphrase string) error {
-	salt := make([]byte, 16)
-	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
-		return err
-	}
-
-	kekFunc := DeriveKeyFromPassphrase(passphrase, salt)
-	var kek MasterKey
-	copy(kek[:], kekFunc)
-
-	encryptedMK, err := kek.Encrypt(mk[:])
+	data, err := SealKey(mk, passphrase, DefaultKDFParams)
 	if err != nil {
 		return err
 	}
-
-	kf := KeyFile{
-		Salt:         salt,
-		EncryptedKey: encryptedMK,
-		Algorithm:    "argon2id_aes256gcm",
-	}
-
-	data, err := json.Marshal(kf)
-	if err != nil {
-		return err
-	}
-
 	return os.WriteFile(path, data, 0600)
 }
 
@@ -121,22 +146,5 @@ func LoadKey(path string, passphrase string) (MasterKey, error) {
 	if err != nil {
 		return MasterKey{}, err
 	}
-
-	var kf KeyFile
-	if err := json.Unmarshal(data, &kf); err != nil {
-		return MasterKey{}, err
-	}
-
-	kekFunc := DeriveKeyFromPassphrase(passphrase, kf.Salt)
-	var kek MasterKey
-	copy(kek[:], kekFunc)
-
-	decryptedBytes, err := kek.Decrypt(kf.EncryptedKey)
-	if err != nil {
-		return MasterKey{}, fmt.Errorf("invalid passphrase or corrupted key file")
-	}
-
-	var mk MasterKey
-	copy(mk[:], decryptedBytes)
-	return mk, nil
+	return OpenKey(data, passphrase)
 }
@@ -0,0 +1,225 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// ErrLastSlot is returned when removing the only remaining key slot
+var ErrLastSlot = errors.New("cannot remove the last key slot")
+
+// KeySlot wraps the master key with a key derived from one passphrase
+type KeySlot struct {
+	ID           string    `json:"id"`
+	Label        string    `json:"label"`
+	Salt         []byte    `json:"salt"`
+	EncryptedKey []byte    `json:"encrypted_key"`
+	KDF          KDFParams `json:"kdf"` // zero for slots written before params were recorded
+	Created      time.Time `json:"created"`
+	// Version 1 slots bind EncryptedKey to the slot id and the repository
+	// cipher as associated data. The slot migrated from a legacy
+	// single-passphrase key file is version 0 and has none.
+	Version int `json:"version,omitempty"`
+}
+
+// keySlotVersion is the slot format written by wrap
+const keySlotVersion = 1
+
+// ad returns the associated data binding the wrapped key to this slot
+func (s *KeySlot) ad(c Cipher) []byte {
+	if s.Version == 0 {
+		return nil
+	}
+	return []byte("aegis key slot " + s.ID + " " + c.String())
+}
+
+// KeyFile structure for storing the encrypted master key.
+// Every slot unlocks the same master key with its own passphrase.
+type KeyFile struct {
+	// Salt and EncryptedKey hold the single passphrase of key files written
+	// before slots existed. They are migrated into Slots when parsed.
+	Salt         []byte `json:"salt,omitempty"`
+	EncryptedKey []byte `json:"encrypted_key,omitempty"`
+	Algorithm    string `json:"algo"` // "argon2id_aes256gcm", how slots wrap the key
+	// Cipher is the repository cipher selected at init. Absent in key files
+	// written before it could be chosen, which use AES-256-GCM.
+	Cipher Cipher    `json:"cipher,omitempty"`
+	Slots  []KeySlot `json:"slots,omitempty"`
+}
+
+// NewKeyFile wraps the master key with a key derived from the passphrase and
+// records the key's cipher. Zero params select DefaultKDFParams.
+func NewKeyFile(mk MasterKey, passphrase string, params KDFParams) (*KeyFile, error) {
+	kf := &KeyFile{Algorithm: "argon2id_aes256gcm", Cipher: mk.Cipher()}
+	if _, err := kf.AddSlot(mk, "default", passphrase, params); err != nil {
+		return nil, err
+	}
+	return kf, nil
+}
+
+// ParseKeyFile decodes a serialized key file
+func ParseKeyFile(data []byte) (*KeyFile, error) {
+	var kf KeyFile
+	if err := json.Unmarshal(data, &kf); err != nil {
+		return nil, err
+	}
+
+	// Legacy single-passphrase key file
+	if len(kf.Slots) == 0 && len(kf.EncryptedKey) > 0 {
+		kf.Slots = []KeySlot{{
+			ID:           "legacy",
+			Label:        "default",
+			Salt:         kf.Salt,
+			EncryptedKey: kf.EncryptedKey,
+			KDF:          DefaultKDFParams,
+		}}
+		kf.Salt, kf.EncryptedKey = nil, nil
+	}
+	return &kf, nil
+}
+
+// AddSlot adds a passphrase that unlocks mk and returns the new slot id.
+// mk must be the master key already held by this key file.
+// Zero params select DefaultKDFParams.
+func (kf *KeyFile) AddSlot(mk MasterKey, label, passphrase string, params KDFParams) (string, error) {
+	id := make([]byte, 8)
+	if _, err := io.ReadFull(rand.Reader, id); err != nil {
+		return "", err
+	}
+
+	slot := KeySlot{
+		ID:      hex.EncodeToString(id),
+		Label:   label,
+		Created: time.Now().UTC(),
+	}
+	if err := slot.wrap(mk.WithCipher(kf.Cipher), passphrase, params); err != nil {
+		return "", err
+	}
+	kf.Slots = append(kf.Slots, slot)
+	return slot.ID, nil
+}
+
+// wrap (re)encrypts mk into the slot with a fresh salt, bound to mk's cipher
+func (s *KeySlot) wrap(mk MasterKey, passphrase string, params KDFParams) error {
+	params = params.orDefault()
+	if err := params.Validate(); err != nil {
+		return err
+	}
+
+	salt := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return err
+	}
+
+	kek, err := MasterKeyFromBytes(params.DeriveKey(passphrase, salt), CipherAES256GCM)
+	if err != nil {
+		return err
+	}
+
+	s.Version = keySlotVersion
+	encryptedMK, err := kek.EncryptWithAD(mk.key[:], s.ad(mk.Cipher()))
+	if err != nil {
+		return err
+	}
+
+	s.Salt = salt
+	s.EncryptedKey = encryptedMK
+	s.KDF = params
+	return nil
+}
+
+// unwrap recovers the master key from the slot of a key file using cipher c
+func (s *KeySlot) unwrap(passphrase string, c Cipher) (MasterKey, error) {
+	if s.Version > keySlotVersion {
+		return MasterKey{}, fmt.Errorf("unsupported key slot version %d", s.Version)
+	}
+	params := s.KDF.orDefault()
+	if err := params.Validate(); err != nil {
+		return MasterKey{}, err
+	}
+
+	kek, err := MasterKeyFromBytes(params.DeriveKey(passphrase, s.Salt), CipherAES256GCM)
+	if err != nil {
+		return MasterKey{}, err
+	}
+
+	c = c.orDefault()
+	decryptedBytes, err := kek.DecryptWithAD(s.EncryptedKey, s.ad(c))
+	if err != nil {
+		return MasterKey{}, err
+	}
+	return MasterKeyFromBytes(decryptedBytes, c)
+}
+
+// RewrapSlot re-derives the slot unlocked by passphrase with new parameters
+// (e.g. after calibrating stronger ones). Returns the slot id.
+func (kf *KeyFile) RewrapSlot(passphrase string, params KDFParams) (string, error) {
+	for i := range kf.Slots {
+		s := &kf.Slots[i]
+		mk, err := s.unwrap(passphrase, kf.Cipher)
+		if err != nil {
+			continue
+		}
+		if err := s.wrap(mk, passphrase, params); err != nil {
+			return "", err
+		}
+		return s.ID, nil
+	}
+	return "", fmt.Errorf("invalid passphrase or corrupted key file")
+}
+
+// RemoveSlot deletes a slot. The last slot can never be removed.
+func (kf *KeyFile) RemoveSlot(id string) error {
+	for i, s := range kf.Slots {
+		if s.ID != id {
+			continue
+		}
+		if len(kf.Slots) == 1 {
+			return ErrLastSlot
+		}
+		kf.Slots = append(kf.Slots[:i], kf.Slots[i+1:]...)
+		return nil
+	}
+	return fmt.Errorf("key slot %s not found", id)
+}
+
+// Unlock recovers the master key using the passphrase of any slot
+func (kf *KeyFile) Unlock(passphrase string) (MasterKey, error) {
+	mk, _, err := kf.UnlockSlot(passphrase)
+	return mk, err
+}
+
+// UnlockSlot is Unlock that also reports which slot matched
+func (kf *KeyFile) UnlockSlot(passphrase string) (MasterKey, string, error) {
+	for _, s := range kf.Slots {
+		mk, err := s.unwrap(passphrase, kf.Cipher)
+		if err != nil {
+			continue
+		}
+		return mk, s.ID, nil
+	}
+	return MasterKey{}, "", fmt.Errorf("invalid passphrase or corrupted key file")
+}
+
+// SealKey returns the serialized key file for mk, encrypted by the passphrase
+func SealKey(mk MasterKey, passphrase string, params KDFParams) ([]byte, error) {
+	kf, err := NewKeyFile(mk, passphrase, params)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(kf)
+}
+
+// OpenKey loads the master key from a serialized key file using the passphrase
+func OpenKey(data []byte, passphrase string) (MasterKey, error) {
+	kf, err := ParseKeyFile(data)
+	if err != nil {
+		return MasterKey{}, err
+	}
+	return kf.Unlock(passphrase)
+}
@@ -0,0 +1,214 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/pranavdwivedi/aegis/pkg/hash"
+)
+
+// Recovery shares split the master key with Shamir's secret sharing over
+// GF(2^8): any threshold of them rebuild the key, fewer reveal nothing.
+//
+// A share is printed as "AEGIS1-" followed by the base32 encoding of
+//
+//	version (1) | threshold (1) | x (1) | cipher (1) | key id (8) | y (32) | checksum (4)
+//
+// in groups of six characters. Upper-case base32 and '-' fit the QR code
+// alphanumeric mode. The checksum catches typos in a single share, the key id
+// that the shares belong to the same key.
+const (
+	sharePrefix   = "AEGIS1-"
+	shareVersion  = 1
+	shareGroup    = 6
+	shareChecksum = 4
+	shareSize     = 4 + KeyIDSize + KeySize + shareChecksum
+)
+
+// MaxShares is the largest number of shares a key can be split into
+const MaxShares = 255
+
+// ErrShareMismatch is returned when shares of different keys or splits are combined
+var ErrShareMismatch = errors.New("recovery shares do not belong together")
+
+var shareEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// SplitKey splits mk into n shares, any threshold of which recover it with
+// CombineShares
+func SplitKey(mk MasterKey, threshold, n int) ([]string, error) {
+	if threshold < 2 || threshold > n || n > MaxShares {
+		return nil, fmt.Errorf("invalid recovery split %d-of-%d: need 2 <= threshold <= shares <= %d", threshold, n, MaxShares)
+	}
+
+	// One random polynomial per key byte, with the byte as constant term
+	coeffs := make([][]byte, KeySize)
+	for i := range coeffs {
+		coeffs[i] = make([]byte, threshold)
+		if _, err := io.ReadFull(rand.Reader, coeffs[i][1:]); err != nil {
+			return nil, err
+		}
+		coeffs[i][0] = mk.key[i]
+	}
+
+	id := mk.ID()
+	shares := make([]string, n)
+	for x := 1; x <= n; x++ {
+		b := make([]byte, 0, shareSize)
+		b = append(b, shareVersion, byte(threshold), byte(x), byte(mk.Cipher()))
+		b = append(b, id[:]...)
+		for i := range coeffs {
+			b = append(b, gfEval(coeffs[i], byte(x)))
+		}
+		b = append(b, hash.Sum(b).Bytes()[:shareChecksum]...)
+		shares[x-1] = formatShare(b)
+	}
+	return shares, nil
+}
+
+// CombineShares rebuilds the master key from at least threshold shares
+// written by SplitKey. The result is checked against the key id the shares
+// record, so too few or altered shares never yield a wrong key.
+func CombineShares(shares []string) (MasterKey, error) {
+	if len(shares) == 0 {
+		return MasterKey{}, fmt.Errorf("no recovery shares given")
+	}
+
+	parsed := make([][]byte, 0, len(shares))
+	seen := make(map[byte]bool)
+	for i, s := range shares {
+		b, err := parseShare(s)
+		if err != nil {
+			return MasterKey{}, fmt.Errorf("share %d: %w", i+1, err)
+		}
+		// Everything but x must agree with the first share
+		if len(parsed) > 0 && (b[1] != parsed[0][1] || !bytes.Equal(b[3:4+KeyIDSize], parsed[0][3:4+KeyIDSize])) {
+			return MasterKey{}, fmt.Errorf("share %d: %w", i+1, ErrShareMismatch)
+		}
+		if seen[b[2]] {
+			continue // the same share entered twice
+		}
+		seen[b[2]] = true
+		parsed = append(parsed, b)
+	}
+
+	threshold := int(parsed[0][1])
+	if len(parsed) < threshold {
+		return MasterKey{}, fmt.Errorf("need %d distinct recovery shares, got %d", threshold, len(parsed))
+	}
+	parsed = parsed[:threshold]
+
+	xs := make([]byte, threshold)
+	for j, b := range parsed {
+		xs[j] = b[2]
+	}
+	key := make([]byte, KeySize)
+	ys := make([]byte, threshold)
+	for i := range key {
+		for j, b := range parsed {
+			ys[j] = b[4+KeyIDSize+i]
+		}
+		key[i] = gfInterpolate(xs, ys)
+	}
+
+	mk, err := MasterKeyFromBytes(key, Cipher(parsed[0][3]))
+	if err != nil {
+		return MasterKey{}, err
+	}
+	if id := mk.ID(); !bytes.Equal(id[:], parsed[0][4:4+KeyIDSize]) {
+		return MasterKey{}, fmt.Errorf("%w: recovered key does not match its id", ErrShareMismatch)
+	}
+	return mk, nil
+}
+
+// formatShare encodes a share as printable text
+func formatShare(b []byte) string {
+	enc := shareEncoding.EncodeToString(b)
+	groups := make([]string, 0, len(enc)/shareGroup+1)
+	for len(enc) > shareGroup {
+		groups = append(groups, enc[:shareGroup])
+		enc = enc[shareGroup:]
+	}
+	groups = append(groups, enc)
+	return sharePrefix + strings.Join(groups, "-")
+}
+
+// parseShare decodes a share written by formatShare. Case, spaces and
+// dashes are ignored so hand-typed shares parse.
+func parseShare(s string) ([]byte, error) {
+	s = strings.ToUpper(strings.Join(strings.Fields(s), ""))
+	if !strings.HasPrefix(s, sharePrefix) {
+		return nil, fmt.Errorf("not an aegis recovery share")
+	}
+	s = strings.ReplaceAll(strings.TrimPrefix(s, sharePrefix), "-", "")
+
+	b, err := shareEncoding.DecodeString(s)
+	if err != nil || len(b) != shareSize {
+		return nil, fmt.Errorf("malformed recovery share")
+	}
+	body, sum := b[:shareSize-shareChecksum], b[shareSize-shareChecksum:]
+	if !bytes.Equal(hash.Sum(body).Bytes()[:shareChecksum], sum) {
+		return nil, fmt.Errorf("recovery share checksum mismatch (typo?)")
+	}
+	if body[0] != shareVersion {
+		return nil, fmt.Errorf("unsupported recovery share version %d", body[0])
+	}
+	if body[1] < 2 || body[2] == 0 {
+		return nil, fmt.Errorf("malformed recovery share")
+	}
+	return body, nil
+}
+
+// gfMul multiplies in GF(2^8) with the AES polynomial x^8+x^4+x^3+x+1.
+// It runs in constant time.
+func gfMul(a, b byte) byte {
+	var p byte
+	for range 8 {
+		p ^= -(b & 1) & a
+		carry := -(a >> 7)
+		a = a<<1 ^ carry&0x1b
+		b >>= 1
+	}
+	return p
+}
+
+// gfInv returns the multiplicative inverse of a (a^254)
+func gfInv(a byte) byte {
+	r := a
+	for range 6 {
+		a = gfMul(a, a)
+		r = gfMul(r, a)
+	}
+	return gfMul(r, r)
+}
+
+// gfEval evaluates the polynomial with the given coefficients at x
+func gfEval(coeffs []byte, x byte) byte {
+	var y byte
+	for i := len(coeffs) - 1; i >= 0; i-- {
+		y = gfMul(y, x) ^ coeffs[i]
+	}
+	return y
+}
+
+// gfInterpolate returns the value at 0 of the polynomial through (xs, ys)
+func gfInterpolate(xs, ys []byte) byte {
+	var secret byte
+	for j := range xs {
+		// Lagrange basis at 0: prod x_m / (x_m - x_j); subtraction is xor
+		num, den := byte(1), byte(1)
+		for m := range xs {
+			if m == j {
+				continue
+			}
+			num = gfMul(num, xs[m])
+			den = gfMul(den, xs[m]^xs[j])
+		}
+		secret ^= gfMul(ys[j], gfMul(num, gfInv(den)))
+	}
+	return secret
+}
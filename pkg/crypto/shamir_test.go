@@ -0,0 +1,145 @@
+package crypto
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// subsets calls fn with every subset of size k of shares, in order
+func subsets(shares []string, k int, fn func([]string)) {
+	var pick func(start int, chosen []string)
+	pick = func(start int, chosen []string) {
+		if len(chosen) == k {
+			fn(append([]string(nil), chosen...))
+			return
+		}
+		for i := start; i < len(shares); i++ {
+			pick(i+1, append(chosen, shares[i]))
+		}
+	}
+	pick(0, nil)
+}
+
+func TestSplitCombine(t *testing.T) {
+	mk, err := NewMasterKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mk = mk.WithCipher(CipherXChaCha20Poly1305)
+
+	for _, split := range []struct{ k, n int }{{2, 2}, {2, 3}, {3, 5}, {5, 5}} {
+		shares, err := SplitKey(mk, split.k, split.n)
+		if err != nil {
+			t.Fatalf("%d-of-%d: %v", split.k, split.n, err)
+		}
+		if len(shares) != split.n {
+			t.Fatalf("%d-of-%d gave %d shares", split.k, split.n, len(shares))
+		}
+
+		subsets(shares, split.k, func(s []string) {
+			// Order does not matter
+			for _, order := range [][]string{s, reverse(s)} {
+				got, err := CombineShares(order)
+				if err != nil {
+					t.Fatalf("%d-of-%d: %v", split.k, split.n, err)
+				}
+				if !bytes.Equal(got.Bytes(), mk.Bytes()) || got.Cipher() != mk.Cipher() {
+					t.Fatalf("%d-of-%d rebuilt another key", split.k, split.n)
+				}
+			}
+		})
+		subsets(shares, split.k-1, func(s []string) {
+			if _, err := CombineShares(s); err == nil {
+				t.Fatalf("%d-of-%d combined from %d shares", split.k, split.n, len(s))
+			}
+			// A share entered twice does not count twice
+			if _, err := CombineShares(append(s, s[0])); err == nil {
+				t.Fatalf("%d-of-%d combined with a repeated share", split.k, split.n)
+			}
+		})
+	}
+}
+
+func reverse(s []string) []string {
+	r := make([]string, len(s))
+	for i, v := range s {
+		r[len(s)-1-i] = v
+	}
+	return r
+}
+
+func TestSplitKeyLimits(t *testing.T) {
+	mk, err := NewMasterKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, split := range []struct{ k, n int }{{1, 3}, {4, 3}, {2, MaxShares + 1}} {
+		if _, err := SplitKey(mk, split.k, split.n); err == nil {
+			t.Errorf("%d-of-%d split accepted", split.k, split.n)
+		}
+	}
+}
+
+func TestCombineSharesRejects(t *testing.T) {
+	mk, err := NewMasterKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	shares, err := SplitKey(mk, 2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewMasterKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherShares, err := SplitKey(other, 2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Hand-typed shares parse regardless of case and spacing
+	typed := " " + strings.ToLower(strings.ReplaceAll(shares[0], "-", "- ")) + "\n"
+	if got, err := CombineShares([]string{typed, shares[2]}); err != nil || !bytes.Equal(got.Bytes(), mk.Bytes()) {
+		t.Errorf("hand-typed share: %v", err)
+	}
+
+	// A typo breaks the checksum
+	typo := []byte(shares[1])
+	i := len(typo) / 2
+	if typo[i] == '-' {
+		i++
+	}
+	if typo[i] == 'A' {
+		typo[i] = 'B'
+	} else {
+		typo[i] = 'A'
+	}
+	if _, err := CombineShares([]string{shares[0], string(typo)}); err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Errorf("share with a typo: %v", err)
+	}
+
+	if _, err := CombineShares([]string{shares[0], otherShares[1]}); !errors.Is(err, ErrShareMismatch) {
+		t.Errorf("shares of two keys: %v", err)
+	}
+	if _, err := CombineShares([]string{"not a share"}); err == nil {
+		t.Error("garbage accepted as a share")
+	}
+	if _, err := CombineShares(nil); err == nil {
+		t.Error("no shares accepted")
+	}
+}
+
+func TestGF(t *testing.T) {
+	for a := 1; a < 256; a++ {
+		if p := gfMul(byte(a), gfInv(byte(a))); p != 1 {
+			t.Fatalf("%d * inverse = %d", a, p)
+		}
+	}
+	// x * x^7 wraps around the AES polynomial
+	if p := gfMul(0x02, 0x80); p != 0x1b {
+		t.Errorf("gfMul(2, 0x80) = %#x, want 0x1b", p)
+	}
+}
@@ -0,0 +1,58 @@
+package engine
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/pranavdwivedi/aegis/pkg/crypto"
+	"github.com/pranavdwivedi/aegis/pkg/index"
+	"github.com/pranavdwivedi/aegis/pkg/intelligence"
+	"github.com/pranavdwivedi/aegis/pkg/security"
+	"github.com/pranavdwivedi/aegis/pkg/storage"
+)
+
+// Audit reads back every chunk the index references. With repair, damaged
+// chunks are rebuilt from their parity groups and replace the damaged copies.
+// Snapshots stored by other hosts are imported first, and Audit refuses to
+// run unless every one of them could be read, so that with write-only hosts
+// it needs the write-only private key (see UnlockWriteOnly).
+func Audit(repoDir string, backend storage.Backend, key crypto.MasterKey, repair bool) (intelligence.AuditReport, error) {
+	security.RepoDir = repoDir
+
+	if _, err := RefreshIndex(repoDir, backend, key); err != nil {
+		return intelligence.AuditReport{}, fmt.Errorf("failed to import snapshots from the backend: %w", err)
+	}
+
+	idx, err := index.NewIndex(repoDir, key)
+	if err != nil {
+		return intelligence.AuditReport{}, fmt.Errorf("failed to open index: %w", err)
+	}
+	defer idx.Close()
+
+	if err := checkIndexComplete(idx, backend); err != nil {
+		return intelligence.AuditReport{}, fmt.Errorf("refusing to audit: %w", err)
+	}
+
+	packer, err := storage.NewPacker(backend, filepath.Join(repoDir, storage.PackIndexName), storage.DefaultPackSize)
+	if err != nil {
+		return intelligence.AuditReport{}, fmt.Errorf("failed to open pack index: %w", err)
+	}
+	defer packer.Close()
+
+	store, err := storage.NewContentAddressableStore(packer, key)
+	if err != nil {
+		return intelligence.AuditReport{}, fmt.Errorf("failed to open store: %w", err)
+	}
+
+	report, err := intelligence.AuditRepository(idx, store, repair)
+	if ferr := packer.Flush(); err == nil {
+		err = ferr
+	}
+	if err != nil {
+		return report, err
+	}
+
+	security.LogAction("AUDIT", fmt.Sprintf("Checked %d chunks: %d missing, %d corrupt, %d healed, %d unrecoverable",
+		report.TotalChunks, report.MissingChunks, report.CorruptChunks, len(report.HealedChunks), len(report.UnrecoverableChunks)))
+	return report, nil
+}
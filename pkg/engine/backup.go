@@ -14,12 +14,38 @@ import (
 	"github.com/pranavdwivedi/aegis/pkg/storage"
 )
 
+// Options tunes a backup run
+type Options struct {
+	Chunker chunker.Params
+	Tag     string // groups snapshots, e.g. by job, for retention
+	// Host is recorded in the snapshot, so retention on one host never
+	// forgets the snapshots of another. Empty uses the machine's hostname.
+	Host string
+	// Parity writes Reed-Solomon parity for the new chunks so audit can
+	// repair them (zero disables it)
+	Parity storage.ParityParams
+}
+
 // Backup performs a backup of the sourcePath.
 // repoDir is used for the Index (always local). backend is used for the chunks.
-func Backup(repoDir string, backend storage.Backend, key crypto.MasterKey, sourcePath string) (int64, error) {
+func Backup(repoDir string, backend storage.Backend, key crypto.MasterKey, sourcePath string, opts Options) (int64, error) {
+	return backup(repoDir, backend, key, nil, sourcePath, opts)
+}
+
+// backup seals everything it writes with key. wk is set for write-only
+// backups, where key is the snapshot's data key and the repository config
+// (sealed with the master key) comes from the write-only key instead.
+func backup(repoDir string, backend storage.Backend, key crypto.MasterKey, wk *storage.WriteOnlyKey, sourcePath string, opts Options) (int64, error) {
 	security.RepoDir = repoDir // Ensure set if called via lib
 	security.LogAction("BACKUP_START", fmt.Sprintf("Backing up %s", sourcePath))
 
+	// Shared with other backups, but not with a prune deleting packs
+	unlock, err := lockRepository(backend, false)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
 	// 1. Open Index (Local)
 	idx, err := index.NewIndex(repoDir, key)
 	if err != nil {
@@ -27,15 +53,50 @@ func Backup(repoDir string, backend storage.Backend, key crypto.MasterKey, sourc
 	}
 	defer idx.Close()
 
-	// 2. Open Store (Backend)
-	store, err := storage.NewContentAddressableStore(backend, key)
+	// 2. Open Store (Backend), aggregating chunks into packfiles
+	packer, err := storage.NewPacker(backend, filepath.Join(repoDir, storage.PackIndexName), storage.DefaultPackSize)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open pack index: %w", err)
+	}
+	defer packer.Close()
+	// Forget the packs another host pruned, so their chunks are stored again
+	if _, err := packer.Rebuild(); err != nil {
+		return 0, fmt.Errorf("failed to rebuild pack index: %w", err)
+	}
+
+	var store *storage.ContentAddressableStore
+	if wk != nil {
+		store, err = storage.NewContentAddressableStoreWithConfig(packer, key, wk.Config())
+	} else {
+		store, err = storage.NewContentAddressableStore(packer, key)
+	}
 	if err != nil {
 		return 0, fmt.Errorf("failed to open store: %w", err)
 	}
+	// Chunking differently from other hosts would silently lose deduplication
+	if wk != nil {
+		err = store.Config().CheckChunker(opts.Chunker)
+	} else {
+		err = store.UseChunker(opts.Chunker)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if opts.Parity != (storage.ParityParams{}) {
+		if err := store.EnableParity(opts.Parity); err != nil {
+			return 0, err
+		}
+	}
 
 	// 2. Create Snapshot
 	absPath, _ := filepath.Abs(sourcePath)
-	snapshotID, err := idx.CreateSnapshot(fmt.Sprintf("Backup of %s", absPath))
+	host := opts.Host
+	if host == "" {
+		if host, err = os.Hostname(); err != nil {
+			return 0, fmt.Errorf("failed to get hostname: %w", err)
+		}
+	}
+	snapshotID, err := idx.CreateTaggedSnapshot(host, opts.Tag, fmt.Sprintf("Backup of %s", absPath))
 	if err != nil {
 		return 0, err
 	}
@@ -47,7 +108,7 @@ func Backup(repoDir string, backend storage.Backend, key crypto.MasterKey, sourc
 	}
 
 	if !info.IsDir() {
-		if err := processFile(sourcePath, snapshotID, idx, store); err != nil {
+		if err := processFile(sourcePath, snapshotID, idx, store, opts); err != nil {
 			return 0, err
 		}
 	} else {
@@ -56,7 +117,7 @@ func Backup(repoDir string, backend storage.Backend, key crypto.MasterKey, sourc
 				return err
 			}
 			if !info.IsDir() {
-				if err := processFile(p, snapshotID, idx, store); err != nil {
+				if err := processFile(p, snapshotID, idx, store, opts); err != nil {
 					return err
 				}
 			}
@@ -66,10 +127,54 @@ func Backup(repoDir string, backend storage.Backend, key crypto.MasterKey, sourc
 			return 0, err
 		}
 	}
+
+	// 4. Upload the last parity group and partial pack
+	if err := store.FlushParity(); err != nil {
+		return 0, err
+	}
+	if err := packer.Flush(); err != nil {
+		return 0, err
+	}
+
+	// 5. Store the (encrypted) snapshot metadata next to the data. A
+	// write-only host cannot read its earlier snapshots, so it uploads only this one.
+	if wk != nil {
+		err = uploadSnapshot(idx, store, snapshotID)
+	} else {
+		err = uploadIndex(idx, store)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if err := extendRetention(backend); err != nil {
+		return 0, err
+	}
 	return snapshotID, nil
 }
 
-func processFile(path string, snapshotID int64, idx *index.Index, store *storage.ContentAddressableStore) error {
+// extendRetention keeps the objects every snapshot needs to be restored
+// (key files, the repository config and write-only data keys, which reused
+// chunks may be sealed with) locked as long as the new snapshot
+func extendRetention(backend storage.Backend) error {
+	for _, ns := range []string{storage.KeyNamespace, storage.ConfigNamespace, storage.DataKeyNamespace} {
+		var keys []string
+		err := backend.List(ns, func(obj storage.ObjectInfo) error {
+			keys = append(keys, obj.Key)
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to list %s: %w", ns, err)
+		}
+		for _, k := range keys {
+			if err := storage.ExtendRetention(backend, k); err != nil {
+				return fmt.Errorf("failed to extend retention of %s: %w", k, err)
+			}
+		}
+	}
+	return nil
+}
+
+func processFile(path string, snapshotID int64, idx *index.Index, store *storage.ContentAddressableStore, opts Options) error {
 	f, err := os.Open(path)
 	if err != nil {
 		fmt.Printf("Skipping %s: %v\n", path, err)
@@ -90,7 +195,10 @@ func processFile(path string, snapshotID int64, idx *index.Index, store *storage
 	}
 
 	// Chunking
-	chnk := chunker.NewFixedSizeChunker(f, chunker.DefaultChunkSize)
+	chnk, err := chunker.New(f, opts.Chunker)
+	if err != nil {
+		return err
+	}
 	var offset int64 = 0
 
 	for {
@@ -103,14 +211,14 @@ func processFile(path string, snapshotID int64, idx *index.Index, store *storage
 			break
 		}
 
-		// Store Chunk
-		_, err = store.Put(chunk.Data)
+		// Store Chunk (the id is keyed, so it differs from chunk.Hash)
+		id, err := store.Put(chunk.Data)
 		if err != nil {
 			return err
 		}
 
 		// Index Chunk
-		err = idx.AddChunk(fileID, chunk.Hash, offset, int64(len(chunk.Data)))
+		err = idx.AddChunk(fileID, id, offset, int64(len(chunk.Data)))
 		if err != nil {
 			return err
 		}
@@ -0,0 +1,240 @@
+package engine
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pranavdwivedi/aegis/pkg/crypto"
+	"github.com/pranavdwivedi/aegis/pkg/index"
+	"github.com/pranavdwivedi/aegis/pkg/security"
+	"github.com/pranavdwivedi/aegis/pkg/storage"
+)
+
+// snapshotNamespace holds one encrypted SnapshotRecord per snapshot, so the
+// repository can be restored from the backend alone. Snapshot ids are
+// random, so hosts sharing the backend do not overwrite each other.
+const snapshotNamespace = "snapshots/"
+
+func snapshotKey(id int64) string {
+	return fmt.Sprintf("%s%016x", snapshotNamespace, id)
+}
+
+// uploadIndex writes every snapshot of the index that is not yet in the backend
+func uploadIndex(idx *index.Index, store *storage.ContentAddressableStore) error {
+	snapshots, err := idx.ListSnapshots()
+	if err != nil {
+		return err
+	}
+	for _, s := range snapshots {
+		if s.Upload == index.UploadDone {
+			continue
+		}
+		if err := uploadSnapshot(idx, store, s.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// uploadSnapshot writes the metadata of one snapshot. An object already
+// stored under its id must be this very snapshot (e.g. uploaded before a
+// crash); anything else belongs to another host and is never replaced.
+func uploadSnapshot(idx *index.Index, store *storage.ContentAddressableStore, id int64) error {
+	rec, err := idx.ExportSnapshot(id)
+	if err != nil {
+		return err
+	}
+	exists, err := checkStoredSnapshot(store, rec)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		data, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		if err := store.PutMetadata(snapshotKey(id), data); err != nil {
+			return fmt.Errorf("failed to upload snapshot %d metadata: %w", id, err)
+		}
+	}
+	return idx.SetSnapshotUploaded(id, true)
+}
+
+// checkStoredSnapshot reports whether the metadata of rec is in the backend.
+// It fails if another snapshot is stored under its id.
+func checkStoredSnapshot(store *storage.ContentAddressableStore, rec *index.SnapshotRecord) (bool, error) {
+	k := snapshotKey(rec.ID)
+	exists, err := store.HasMetadata(k)
+	if err != nil || !exists {
+		return false, err
+	}
+
+	data, err := store.GetLatestMetadata(k)
+	if err != nil {
+		return true, fmt.Errorf("snapshot %d: %s holds metadata this host cannot read (%v); refusing to replace it", rec.ID, k, err)
+	}
+	var stored index.SnapshotRecord
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return true, fmt.Errorf("metadata %s: %w", k, err)
+	}
+	if !stored.Equal(rec) {
+		return true, fmt.Errorf("snapshot %d collides with another host's snapshot stored as %s; forget the local one to resolve it", rec.ID, k)
+	}
+	return true, nil
+}
+
+// replaceSnapshot rewrites the stored metadata of a snapshot from the index,
+// e.g. after its chunks were renamed
+func replaceSnapshot(idx *index.Index, store *storage.ContentAddressableStore, id int64) error {
+	rec, err := idx.ExportSnapshot(id)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if err := store.ReplaceMetadata(snapshotKey(id), data); err != nil {
+		return fmt.Errorf("failed to replace snapshot %d metadata: %w", id, err)
+	}
+	return idx.SetSnapshotUploaded(id, true)
+}
+
+// storedSnapshots returns the ids of the snapshots whose metadata is in the backend
+func storedSnapshots(backend storage.Backend) ([]int64, error) {
+	var ids []int64
+	seen := make(map[int64]bool)
+	err := backend.List(snapshotNamespace, func(obj storage.ObjectInfo) error {
+		id, err := strconv.ParseInt(strings.TrimPrefix(storage.MetadataBase(obj.Key), snapshotNamespace), 16, 64)
+		if err != nil || seen[id] {
+			return nil // Not one of ours, or another version
+		}
+		seen[id] = true
+		ids = append(ids, id)
+		return nil
+	})
+	return ids, err
+}
+
+// RebuildIndex reconstructs index.db and the pack index in repoDir from the
+// snapshot metadata and packs stored in the backend. It refuses to overwrite
+// an existing index. Returns the number of snapshots recovered.
+func RebuildIndex(repoDir string, backend storage.Backend, key crypto.MasterKey) (int, error) {
+	security.RepoDir = repoDir
+
+	if _, err := os.Stat(filepath.Join(repoDir, "index.db")); err == nil {
+		return 0, fmt.Errorf("index already exists in %s; move it away before rebuilding", repoDir)
+	}
+	if err := os.MkdirAll(repoDir, 0700); err != nil {
+		return 0, err
+	}
+
+	count, packs, err := refreshIndex(repoDir, backend, key)
+	if err != nil {
+		return count, err
+	}
+	security.LogAction("INDEX_REBUILD", fmt.Sprintf("Recovered %d snapshots and %d packs from backend", count, packs))
+	return count, nil
+}
+
+// RefreshIndex imports the snapshots that other hosts (e.g. write-only
+// backup hosts) stored in the backend into the local index, together with
+// their packs. An index another host made stale, by rotating the master key
+// or rewriting snapshot metadata, is moved aside and rebuilt. Returns the
+// number of snapshots imported.
+func RefreshIndex(repoDir string, backend storage.Backend, key crypto.MasterKey) (int, error) {
+	security.RepoDir = repoDir
+
+	count, _, err := refreshIndex(repoDir, backend, key)
+	if err != nil {
+		return count, err
+	}
+	if count > 0 {
+		security.LogAction("INDEX_REFRESH", fmt.Sprintf("Imported %d snapshots from backend", count))
+	}
+	return count, nil
+}
+
+// refreshIndex imports every snapshot in the backend missing from the local
+// index and indexes every pack. Returns the snapshots imported and the packs seen.
+func refreshIndex(repoDir string, backend storage.Backend, key crypto.MasterKey) (int, int, error) {
+	store, err := storage.NewContentAddressableStore(backend, key)
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := retireStaleIndex(repoDir, key, store.Config()); err != nil {
+		return 0, 0, err
+	}
+
+	// 1. Pack index
+	packer, err := storage.NewPacker(backend, filepath.Join(repoDir, storage.PackIndexName), storage.DefaultPackSize)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to open pack index: %w", err)
+	}
+	defer packer.Close()
+
+	packs, err := packer.Rebuild()
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to rebuild pack index: %w", err)
+	}
+
+	// 2. Snapshots
+	idx, err := index.NewIndex(repoDir, key)
+	if err != nil {
+		return 0, packs, fmt.Errorf("failed to open index: %w", err)
+	}
+	defer idx.Close()
+
+	local, err := idx.ListSnapshots()
+	if err != nil {
+		return 0, packs, err
+	}
+	known := make(map[int64]bool, len(local))
+	for _, s := range local {
+		known[s.ID] = true
+	}
+
+	ids, err := storedSnapshots(backend)
+	if err != nil {
+		return 0, packs, err
+	}
+
+	count := 0
+	for _, id := range ids {
+		if known[id] {
+			continue
+		}
+
+		k := snapshotKey(id)
+		data, err := store.GetLatestMetadata(k)
+		if errors.Is(err, storage.ErrPrivateKeyRequired) {
+			fmt.Printf("SKIPPED SNAPSHOT: %s was written by a write-only host; unlock the write-only private key to import it\n", k)
+			continue
+		}
+		if err != nil {
+			return count, packs, err
+		}
+		var rec index.SnapshotRecord
+		if err := json.Unmarshal(data, &rec); err != nil {
+			return count, packs, fmt.Errorf("metadata %s: %w", k, err)
+		}
+		if err := idx.ImportSnapshot(&rec); err != nil {
+			return count, packs, err
+		}
+		count++
+	}
+
+	// The index is now up to date with the repository
+	if err := idx.SetMasterKeyID(key.ID()); err != nil {
+		return count, packs, err
+	}
+	if err := idx.SetEpoch(store.Config().IndexEpoch); err != nil {
+		return count, packs, err
+	}
+	return count, packs, nil
+}
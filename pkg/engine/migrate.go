@@ -0,0 +1,152 @@
+package engine
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+
+	"github.com/pranavdwivedi/aegis/pkg/crypto"
+	"github.com/pranavdwivedi/aegis/pkg/hash"
+	"github.com/pranavdwivedi/aegis/pkg/index"
+	"github.com/pranavdwivedi/aegis/pkg/security"
+	"github.com/pranavdwivedi/aegis/pkg/storage"
+)
+
+// migrateBatch is the number of chunks re-stored between index updates
+const migrateBatch = 500
+
+// MigrateReport summarizes a chunk id migration
+type MigrateReport struct {
+	Migrated   int // chunks re-stored under a keyed id
+	Unreadable int // chunks that could not be read (see audit)
+}
+
+// MigrateChunkIDs moves a repository from plain BLAKE3 chunk names to keyed
+// ids. Every chunk a snapshot of any host references is re-stored under its
+// keyed id, the index and the snapshot metadata and parity groups in the
+// backend are updated, and the old objects are left for Prune. Finally the
+// index epoch of the repository is raised, so other hosts rebuild their
+// index from the migrated metadata. The migration holds an exclusive
+// repository lock; it can be interrupted and run again.
+func MigrateChunkIDs(repoDir string, backend storage.Backend, key crypto.MasterKey) (MigrateReport, error) {
+	security.RepoDir = repoDir
+	var report MigrateReport
+
+	unlock, err := lockRepository(backend, true)
+	if err != nil {
+		return report, err
+	}
+	defer unlock()
+
+	// Snapshots are only migrated if they are in the local index
+	if _, err := RefreshIndex(repoDir, backend, key); err != nil {
+		return report, fmt.Errorf("failed to import snapshots from the backend: %w", err)
+	}
+	idx, err := index.NewIndex(repoDir, key)
+	if err != nil {
+		return report, fmt.Errorf("failed to open index: %w", err)
+	}
+	defer idx.Close()
+	if err := checkIndexComplete(idx, backend); err != nil {
+		return report, fmt.Errorf("refusing to migrate: %w", err)
+	}
+
+	packer, err := storage.NewPacker(backend, filepath.Join(repoDir, storage.PackIndexName), storage.DefaultPackSize)
+	if err != nil {
+		return report, fmt.Errorf("failed to open pack index: %w", err)
+	}
+	defer packer.Close()
+
+	store, err := storage.NewContentAddressableStore(packer, key)
+	if err != nil {
+		return report, fmt.Errorf("failed to open store: %w", err)
+	}
+	if err := store.EnableKeyedIDs(); err != nil {
+		return report, err
+	}
+
+	referenced, err := idx.ReferencedHashes()
+	if err != nil {
+		return report, err
+	}
+	hashes := make([]string, 0, len(referenced))
+	for h := range referenced {
+		hashes = append(hashes, h)
+	}
+	sort.Strings(hashes)
+
+	renames := make(map[string]string)
+	// Parity groups may still name chunks by plain hash, including chunks
+	// migrated by an interrupted earlier run
+	parityRenames := make(map[string]string)
+	commit := func() error {
+		// Chunks must be durable before the index points at them
+		if err := packer.Flush(); err != nil {
+			return err
+		}
+		if err := idx.RenameChunks(renames); err != nil {
+			return err
+		}
+		renames = make(map[string]string)
+		return nil
+	}
+
+	for _, hs := range hashes {
+		h, err := hash.Parse(hs)
+		if err != nil {
+			report.Unreadable++
+			continue
+		}
+		data, err := store.Get(h)
+		if err != nil {
+			fmt.Printf("UNREADABLE CHUNK: %s - %v\n", hs, err)
+			report.Unreadable++
+			continue
+		}
+		if plain := hash.Sum(data); plain != h {
+			parityRenames[plain.String()] = hs
+			continue // Already keyed
+		}
+
+		id, err := store.Put(data)
+		if err != nil {
+			return report, err
+		}
+		renames[hs] = id.String()
+		parityRenames[hs] = id.String()
+		report.Migrated++
+
+		if len(renames) >= migrateBatch {
+			if err := commit(); err != nil {
+				return report, err
+			}
+		}
+	}
+	if err := commit(); err != nil {
+		return report, err
+	}
+
+	// Snapshot metadata carries chunk ids too; re-upload it from the index
+	snapshots, err := idx.ListSnapshots()
+	if err != nil {
+		return report, err
+	}
+	for _, s := range snapshots {
+		if err := replaceSnapshot(idx, store, s.ID); err != nil {
+			return report, err
+		}
+	}
+	if err := store.RenameParityChunks(parityRenames); err != nil {
+		return report, err
+	}
+	epoch, err := store.BumpIndexEpoch()
+	if err != nil {
+		return report, err
+	}
+	if err := idx.SetEpoch(epoch); err != nil {
+		return report, err
+	}
+
+	security.LogAction("MIGRATE_CHUNK_IDS", fmt.Sprintf("Migrated %d chunks to keyed ids", report.Migrated))
+	return report, nil
+}
@@ -0,0 +1,68 @@
+package engine
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/pranavdwivedi/aegis/pkg/crypto"
+	"github.com/pranavdwivedi/aegis/pkg/storage"
+)
+
+func TestMigrateChunkIDsOnOtherHosts(t *testing.T) {
+	dir := t.TempDir()
+	backend, err := storage.NewLocalBackend(filepath.Join(dir, "backend"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostA, hostB := filepath.Join(dir, "host-a"), filepath.Join(dir, "host-b")
+
+	// A repository from before keyed chunk ids: a key file and nothing else
+	key, err := crypto.NewMasterKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.SaveKey(backend, key, testPassphrase, testKDF); err != nil {
+		t.Fatal(err)
+	}
+	contents := map[string]string{"host-a": "backed up by host A\n", "host-b": "backed up by host B\n"}
+	sources := map[int64]string{}
+	for _, host := range []string{hostA, hostB} {
+		if _, err := Open(host, backend, testPassphrase); err != nil {
+			t.Fatal(err)
+		}
+		name := filepath.Base(host)
+		src := writeSource(t, filepath.Join(dir, "src-"+name), contents[name])
+		id, err := Backup(host, backend, key, src, Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sources[id] = name
+	}
+
+	report, err := MigrateChunkIDs(hostA, backend, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Migrated != 2 || report.Unreadable != 0 {
+		t.Errorf("migrated %d chunks (%d unreadable), want the chunks of both hosts", report.Migrated, report.Unreadable)
+	}
+	// The chunks under plain ids are gone after a prune
+	if _, err := Prune(hostA, backend, key, false); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, host := range []string{hostB, hostA} {
+		if _, err := Open(host, backend, testPassphrase); err != nil {
+			t.Fatalf("open on %s after the migration: %v", filepath.Base(host), err)
+		}
+		for id, name := range sources {
+			checkRestore(t, host, backend, key, id, filepath.Join(dir, "src-"+name), contents[name])
+		}
+	}
+	if stale, _ := filepath.Glob(filepath.Join(hostB, "index.db.*")); len(stale) != 1 {
+		t.Errorf("host B kept %v, want its index from before the migration", stale)
+	}
+	if stale, _ := filepath.Glob(filepath.Join(hostA, "index.db.*")); len(stale) != 0 {
+		t.Errorf("the migrating host moved its index aside: %v", stale)
+	}
+}
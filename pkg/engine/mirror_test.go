@@ -0,0 +1,117 @@
+package engine
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/pranavdwivedi/aegis/pkg/chunker"
+	"github.com/pranavdwivedi/aegis/pkg/index"
+	"github.com/pranavdwivedi/aegis/pkg/storage"
+)
+
+// offlineBackend is a mirror replica that can be taken offline
+type offlineBackend struct {
+	storage.Backend
+	down bool
+}
+
+var errOffline = errors.New("replica unreachable")
+
+func (b *offlineBackend) Put(key string, data []byte) error {
+	if b.down {
+		return errOffline
+	}
+	return b.Backend.Put(key, data)
+}
+
+func (b *offlineBackend) Get(key string) ([]byte, error) {
+	if b.down {
+		return nil, errOffline
+	}
+	return b.Backend.Get(key)
+}
+
+func (b *offlineBackend) Has(key string) (bool, error) {
+	if b.down {
+		return false, errOffline
+	}
+	return b.Backend.Has(key)
+}
+
+func (b *offlineBackend) List(prefix string, fn func(storage.ObjectInfo) error) error {
+	if b.down {
+		return errOffline
+	}
+	return b.Backend.List(prefix, fn)
+}
+
+func (b *offlineBackend) Delete(key string) error {
+	if b.down {
+		return errOffline
+	}
+	return b.Backend.Delete(key)
+}
+
+func TestForgetWhileMirrorReplicaDown(t *testing.T) {
+	dir := t.TempDir()
+	var replicas []storage.Backend
+	for _, name := range []string{"disk", "nas", "cloud"} {
+		local, err := storage.NewLocalBackend(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		replicas = append(replicas, &offlineBackend{Backend: local})
+	}
+	backend, err := storage.NewMirrorBackend(replicas, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostA, hostB := filepath.Join(dir, "host-a"), filepath.Join(dir, "host-b")
+
+	key, err := Init(hostA, backend, testPassphrase, testKDF, 0, chunker.Params{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := "forgotten\n"
+	src := writeSource(t, filepath.Join(dir, "src"), content)
+	forgotten, err := Backup(hostA, backend, key, src, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept, err := Backup(hostA, backend, key, src, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cloud := replicas[2].(*offlineBackend)
+	cloud.down = true
+	if err := Forget(hostA, backend, key, forgotten); err != nil {
+		t.Fatal(err)
+	}
+	cloud.down = false
+
+	// Host B has never seen the repository and imports what is stored
+	if _, err := Open(hostB, backend, testPassphrase); err != nil {
+		t.Fatal(err)
+	}
+	// Host A refreshes after the replica is back
+	if _, err := RefreshIndex(hostA, backend, key); err != nil {
+		t.Fatal(err)
+	}
+	for _, host := range []string{hostA, hostB} {
+		idx, err := index.NewIndex(host, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		snapshots, err := idx.ListSnapshots()
+		idx.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(snapshots) != 1 || snapshots[0].ID != kept {
+			t.Errorf("%s indexes %v, want only snapshot %d", filepath.Base(host), snapshots, kept)
+		}
+	}
+	checkRestore(t, hostB, backend, key, kept, src, content)
+}
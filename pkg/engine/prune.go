@@ -0,0 +1,272 @@
+package engine
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pranavdwivedi/aegis/pkg/crypto"
+	"github.com/pranavdwivedi/aegis/pkg/index"
+	"github.com/pranavdwivedi/aegis/pkg/security"
+	"github.com/pranavdwivedi/aegis/pkg/storage"
+)
+
+// PruneReport summarizes a garbage collection pass
+type PruneReport struct {
+	ReferencedChunks int
+	UnusedObjects    int // loose objects no snapshot refers to
+	DeletedPacks     int
+	RewrittenPacks   int
+	UnindexedPacks   int       // packs left alone because they hold objects the index does not know
+	DeletedParity    int       // parity groups none of whose chunks are referenced
+	RecomputedParity int       // parity groups recomputed over their remaining chunks
+	ReducedParity    int       // parity groups left with fewer chunks than they were computed for
+	Retained         int       // unused objects, packs and parity groups left while under retention
+	RetainedUntil    time.Time // when the last of them can be pruned
+	ReclaimableBytes int64
+	DryRun           bool
+}
+
+// retain reports whether any of keys, the objects of one prunable item, is
+// under retention (e.g. S3 Object Lock). Such items are counted and must
+// be left for a later prune.
+func (r *PruneReport) retain(backend storage.Backend, keys ...string) (bool, error) {
+	locked := false
+	for _, k := range keys {
+		until, err := storage.RetainedUntil(backend, k)
+		if err != nil {
+			return false, fmt.Errorf("failed to check retention of %s: %w", k, err)
+		}
+		if until.After(time.Now()) {
+			locked = true
+			if until.After(r.RetainedUntil) {
+				r.RetainedUntil = until
+			}
+		}
+	}
+	if locked {
+		r.Retained++
+	}
+	return locked, nil
+}
+
+// Forget deletes a snapshot from the index and its metadata from the backend.
+// Its data is only reclaimed by a later Prune. Metadata stored under the
+// same id by another host is left alone.
+func Forget(repoDir string, backend storage.Backend, key crypto.MasterKey, snapshotID int64) error {
+	security.RepoDir = repoDir
+
+	idx, err := index.NewIndex(repoDir, key)
+	if err != nil {
+		return fmt.Errorf("failed to open index: %w", err)
+	}
+	defer idx.Close()
+
+	s, err := idx.GetSnapshot(snapshotID)
+	if err != nil {
+		return err
+	}
+	store, err := storage.NewContentAddressableStore(backend, key)
+	if err != nil {
+		return err
+	}
+	uploaded := s.Upload == index.UploadDone
+	if s.Upload == index.UploadUnknown {
+		// Indexed before uploads were tracked: only ours if it matches
+		rec, err := idx.ExportSnapshot(snapshotID)
+		if err != nil {
+			return err
+		}
+		if uploaded, err = checkStoredSnapshot(store, rec); err != nil {
+			fmt.Printf("Keeping %s: %v\n", snapshotKey(snapshotID), err)
+			uploaded = false
+		}
+	}
+
+	if err := idx.DeleteSnapshot(snapshotID); err != nil {
+		return err
+	}
+	if uploaded {
+		if err := store.DeleteMetadata(snapshotKey(snapshotID)); err != nil {
+			return fmt.Errorf("failed to delete snapshot %d metadata: %w", snapshotID, err)
+		}
+	}
+	security.LogAction("SNAPSHOT_FORGET", fmt.Sprintf("Forgot snapshot %d", snapshotID))
+	return nil
+}
+
+// Prune deletes every stored chunk that is no longer referenced by a snapshot.
+// Snapshots other hosts stored in the backend are imported first, and Prune
+// refuses to run unless every one of them could be read. Objects under
+// retention are skipped and reported; a prune after their retention date
+// removes them. With dryRun it only reports what would be reclaimed.
+// A prune holds an exclusive repository lock, so it fails with
+// storage.ErrLocked while a backup runs, and backups fail while it runs.
+func Prune(repoDir string, backend storage.Backend, key crypto.MasterKey, dryRun bool) (PruneReport, error) {
+	security.RepoDir = repoDir
+	report := PruneReport{DryRun: dryRun}
+
+	if !dryRun {
+		unlock, err := lockRepository(backend, true)
+		if err != nil {
+			return report, err
+		}
+		defer unlock()
+		if n, err := storage.RemoveStaleLocks(backend); err != nil {
+			return report, fmt.Errorf("failed to remove stale locks: %w", err)
+		} else if n > 0 {
+			fmt.Printf("Removed %d stale locks\n", n)
+		}
+	}
+
+	// Chunks are only unused if no snapshot of any host refers to them
+	if _, err := RefreshIndex(repoDir, backend, key); err != nil {
+		return report, fmt.Errorf("failed to import snapshots from the backend: %w", err)
+	}
+
+	idx, err := index.NewIndex(repoDir, key)
+	if err != nil {
+		return report, fmt.Errorf("failed to open index: %w", err)
+	}
+	defer idx.Close()
+
+	if err := checkIndexComplete(idx, backend); err != nil {
+		return report, fmt.Errorf("refusing to prune: %w", err)
+	}
+	referenced, err := idx.ReferencedHashes()
+	if err != nil {
+		return report, err
+	}
+	report.ReferencedChunks = len(referenced)
+
+	packer, err := storage.NewPacker(backend, filepath.Join(repoDir, storage.PackIndexName), storage.DefaultPackSize)
+	if err != nil {
+		return report, fmt.Errorf("failed to open pack index: %w", err)
+	}
+	defer packer.Close()
+
+	// 1. Parity groups, while the chunks they lose are still readable.
+	// Groups that keep some of their chunks are recomputed over those, so
+	// their tolerance does not drop; groups that keep none are deleted.
+	store, err := storage.NewContentAddressableStore(packer, key)
+	if err != nil {
+		return report, err
+	}
+	groups, err := store.ParityGroups()
+	if err != nil {
+		return report, err
+	}
+	for _, g := range groups {
+		live := 0
+		for _, c := range g.Chunks {
+			if referenced[c.ID] {
+				live++
+			}
+		}
+		if live == len(g.Chunks) {
+			continue
+		}
+		retained, err := report.retain(backend, storage.ParityNamespace+g.ID, storage.ParityDataNamespace+g.ID)
+		if err != nil {
+			return report, err
+		}
+		if retained {
+			continue
+		}
+
+		if live == 0 {
+			report.DeletedParity++
+			if !dryRun {
+				if err := store.DeleteParityGroup(g.ID); err != nil {
+					return report, fmt.Errorf("failed to delete parity group %s: %w", g.ID, err)
+				}
+			}
+			continue
+		}
+		if dryRun {
+			report.RecomputedParity++
+			continue
+		}
+		ok, err := store.RecomputeParity(g, func(id string) bool { return referenced[id] })
+		if err != nil {
+			return report, fmt.Errorf("failed to recompute parity group %s: %w", g.ID, err)
+		}
+		if ok {
+			report.RecomputedParity++
+		} else {
+			report.ReducedParity++
+			fmt.Printf("REDUCED PARITY: group %s has an unreadable chunk and keeps %d pruned chunks; run repair, then prune again\n",
+				g.ID, len(g.Chunks)-live)
+		}
+	}
+
+	// 2. Loose objects (written before packing existed)
+	var candidates []storage.ObjectInfo
+	err = backend.List("", func(obj storage.ObjectInfo) error {
+		if strings.Contains(obj.Key, "/") || referenced[obj.Key] {
+			return nil // Namespaced (packs, keys, ...) or still in use
+		}
+		candidates = append(candidates, obj)
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+	var unused []string
+	for _, obj := range candidates {
+		retained, err := report.retain(backend, obj.Key)
+		if err != nil {
+			return report, err
+		}
+		if !retained {
+			unused = append(unused, obj.Key)
+			report.ReclaimableBytes += obj.Size
+		}
+	}
+	report.UnusedObjects = len(unused)
+
+	if !dryRun {
+		for _, k := range unused {
+			if err := backend.Delete(k); err != nil {
+				return report, fmt.Errorf("failed to delete %s: %w", k, err)
+			}
+		}
+	}
+
+	// 3. Packfiles
+	stats, err := packer.Prune(func(k string) bool { return referenced[k] }, dryRun)
+	if err != nil {
+		return report, err
+	}
+	report.DeletedPacks = stats.DeletedPacks
+	report.RewrittenPacks = stats.RewrittenPacks
+	report.UnindexedPacks = stats.UnindexedPacks
+	report.Retained += stats.RetainedPacks
+	if stats.RetainedUntil.After(report.RetainedUntil) {
+		report.RetainedUntil = stats.RetainedUntil
+	}
+	report.ReclaimableBytes += stats.ReclaimableBytes
+
+	if !dryRun {
+		security.LogAction("PRUNE", fmt.Sprintf("Removed %d objects, %d packs, %d parity groups, rewrote %d packs, recomputed %d parity groups, reclaimed %d bytes, kept %d under retention",
+			report.UnusedObjects, report.DeletedPacks, report.DeletedParity, report.RewrittenPacks, report.RecomputedParity, report.ReclaimableBytes, report.Retained))
+	}
+	return report, nil
+}
+
+// checkIndexComplete fails unless every snapshot stored in the backend is
+// in the local index, so its references are known. Snapshots of write-only
+// hosts are only imported with the write-only private key.
+func checkIndexComplete(idx *index.Index, backend storage.Backend) error {
+	ids, err := storedSnapshots(backend)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if _, err := idx.GetSnapshot(id); err != nil {
+			return fmt.Errorf("snapshot %s is not in the local index (is the write-only private key unlocked?): %w", snapshotKey(id), err)
+		}
+	}
+	return nil
+}
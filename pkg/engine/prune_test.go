@@ -0,0 +1,426 @@
+package engine
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pranavdwivedi/aegis/pkg/chunker"
+	"github.com/pranavdwivedi/aegis/pkg/crypto"
+	"github.com/pranavdwivedi/aegis/pkg/index"
+	"github.com/pranavdwivedi/aegis/pkg/restore"
+	"github.com/pranavdwivedi/aegis/pkg/storage"
+)
+
+// testKDF keeps key derivation cheap in tests
+var testKDF = crypto.KDFParams{Time: 1, Memory: 8 * 1024, Threads: 1}
+
+const testPassphrase = "correct horse battery staple"
+
+// writeSource creates a directory holding one file with content
+func writeSource(t *testing.T, dir, content string) string {
+	t.Helper()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "data.txt"), []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// checkRestore restores a snapshot as seen from repoDir and compares the
+// file written by writeSource with content
+func checkRestore(t *testing.T, repoDir string, backend storage.Backend, key crypto.MasterKey, snapshotID int64, source, content string) {
+	t.Helper()
+
+	idx, err := index.NewIndex(repoDir, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+	packer, err := storage.NewPacker(backend, filepath.Join(repoDir, storage.PackIndexName), storage.DefaultPackSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer packer.Close()
+	store, err := storage.NewContentAddressableStore(packer, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	target := t.TempDir()
+	if err := restore.RestoreSnapshot(idx, store, snapshotID, target, false, false, nil); err != nil {
+		t.Fatalf("restore of snapshot %d failed: %v", snapshotID, err)
+	}
+	abs, err := filepath.Abs(filepath.Join(source, "data.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(filepath.Join(target, strings.TrimPrefix(abs, string(filepath.Separator))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, []byte(content)) {
+		t.Fatalf("snapshot %d restored the wrong content", snapshotID)
+	}
+}
+
+func TestPruneKeepsOtherHostsData(t *testing.T) {
+	dir := t.TempDir()
+	backend, err := storage.NewLocalBackend(filepath.Join(dir, "backend"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostA, hostB := filepath.Join(dir, "host-a"), filepath.Join(dir, "host-b")
+
+	key, err := Init(hostA, backend, testPassphrase, testKDF, 0, chunker.Params{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(hostB, backend, testPassphrase); err != nil {
+		t.Fatal(err)
+	}
+
+	contentA := strings.Repeat("only host a has this\n", 1000)
+	contentB := strings.Repeat("only host b has this\n", 1000)
+	srcA := writeSource(t, filepath.Join(dir, "src-a"), contentA)
+	srcB := writeSource(t, filepath.Join(dir, "src-b"), contentB)
+
+	snapA, err := Backup(hostA, backend, key, srcA, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapB, err := Backup(hostB, backend, key, srcB, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapA == snapB {
+		t.Fatal("two hosts picked the same snapshot id")
+	}
+
+	// Host A has never seen host B's snapshot or pack
+	if err := Forget(hostA, backend, key, snapA); err != nil {
+		t.Fatal(err)
+	}
+	report, err := Prune(hostA, backend, key, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.DeletedPacks != 1 {
+		t.Errorf("prune deleted %d packs, want only host a's", report.DeletedPacks)
+	}
+
+	checkRestore(t, hostB, backend, key, snapB, srcB, contentB)
+	checkRestore(t, hostA, backend, key, snapB, srcB, contentB)
+}
+
+func TestPruneRebuildsLostPackIndex(t *testing.T) {
+	dir := t.TempDir()
+	backend, err := storage.NewLocalBackend(filepath.Join(dir, "backend"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	repoDir := filepath.Join(dir, "host")
+
+	key, err := Init(repoDir, backend, testPassphrase, testKDF, 0, chunker.Params{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := strings.Repeat("kept\n", 1000)
+	src := writeSource(t, filepath.Join(dir, "src"), content)
+	snap, err := Backup(repoDir, backend, key, src, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Remove(filepath.Join(repoDir, storage.PackIndexName)); err != nil {
+		t.Fatal(err)
+	}
+	report, err := Prune(repoDir, backend, key, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.DeletedPacks != 0 || report.RewrittenPacks != 0 {
+		t.Errorf("prune touched referenced packs: %+v", report)
+	}
+	checkRestore(t, repoDir, backend, key, snap, src, content)
+}
+
+func TestBackupAfterOtherHostPruned(t *testing.T) {
+	dir := t.TempDir()
+	backend, err := storage.NewLocalBackend(filepath.Join(dir, "backend"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostA, hostB := filepath.Join(dir, "host-a"), filepath.Join(dir, "host-b")
+
+	key, err := Init(hostA, backend, testPassphrase, testKDF, 0, chunker.Params{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(hostB, backend, testPassphrase); err != nil {
+		t.Fatal(err)
+	}
+
+	content := strings.Repeat("backed up twice\n", 1000)
+	src := writeSource(t, filepath.Join(dir, "src"), content)
+	first, err := Backup(hostB, backend, key, src, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Host A forgets host B's snapshot and prunes its pack, which host B
+	// still has in its pack index
+	if _, err := RefreshIndex(hostA, backend, key); err != nil {
+		t.Fatal(err)
+	}
+	if err := Forget(hostA, backend, key, first); err != nil {
+		t.Fatal(err)
+	}
+	report, err := Prune(hostA, backend, key, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.DeletedPacks != 1 {
+		t.Fatalf("prune deleted %d packs, want 1", report.DeletedPacks)
+	}
+
+	second, err := Backup(hostB, backend, key, src, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRestore(t, hostB, backend, key, second, src, content)
+}
+
+func TestPruneWaitsForBackups(t *testing.T) {
+	dir := t.TempDir()
+	backend, err := storage.NewLocalBackend(filepath.Join(dir, "backend"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	repoDir := filepath.Join(dir, "host")
+	key, err := Init(repoDir, backend, testPassphrase, testKDF, 0, chunker.Params{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := writeSource(t, filepath.Join(dir, "src"), "locked\n")
+
+	// A backup running on another host
+	backupLock, err := storage.AcquireLock(backend, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Prune(repoDir, backend, key, false); !errors.Is(err, storage.ErrLocked) {
+		t.Errorf("prune during a backup returned %v, want ErrLocked", err)
+	}
+	if _, err := Prune(repoDir, backend, key, true); err != nil {
+		t.Errorf("dry run during a backup failed: %v", err)
+	}
+	if _, err := Backup(repoDir, backend, key, src, Options{}); err != nil {
+		t.Errorf("backups do not exclude each other, but got %v", err)
+	}
+	if err := backupLock.Release(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A prune running on another host
+	pruneLock, err := storage.AcquireLock(backend, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Backup(repoDir, backend, key, src, Options{}); !errors.Is(err, storage.ErrLocked) {
+		t.Errorf("backup during a prune returned %v, want ErrLocked", err)
+	}
+	if err := pruneLock.Release(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A lock left by a crashed host stops nothing once it is stale
+	if _, err := storage.AcquireLock(backend, true); err != nil {
+		t.Fatal(err)
+	}
+	defer func(d time.Duration) { storage.LockStaleAfter = d }(storage.LockStaleAfter)
+	storage.LockStaleAfter = 0
+	if _, err := Prune(repoDir, backend, key, false); err != nil {
+		t.Fatalf("prune with a stale lock failed: %v", err)
+	}
+	var locks []string
+	backend.List(storage.LockNamespace, func(obj storage.ObjectInfo) error {
+		locks = append(locks, obj.Key)
+		return nil
+	})
+	if len(locks) != 0 {
+		t.Errorf("locks left after prune: %v", locks)
+	}
+}
+
+// retainingBackend reports every object it stores as locked for period, as
+// an S3 bucket with a lock mode does. Like S3 it still lets locked objects
+// be deleted from view, so tests check what was kept.
+type retainingBackend struct {
+	storage.Backend
+	period time.Duration
+
+	mu       sync.Mutex
+	until    map[string]time.Time
+	extended map[string]int
+}
+
+func newRetainingBackend(t *testing.T, dir string, period time.Duration) *retainingBackend {
+	t.Helper()
+	local, err := storage.NewLocalBackend(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &retainingBackend{Backend: local, period: period, until: map[string]time.Time{}, extended: map[string]int{}}
+}
+
+func (b *retainingBackend) Put(key string, data []byte) error {
+	if err := b.Backend.Put(key, data); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.until[key]; !ok && !strings.HasPrefix(key, storage.LockNamespace) {
+		b.until[key] = time.Now().Add(b.period)
+	}
+	return nil
+}
+
+func (b *retainingBackend) RetainedUntil(key string) (time.Time, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.until[key], nil
+}
+
+func (b *retainingBackend) ExtendRetention(key string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.until[key]; !ok {
+		return fmt.Errorf("extend retention of %s: no such object", key)
+	}
+	b.until[key] = time.Now().Add(b.period)
+	b.extended[key]++
+	return nil
+}
+
+func (b *retainingBackend) Delete(key string) error {
+	b.mu.Lock()
+	delete(b.until, key)
+	b.mu.Unlock()
+	return b.Backend.Delete(key)
+}
+
+// age moves every retention date back by d, as if d had passed
+func (b *retainingBackend) age(d time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for k, until := range b.until {
+		b.until[k] = until.Add(-d)
+	}
+}
+
+func (b *retainingBackend) packs(t *testing.T) []string {
+	t.Helper()
+	var packs []string
+	if err := b.List("packs/", func(obj storage.ObjectInfo) error {
+		packs = append(packs, obj.Key)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return packs
+}
+
+func TestPruneSkipsRetainedObjects(t *testing.T) {
+	dir := t.TempDir()
+	backend := newRetainingBackend(t, filepath.Join(dir, "backend"), 30*24*time.Hour)
+	repoDir := filepath.Join(dir, "host")
+	key, err := Init(repoDir, backend, testPassphrase, testKDF, 0, chunker.Params{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	forgotten, err := Backup(repoDir, backend, key, writeSource(t, filepath.Join(dir, "old"), "forgotten\n"), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Forget(repoDir, backend, key, forgotten); err != nil {
+		t.Fatal(err)
+	}
+	packs := backend.packs(t)
+	if len(packs) != 1 {
+		t.Fatalf("test setup: want one pack, have %v", packs)
+	}
+	until, _ := backend.RetainedUntil(packs[0])
+
+	report, err := Prune(repoDir, backend, key, false)
+	if err != nil {
+		t.Fatalf("prune of a retained pack failed: %v", err)
+	}
+	if report.Retained != 1 || report.DeletedPacks != 0 || !report.RetainedUntil.Equal(until) {
+		t.Errorf("retained %d until %v, deleted %d packs; want the pack retained until %v", report.Retained, report.RetainedUntil, report.DeletedPacks, until)
+	}
+	if got := backend.packs(t); len(got) != 1 {
+		t.Errorf("retained pack removed: %v", got)
+	}
+
+	// Once its retention has passed, the next prune removes it
+	backend.age(31 * 24 * time.Hour)
+	report, err = Prune(repoDir, backend, key, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Retained != 0 || report.DeletedPacks != 1 {
+		t.Errorf("retained %d, deleted %d packs after the retention passed", report.Retained, report.DeletedPacks)
+	}
+	if got := backend.packs(t); len(got) != 0 {
+		t.Errorf("packs left: %v", got)
+	}
+}
+
+func TestBackupExtendsReusedRetention(t *testing.T) {
+	dir := t.TempDir()
+	period := 30 * 24 * time.Hour
+	backend := newRetainingBackend(t, filepath.Join(dir, "backend"), period)
+	repoDir := filepath.Join(dir, "host")
+	key, err := Init(repoDir, backend, testPassphrase, testKDF, 0, chunker.Params{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := strings.Repeat("reused data\n", 100000)
+	src := writeSource(t, filepath.Join(dir, "src"), content)
+	if _, err := Backup(repoDir, backend, key, src, Options{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 29 days later the same data is backed up again
+	backend.age(29 * 24 * time.Hour)
+	snap, err := Backup(repoDir, backend, key, src, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := backend.packs(t); len(got) != 1 {
+		t.Fatalf("second backup stored packs %v, want the first one reused", got)
+	}
+
+	backend.mu.Lock()
+	for k, until := range backend.until {
+		if strings.HasPrefix(k, storage.KeyNamespace) || strings.HasPrefix(k, storage.ConfigNamespace) || strings.HasPrefix(k, "packs/") {
+			if time.Until(until) < period-time.Hour {
+				t.Errorf("%s stays locked only until %v", k, until)
+			}
+		}
+		if strings.HasPrefix(k, "packs/") && backend.extended[k] != 1 {
+			t.Errorf("retention of %s extended %d times, want once per backup", k, backend.extended[k])
+		}
+	}
+	backend.mu.Unlock()
+	checkRestore(t, repoDir, backend, key, snap, src, content)
+}
@@ -0,0 +1,71 @@
+package engine
+
+import (
+	"fmt"
+
+	"github.com/pranavdwivedi/aegis/pkg/crypto"
+	"github.com/pranavdwivedi/aegis/pkg/security"
+	"github.com/pranavdwivedi/aegis/pkg/storage"
+)
+
+// ExportRecoveryShares splits the master key into n printable recovery
+// shares, any threshold of which restore access with ImportRecoveryShares.
+// Nothing is written: hand each share to a different custodian. The shares
+// stay valid until the next key rotation.
+func ExportRecoveryShares(repoDir string, key crypto.MasterKey, threshold, n int) ([]string, error) {
+	security.RepoDir = repoDir
+
+	shares, err := crypto.SplitKey(key, threshold, n)
+	if err != nil {
+		return nil, err
+	}
+
+	id := key.ID()
+	security.LogAction("RECOVERY_EXPORT", fmt.Sprintf("Master key %x split into %d-of-%d recovery shares", id[:], threshold, n))
+	return shares, nil
+}
+
+// ImportRecoveryShares rebuilds the master key from recovery shares and adds
+// a key slot unlocked by passphrase. The key is checked against the
+// repository before the slot is written, and only ever held in memory.
+// Returns the new slot id.
+func ImportRecoveryShares(repoDir string, backend storage.Backend, shares []string, label, passphrase string, kdf crypto.KDFParams) (string, error) {
+	security.RepoDir = repoDir
+
+	mk, err := crypto.CombineShares(shares)
+	if err != nil {
+		return "", err
+	}
+	if err := checkRepositoryKey(backend, mk); err != nil {
+		return "", err
+	}
+
+	slotID, err := storage.AddKeySlotWithKey(backend, mk, label, passphrase, kdf)
+	if err != nil {
+		return "", fmt.Errorf("failed to store key slot: %w", err)
+	}
+
+	security.LogAction("RECOVERY_IMPORT", fmt.Sprintf("Key slot %s (%s) added from %d recovery shares", slotID, label, len(shares)))
+	return slotID, nil
+}
+
+// checkRepositoryKey fails unless key opens the repository config or, in
+// legacy repositories without one, a stored snapshot
+func checkRepositoryKey(backend storage.Backend, key crypto.MasterKey) error {
+	store, err := storage.NewContentAddressableStore(backend, key)
+	if err != nil {
+		return fmt.Errorf("recovered key does not open this repository: %w", err)
+	}
+	if exists, err := store.HasMetadata(storage.ConfigKey); err != nil || exists {
+		return err
+	}
+
+	ids, err := storedSnapshots(backend)
+	if err != nil || len(ids) == 0 {
+		return err
+	}
+	if _, err := store.GetLatestMetadata(snapshotKey(ids[0])); err != nil {
+		return fmt.Errorf("recovered key does not open this repository: %w", err)
+	}
+	return nil
+}
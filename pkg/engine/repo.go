@@ -0,0 +1,178 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pranavdwivedi/aegis/pkg/chunker"
+	"github.com/pranavdwivedi/aegis/pkg/crypto"
+	"github.com/pranavdwivedi/aegis/pkg/index"
+	"github.com/pranavdwivedi/aegis/pkg/security"
+	"github.com/pranavdwivedi/aegis/pkg/storage"
+)
+
+// Init creates a new repository in the backend: a fresh master key whose
+// key file, encrypted by the passphrase, is stored under keys/.
+// kdf selects the Argon2id parameters (zero for the defaults, or see crypto.CalibrateKDF).
+// cipher selects the repository cipher (zero for crypto.DefaultCipher); it is
+// recorded in the key file and cannot be changed later.
+// chunking selects how files are split; it is recorded in the repository
+// config and backups with other params are refused.
+func Init(repoDir string, backend storage.Backend, passphrase string, kdf crypto.KDFParams, cipher crypto.Cipher, chunking chunker.Params) (crypto.MasterKey, error) {
+	if _, err := chunking.Normalize(); err != nil {
+		return crypto.MasterKey{}, err
+	}
+	ids, err := storage.ListKeys(backend)
+	if err != nil {
+		return crypto.MasterKey{}, err
+	}
+	if len(ids) > 0 {
+		return crypto.MasterKey{}, fmt.Errorf("repository already initialized")
+	}
+
+	mk, err := crypto.NewMasterKey()
+	if err != nil {
+		return crypto.MasterKey{}, err
+	}
+	if mk = mk.WithCipher(cipher); !mk.Cipher().Valid() {
+		return crypto.MasterKey{}, fmt.Errorf("unsupported cipher %s", cipher)
+	}
+	if _, err := storage.SaveKey(backend, mk, passphrase, kdf); err != nil {
+		return crypto.MasterKey{}, fmt.Errorf("failed to store key: %w", err)
+	}
+
+	// New repositories name chunks by keyed hash from the start
+	store, err := storage.NewContentAddressableStore(backend, mk)
+	if err != nil {
+		return crypto.MasterKey{}, err
+	}
+	if err := store.EnableKeyedIDs(); err != nil {
+		return crypto.MasterKey{}, err
+	}
+	if err := store.UseChunker(chunking); err != nil {
+		return crypto.MasterKey{}, err
+	}
+
+	if err := os.MkdirAll(repoDir, 0700); err != nil {
+		return crypto.MasterKey{}, err
+	}
+	security.RepoDir = repoDir
+	security.LogAction("INIT", "Repository initialized")
+	return mk, nil
+}
+
+// ErrRotationInProgress is returned by Open while a key rotation has not
+// completed; running RotateKey again finishes it
+var ErrRotationInProgress = errors.New("a master key rotation is in progress; run it again to finish it")
+
+// Open unlocks a repository from its backend with the passphrase and checks
+// that its format is supported.
+// On a machine that has never seen the repository the local index is
+// rebuilt from the backend first; otherwise snapshots stored by other hosts
+// since are imported (see RefreshIndex).
+func Open(repoDir string, backend storage.Backend, passphrase string) (crypto.MasterKey, error) {
+	// Until a rotation completes the passphrase may open the retiring key
+	var rotating bool
+	err := backend.List(rotationNamespace, func(storage.ObjectInfo) error {
+		rotating = true
+		return nil
+	})
+	if err != nil {
+		return crypto.MasterKey{}, err
+	}
+	if rotating {
+		return crypto.MasterKey{}, ErrRotationInProgress
+	}
+
+	mk, err := storage.LoadKey(backend, passphrase)
+	if err != nil {
+		return crypto.MasterKey{}, err
+	}
+	// Refuse repositories written by a newer version before touching them
+	if _, err := storage.LoadConfig(backend, mk); err != nil {
+		return crypto.MasterKey{}, err
+	}
+
+	if _, err := os.Stat(filepath.Join(repoDir, "index.db")); os.IsNotExist(err) {
+		if _, err := RebuildIndex(repoDir, backend, mk); err != nil {
+			return crypto.MasterKey{}, fmt.Errorf("failed to rebuild local index: %w", err)
+		}
+	} else if _, err := RefreshIndex(repoDir, backend, mk); err != nil {
+		return crypto.MasterKey{}, fmt.Errorf("failed to refresh local index: %w", err)
+	}
+	return mk, nil
+}
+
+// retireStaleIndex moves index.db aside if it no longer matches the
+// repository: its paths are sealed with a master key another host has
+// since rotated out, or another host rewrote the stored snapshot metadata
+// (see storage.RepoConfig.IndexEpoch). An index that never recorded its key
+// is taken to be sealed with key.
+func retireStaleIndex(repoDir string, key crypto.MasterKey, cfg storage.RepoConfig) error {
+	dbPath := filepath.Join(repoDir, "index.db")
+	if _, err := os.Stat(dbPath); os.IsNotExist(err) {
+		return nil
+	}
+	idx, err := index.NewIndex(repoDir, key)
+	if err != nil {
+		return fmt.Errorf("failed to open index: %w", err)
+	}
+	id, recorded, err := idx.MasterKeyID()
+	if err != nil {
+		idx.Close()
+		return err
+	}
+	epoch, err := idx.Epoch()
+	if err != nil {
+		idx.Close()
+		return err
+	}
+	var reason string
+	switch {
+	case recorded && id != key.ID():
+		reason = "sealed with a retired master key"
+	case epoch < cfg.IndexEpoch:
+		reason = "older than the snapshot metadata another host rewrote"
+	default:
+		return idx.Close()
+	}
+
+	snapshots, err := idx.ListSnapshots()
+	idx.Close()
+	if err != nil {
+		return err
+	}
+	pending := 0
+	for _, s := range snapshots {
+		if s.Upload == index.UploadPending {
+			pending++
+		}
+	}
+	retired := fmt.Sprintf("%s.%s", dbPath, time.Now().Format("20060102-150405"))
+	if err := os.Rename(dbPath, retired); err != nil {
+		return fmt.Errorf("failed to move aside stale index: %w", err)
+	}
+	fmt.Printf("INDEX: %s; kept as %s and rebuilt from the backend\n", reason, retired)
+	if pending > 0 {
+		fmt.Printf("INDEX: %d snapshots in %s were never uploaded and are not in the rebuilt index\n", pending, retired)
+	}
+	security.LogAction("INDEX_RETIRED", fmt.Sprintf("Index %s moved aside", reason))
+	return nil
+}
+
+// lockRepository takes a repository lock (see storage.AcquireLock) and
+// returns the function that releases it
+func lockRepository(backend storage.Backend, exclusive bool) (func(), error) {
+	lock, err := storage.AcquireLock(backend, exclusive)
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		if err := lock.Release(); err != nil {
+			fmt.Printf("LOCK: failed to release the repository lock: %v\n", err)
+		}
+	}, nil
+}
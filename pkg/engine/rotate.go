@@ -0,0 +1,572 @@
+package engine
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pranavdwivedi/aegis/pkg/crypto"
+	"github.com/pranavdwivedi/aegis/pkg/hash"
+	"github.com/pranavdwivedi/aegis/pkg/index"
+	"github.com/pranavdwivedi/aegis/pkg/security"
+	"github.com/pranavdwivedi/aegis/pkg/storage"
+)
+
+// rotationNamespace holds the checkpoints of an in-progress key rotation,
+// sealed with the old master key. The highest sequence number is current.
+// The new key is never sealed with the old one: a checkpoint holds it as a
+// key file wrapped by the passphrase that started the rotation.
+const rotationNamespace = "rotation/"
+
+// DefaultRotateBatch is the number of objects re-encrypted between checkpoints
+const DefaultRotateBatch = 100
+
+// Rotation phases, in order
+const (
+	rotatePhaseObjects = "objects" // loose objects, packs, snapshot metadata, config, parity
+	rotatePhaseIndex   = "index"   // encrypted paths in index.db
+	rotatePhaseVerify  = "verify"
+	rotatePhaseRetire  = "retire"
+)
+
+// RotateProgress is reported after every checkpoint
+type RotateProgress struct {
+	Phase string
+	Done  int
+	Total int
+}
+
+// RotateReport summarizes a completed rotation
+type RotateReport struct {
+	Objects      int // loose objects re-encrypted into packs
+	Packs        int
+	Metadata     int // snapshot metadata, config and parity objects
+	Paths        int
+	Repaired     int      // objects found under the old key during verification
+	RevokedSlots []string // labels of key slots that must be re-added
+	Resumed      bool
+}
+
+// rotationState is the resumable checkpoint of a rotation
+type rotationState struct {
+	Seq        int64              `json:"seq"`
+	NewKeyFile []byte             `json:"new_key_file"` // the new key, wrapped like the unlocking slot
+	Config     storage.RepoConfig `json:"config"`
+	Phase      string             `json:"phase"`
+	Loose      []string           `json:"loose,omitempty"`
+	Packs      []string           `json:"packs,omitempty"`
+	Metadata   []string           `json:"metadata,omitempty"`
+	LastFileID int64              `json:"last_file_id"`
+	Total      int                `json:"total"`
+	Done       int                `json:"done"`
+	Report     RotateReport       `json:"report"`
+}
+
+// RotateKey replaces the master key of the repository.
+//
+// A new master key is generated and every stored object, snapshot metadata
+// and parity object, the repository config and every index path is
+// re-encrypted with it in batches. Progress is checkpointed in the backend
+// (sealed with the old key, with the new key wrapped by passphrase), so an
+// interrupted rotation resumes where it stopped when RotateKey is called
+// again with the same passphrase. The old key is retired only after every
+// referenced chunk, snapshot and path has been verified under the new key.
+//
+// The new key gets a single slot for passphrase; all other slots are revoked
+// (their labels are reported) and must be added again. A rotation holds an
+// exclusive repository lock, and Open refuses the repository until it has
+// completed. Other hosts find their local index sealed with the retired key
+// when they next Open the repository, and rebuild it from the backend.
+func RotateKey(repoDir string, backend storage.Backend, passphrase string, batchSize int, progress func(RotateProgress)) (RotateReport, error) {
+	security.RepoDir = repoDir
+	if batchSize <= 0 {
+		batchSize = DefaultRotateBatch
+	}
+	if progress == nil {
+		progress = func(RotateProgress) {}
+	}
+
+	unlock, err := lockRepository(backend, true)
+	if err != nil {
+		return RotateReport{}, err
+	}
+	defer unlock()
+
+	unlocked, err := storage.UnlockKeySlots(backend, passphrase)
+	if err != nil {
+		return RotateReport{}, err
+	}
+	st, err := loadRotation(backend, unlocked)
+	if err != nil {
+		return RotateReport{}, err
+	}
+	oldKey, slot := unlocked[0].Key, unlocked[0].Slot
+	var newKey crypto.MasterKey
+	if st != nil {
+		if newKey, err = crypto.OpenKey(st.NewKeyFile, passphrase); err != nil {
+			return RotateReport{}, fmt.Errorf("rotation was started with another passphrase: %w", err)
+		}
+		if oldKey, slot, err = retiringKey(unlocked, newKey, st.Phase); err != nil {
+			return RotateReport{}, err
+		}
+	}
+
+	packer, err := storage.NewPacker(backend, filepath.Join(repoDir, storage.PackIndexName), storage.DefaultPackSize)
+	if err != nil {
+		return RotateReport{}, fmt.Errorf("failed to open pack index: %w", err)
+	}
+	defer packer.Close()
+
+	idx, err := index.NewIndex(repoDir, oldKey)
+	if err != nil {
+		return RotateReport{}, fmt.Errorf("failed to open index: %w", err)
+	}
+	defer idx.Close()
+
+	if st == nil {
+		if st, err = startRotation(backend, packer, oldKey, passphrase, slot.KDF); err != nil {
+			return RotateReport{}, err
+		}
+		if newKey, err = crypto.OpenKey(st.NewKeyFile, passphrase); err != nil {
+			return RotateReport{}, err
+		}
+		security.LogAction("KEY_ROTATE_START", fmt.Sprintf("Rotating master key (%d objects)", st.Total))
+	} else {
+		st.Report.Resumed = true
+	}
+	// Checkpoints are plain metadata; the repository config may already be
+	// sealed with the new key, so it is carried in the checkpoint instead.
+	metaStore, err := storage.NewContentAddressableStoreWithConfig(backend, oldKey, storage.RepoConfig{})
+	if err != nil {
+		return st.Report, err
+	}
+	if err := saveRotation(backend, metaStore, st); err != nil {
+		return st.Report, err
+	}
+
+	oldStore, err := storage.NewContentAddressableStoreWithConfig(packer, oldKey, st.Config)
+	if err != nil {
+		return st.Report, err
+	}
+	newStore, err := storage.NewContentAddressableStoreWithConfig(packer, newKey, st.Config)
+	if err != nil {
+		return st.Report, err
+	}
+
+	checkpoint := func() error {
+		progress(RotateProgress{Phase: st.Phase, Done: st.Done, Total: st.Total})
+		return saveRotation(backend, metaStore, st)
+	}
+	rekey := func(key string, data []byte) ([]byte, error) {
+		return oldStore.Rekey(key, data, newKey)
+	}
+
+	for {
+		switch st.Phase {
+		case rotatePhaseObjects:
+			switch {
+			case len(st.Loose) > 0:
+				n := min(batchSize, len(st.Loose))
+				if err := rotateLoose(backend, packer, st.Loose[:n], oldStore, newKey); err != nil {
+					return st.Report, err
+				}
+				st.Loose = st.Loose[n:]
+				st.Done += n
+				st.Report.Objects += n
+			case len(st.Packs) > 0:
+				n := min(batchSize, len(st.Packs))
+				if err := packer.RewritePacks(st.Packs[:n], rekey); err != nil {
+					return st.Report, err
+				}
+				st.Packs = st.Packs[n:]
+				st.Done += n
+				st.Report.Packs += n
+			case len(st.Metadata) > 0:
+				n := min(batchSize, len(st.Metadata))
+				for _, k := range st.Metadata[:n] {
+					if err := rotateMetadata(idx, oldStore, newStore, st, k); err != nil {
+						return st.Report, err
+					}
+				}
+				st.Metadata = st.Metadata[n:]
+				st.Done += n
+				st.Report.Metadata += n
+			default:
+				st.Phase = rotatePhaseIndex
+			}
+
+		case rotatePhaseIndex:
+			last, n, err := idx.RekeyPaths(newKey, st.LastFileID, batchSize)
+			if err != nil {
+				return st.Report, err
+			}
+			if n == 0 {
+				if err := idx.SetMasterKeyID(newKey.ID()); err != nil {
+					return st.Report, err
+				}
+				st.Phase = rotatePhaseVerify
+				break
+			}
+			st.LastFileID = last
+			st.Report.Paths += n
+
+		case rotatePhaseVerify:
+			repaired, err := verifyRotation(repoDir, backend, idx, packer, oldStore, newStore, newKey)
+			st.Report.Repaired += repaired
+			if err != nil {
+				// Stay in the verify phase; a later run retries after repair
+				_ = checkpoint()
+				return st.Report, err
+			}
+			st.Phase = rotatePhaseRetire
+
+		case rotatePhaseRetire:
+			// Once the key files are swapped only the new key can read the
+			// checkpoints, so leave one sealed with it next to the old-key one.
+			if err := saveRotationCopy(newStore, st); err != nil {
+				return st.Report, err
+			}
+
+			revoked, err := storage.ReplaceKeys(backend, newKey, slot.Label, passphrase, slot.KDF)
+			if err != nil {
+				return st.Report, fmt.Errorf("failed to store new key: %w", err)
+			}
+			// The slot we rewrapped is not revoked
+			for i, l := range revoked {
+				if l == slot.Label {
+					revoked = append(revoked[:i], revoked[i+1:]...)
+					break
+				}
+			}
+			st.Report.RevokedSlots = revoked
+
+			if err := clearRotation(backend); err != nil {
+				return st.Report, err
+			}
+			security.LogAction("KEY_ROTATE_DONE", fmt.Sprintf("Master key rotated; %d slots revoked", len(revoked)))
+			return st.Report, nil
+		}
+
+		if err := checkpoint(); err != nil {
+			return st.Report, err
+		}
+	}
+}
+
+// retiringKey picks the key being retired out of the keys the passphrase
+// unlocks. Once the retire phase has stored the new key file, the old one
+// may be gone or still next to it; either way the checkpoint, not the order
+// of the key files, tells the keys apart.
+func retiringKey(unlocked []storage.UnlockedSlot, newKey crypto.MasterKey, phase string) (crypto.MasterKey, crypto.KeySlot, error) {
+	for _, u := range unlocked {
+		if u.Key.ID() != newKey.ID() {
+			return u.Key, u.Slot, nil
+		}
+	}
+	if phase != rotatePhaseRetire {
+		return crypto.MasterKey{}, crypto.KeySlot{}, fmt.Errorf("the key being rotated out is gone before the rotation finished")
+	}
+	// Only the checkpoints are left to clear; they are read with the new key
+	return newKey, unlocked[0].Slot, nil
+}
+
+// startRotation generates the new key, wraps it with passphrase and params
+// like the slot that unlocked the old one, and snapshots the work list and
+// the repository config
+func startRotation(backend storage.Backend, packer *storage.Packer, oldKey crypto.MasterKey, passphrase string, params crypto.KDFParams) (*rotationState, error) {
+	store, err := storage.NewContentAddressableStore(backend, oldKey)
+	if err != nil {
+		return nil, err
+	}
+	newKey, err := crypto.NewMasterKey()
+	if err != nil {
+		return nil, err
+	}
+	// The repository keeps its cipher across rotations
+	keyFile, err := crypto.SealKey(newKey.WithCipher(oldKey.Cipher()), passphrase, params)
+	if err != nil {
+		return nil, err
+	}
+	st := &rotationState{NewKeyFile: keyFile, Config: store.Config(), Phase: rotatePhaseObjects}
+
+	seen := make(map[string]bool)
+	err = backend.List("", func(obj storage.ObjectInfo) error {
+		switch {
+		case !strings.Contains(obj.Key, "/"):
+			st.Loose = append(st.Loose, obj.Key)
+		case strings.HasPrefix(obj.Key, snapshotNamespace), strings.HasPrefix(obj.Key, storage.ConfigNamespace),
+			strings.HasPrefix(obj.Key, storage.ParityNamespace), strings.HasPrefix(obj.Key, storage.ParityDataNamespace):
+			// Every version of an object is replaced at once
+			if k := storage.MetadataBase(obj.Key); !seen[k] {
+				seen[k] = true
+				st.Metadata = append(st.Metadata, k)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if st.Packs, err = packer.ListPacks(); err != nil {
+		return nil, err
+	}
+	st.Total = len(st.Loose) + len(st.Packs) + len(st.Metadata)
+	return st, nil
+}
+
+// rotateLoose re-encrypts loose objects into packs, then deletes the originals
+func rotateLoose(backend storage.Backend, packer *storage.Packer, keys []string, oldStore *storage.ContentAddressableStore, newKey crypto.MasterKey) error {
+	for _, k := range keys {
+		if packed, err := packer.Has(k); err != nil {
+			return err
+		} else if packed {
+			continue // Moved before an interruption
+		}
+
+		data, err := backend.Get(k)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", k, err)
+		}
+		rekeyed, err := oldStore.Rekey(k, data, newKey)
+		if err != nil {
+			return fmt.Errorf("%s: %w", k, err)
+		}
+		if err := packer.Put(k, rekeyed); err != nil {
+			return err
+		}
+	}
+
+	if err := packer.Flush(); err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if err := backend.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rotateMetadata re-seals one snapshot metadata, config or parity object with the new key
+func rotateMetadata(idx *index.Index, oldStore, newStore *storage.ContentAddressableStore, st *rotationState, key string) error {
+	if _, err := newStore.GetMetadata(key); err == nil {
+		return nil // Already rotated
+	}
+
+	// An interrupted replace may have left the new version next to the old
+	// one. If neither is readable, the checkpoint has a copy of the config
+	// and snapshots are recreated from the index.
+	data, err := newStore.GetLatestMetadata(key)
+	if err != nil {
+		data, err = oldStore.GetLatestMetadata(key)
+	}
+	switch {
+	case err == nil:
+	case errors.Is(err, storage.ErrPrivateKeyRequired):
+		// Sealed with a write-only data key, which does not change
+		return nil
+	case key == storage.ConfigKey:
+		data, err = json.Marshal(st.Config)
+	case strings.HasPrefix(key, storage.ParityNamespace), strings.HasPrefix(key, storage.ParityDataNamespace):
+		// Parity cannot be recreated; losing a group only costs redundancy
+		return nil
+	default:
+		id, perr := strconv.ParseInt(strings.TrimPrefix(key, snapshotNamespace), 16, 64)
+		if perr != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+		rec, eerr := idx.ExportSnapshot(id)
+		if eerr != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+		data, err = json.Marshal(rec)
+	}
+	if err != nil {
+		return err
+	}
+	return newStore.ReplaceMetadata(key, data)
+}
+
+// verifyRotation checks that everything the index references is readable
+// with the new key. Chunks still sealed with the old key (e.g. written by a
+// backup during the rotation) are re-encrypted on the spot.
+func verifyRotation(repoDir string, backend storage.Backend, idx *index.Index, packer *storage.Packer, oldStore, newStore *storage.ContentAddressableStore, newKey crypto.MasterKey) (int, error) {
+	referenced, err := idx.ReferencedHashes()
+	if err != nil {
+		return 0, err
+	}
+
+	hashes := make([]string, 0, len(referenced))
+	for h := range referenced {
+		hashes = append(hashes, h)
+	}
+	sort.Strings(hashes)
+
+	repaired, failed := 0, 0
+	for _, hs := range hashes {
+		h, err := hash.Parse(hs)
+		if err != nil {
+			failed++
+			continue
+		}
+		if _, err := newStore.Get(h); err == nil || errors.Is(err, storage.ErrPrivateKeyRequired) {
+			continue // Chunks of write-only backups keep their data key
+		}
+
+		// Still under the old key?
+		data, err := packer.Get(hs)
+		if err == nil {
+			data, err = oldStore.Rekey(hs, data, newKey)
+		}
+		if err == nil {
+			err = packer.Replace(hs, data)
+		}
+		if err == nil {
+			_, err = newStore.Get(h)
+		}
+		if err != nil {
+			fmt.Printf("UNREADABLE CHUNK: %s - %v\n", hs, err)
+			failed++
+			continue
+		}
+		repaired++
+	}
+	if err := packer.Flush(); err != nil {
+		return repaired, err
+	}
+
+	ids, err := storedSnapshots(backend)
+	if err != nil {
+		return repaired, err
+	}
+	for _, id := range ids {
+		if _, err := newStore.GetLatestMetadata(snapshotKey(id)); err != nil && !errors.Is(err, storage.ErrPrivateKeyRequired) {
+			fmt.Printf("UNREADABLE SNAPSHOT: %s - %v\n", snapshotKey(id), err)
+			failed++
+		}
+	}
+	if exists, err := newStore.HasMetadata(storage.ConfigKey); err != nil {
+		return repaired, err
+	} else if exists {
+		if _, err := newStore.GetLatestMetadata(storage.ConfigKey); err != nil {
+			fmt.Printf("UNREADABLE CONFIG: %v\n", err)
+			failed++
+		}
+	}
+
+	newIdx, err := index.NewIndex(repoDir, newKey)
+	if err != nil {
+		return repaired, err
+	}
+	defer newIdx.Close()
+	snapshots, err := newIdx.ListSnapshots()
+	if err != nil {
+		return repaired, err
+	}
+	for _, s := range snapshots {
+		if _, err := newIdx.GetFiles(s.ID); err != nil {
+			fmt.Printf("UNREADABLE PATHS: snapshot %d - %v\n", s.ID, err)
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return repaired, fmt.Errorf("verification failed: %d objects unreadable with the new key; old key kept", failed)
+	}
+	return repaired, nil
+}
+
+func rotationKey(seq int64) string {
+	return fmt.Sprintf("%s%016x", rotationNamespace, seq)
+}
+
+// loadRotation returns the newest checkpoint readable with one of the
+// unlocked keys, or nil if no rotation is in progress
+func loadRotation(backend storage.Backend, unlocked []storage.UnlockedSlot) (*rotationState, error) {
+	var keys []string
+	err := backend.List(rotationNamespace, func(obj storage.ObjectInfo) error {
+		keys = append(keys, obj.Key)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(keys)))
+
+	var stores []*storage.ContentAddressableStore
+	for _, u := range unlocked {
+		store, err := storage.NewContentAddressableStoreWithConfig(backend, u.Key, storage.RepoConfig{})
+		if err != nil {
+			return nil, err
+		}
+		stores = append(stores, store)
+	}
+	for _, k := range keys {
+		for _, store := range stores {
+			data, err := store.GetMetadata(k)
+			if err != nil {
+				continue // Torn write or another key; fall back to the previous checkpoint
+			}
+			var st rotationState
+			if err := json.Unmarshal(data, &st); err != nil {
+				continue
+			}
+			return &st, nil
+		}
+	}
+	if len(keys) > 0 {
+		return nil, fmt.Errorf("rotation in progress but no checkpoint is readable with this key")
+	}
+	return nil, nil
+}
+
+// saveRotation writes a new checkpoint, then removes the older ones
+func saveRotation(backend storage.Backend, store *storage.ContentAddressableStore, st *rotationState) error {
+	st.Seq++
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	if err := store.PutMetadata(rotationKey(st.Seq), data); err != nil {
+		return fmt.Errorf("failed to save rotation checkpoint: %w", err)
+	}
+	for seq := st.Seq - 1; seq > 0 && seq >= st.Seq-2; seq-- {
+		if err := backend.Delete(rotationKey(seq)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// saveRotationCopy writes a checkpoint without removing the older ones
+func saveRotationCopy(store *storage.ContentAddressableStore, st *rotationState) error {
+	st.Seq++
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	return store.PutMetadata(rotationKey(st.Seq), data)
+}
+
+// clearRotation removes every checkpoint once the rotation is complete
+func clearRotation(backend storage.Backend) error {
+	var keys []string
+	err := backend.List(rotationNamespace, func(obj storage.ObjectInfo) error {
+		keys = append(keys, obj.Key)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if err := backend.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package engine
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pranavdwivedi/aegis/pkg/chunker"
+	"github.com/pranavdwivedi/aegis/pkg/storage"
+)
+
+var errInterrupted = errors.New("interrupted")
+
+// interruptingBackend fails the operations fail matches, as a crash or a
+// lost connection at that point would
+type interruptingBackend struct {
+	storage.Backend
+	fail func(op, key string) bool
+}
+
+func (b *interruptingBackend) Put(key string, data []byte) error {
+	if b.fail != nil && b.fail("put", key) {
+		return errInterrupted
+	}
+	return b.Backend.Put(key, data)
+}
+
+func (b *interruptingBackend) Delete(key string) error {
+	if b.fail != nil && b.fail("delete", key) {
+		return errInterrupted
+	}
+	return b.Backend.Delete(key)
+}
+
+func TestRotateKeyResumes(t *testing.T) {
+	dir := t.TempDir()
+	local, err := storage.NewLocalBackend(filepath.Join(dir, "backend"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := &interruptingBackend{Backend: local}
+	hostA, hostB := filepath.Join(dir, "host-a"), filepath.Join(dir, "host-b")
+
+	oldKey, err := Init(hostA, backend, testPassphrase, testKDF, 0, chunker.Params{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents := map[string]string{"first": "first file\n", "second": "second file\n"}
+	sources := map[int64]string{}
+	for name, content := range contents {
+		src := writeSource(t, filepath.Join(dir, name), content)
+		id, err := Backup(hostA, backend, oldKey, src, Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sources[id] = name
+	}
+	// Host B indexes the repository before the rotation
+	if _, err := Open(hostB, backend, testPassphrase); err != nil {
+		t.Fatal(err)
+	}
+
+	// Stop the rotation inside the objects phase, after each phase, and
+	// while the key files are replaced
+	failCheckpoint := func(op, key string) bool {
+		return op == "put" && strings.HasPrefix(key, rotationNamespace)
+	}
+	stops := []struct {
+		name  string
+		at    func(RotateProgress) bool
+		inner func(op, key string) bool
+	}{
+		{name: "objects", at: func(p RotateProgress) bool { return p.Phase == rotatePhaseObjects && p.Done == 2 }},
+		{name: "index", at: func(p RotateProgress) bool { return p.Phase == rotatePhaseIndex }},
+		{name: "verify", at: func(p RotateProgress) bool { return p.Phase == rotatePhaseVerify }},
+		{name: "retire", at: func(p RotateProgress) bool { return p.Phase == rotatePhaseRetire }},
+		{name: "key files", inner: func(op, key string) bool {
+			return op == "delete" && strings.HasPrefix(key, storage.KeyNamespace)
+		}},
+	}
+	for _, stop := range stops {
+		backend.fail = stop.inner
+		progress := func(p RotateProgress) {
+			if stop.at != nil && stop.at(p) {
+				backend.fail = failCheckpoint
+			}
+		}
+		if _, err := RotateKey(hostA, backend, testPassphrase, 1, progress); !errors.Is(err, errInterrupted) {
+			t.Fatalf("rotation stopped at %s returned %v", stop.name, err)
+		}
+		backend.fail = nil
+		if _, err := Open(hostB, backend, testPassphrase); !errors.Is(err, ErrRotationInProgress) {
+			t.Errorf("open after a rotation stopped at %s returned %v", stop.name, err)
+		}
+	}
+	if ids, _ := storage.ListKeys(backend); len(ids) != 2 {
+		t.Fatalf("test setup: the last stop should leave both key files, have %v", ids)
+	}
+
+	report, err := RotateKey(hostA, backend, testPassphrase, 1, nil)
+	if err != nil {
+		t.Fatalf("resumed rotation failed: %v", err)
+	}
+	if !report.Resumed {
+		t.Error("rotation did not resume from its checkpoint")
+	}
+	if ids, _ := storage.ListKeys(backend); len(ids) != 1 {
+		t.Errorf("key files after the rotation: %v", ids)
+	}
+
+	for _, host := range []string{hostA, hostB} {
+		key, err := Open(host, backend, testPassphrase)
+		if err != nil {
+			t.Fatalf("open on %s after the rotation: %v", filepath.Base(host), err)
+		}
+		if key.ID() == oldKey.ID() {
+			t.Fatal("passphrase still opens the retired key")
+		}
+		for id, name := range sources {
+			checkRestore(t, host, backend, key, id, filepath.Join(dir, name), contents[name])
+		}
+	}
+	if retired, _ := filepath.Glob(filepath.Join(hostA, "index.db.*")); len(retired) != 0 {
+		t.Errorf("the rotating host moved its index aside: %v", retired)
+	}
+	if retired, _ := filepath.Glob(filepath.Join(hostB, "index.db.*")); len(retired) != 1 {
+		t.Errorf("host B kept %v, want its index sealed with the retired key", retired)
+	}
+}
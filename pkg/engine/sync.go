@@ -2,8 +2,6 @@ package engine
 
 import (
 	"fmt"
-	"os"
-	"path/filepath"
 	"strings"
 	"sync"
 	"time"
@@ -12,17 +10,11 @@ import (
 )
 
 // Sync synchronizes all objects from source to dest.
-// It assumes source is LocalBackend (to list files) and dest is generic Backend.
-// For S3-to-Local sync, we would need a layout-aware Lister in the interface,
-// but for now we focus on Backup Sync (Local -> Cloud).
-func Sync(localRepoDir string, dest storage.Backend) error {
-	objectsDir := filepath.Join(localRepoDir, "objects")
-
-	type task struct {
-		key  string
-		path string
-	}
-	tasks := make(chan task, 100)
+// Both sides can be any Backend (Local -> Cloud, Cloud -> Local, ...).
+// Objects already present in dest are skipped, and so are locks, which
+// only mean something in the repository that holds them.
+func Sync(source storage.Backend, dest storage.Backend) error {
+	tasks := make(chan storage.ObjectInfo, 100)
 	var wg sync.WaitGroup
 
 	// Worker pool
@@ -30,29 +22,32 @@ func Sync(localRepoDir string, dest storage.Backend) error {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			for t := range tasks {
+			for obj := range tasks {
+				key := obj.Key
 				// Check if exists in dest
-				exists, err := dest.Has(t.key)
+				exists, err := dest.Has(key)
 				if err != nil {
-					fmt.Printf("Error checking %s: %v\n", t.key, err)
+					fmt.Printf("Error checking %s: %v\n", key, err)
 					continue
 				}
 				if exists {
-					// fmt.Printf("Skipping %s (exists)\n", t.key) // Verbose
+					// fmt.Printf("Skipping %s (exists)\n", key) // Verbose
 					continue
 				}
 
-				// Upload
-				data, err := os.ReadFile(t.path)
+				// Upload, streaming where both sides support it
+				r, err := storage.StreamGet(source, key)
 				if err != nil {
-					fmt.Printf("Error reading %s: %v\n", t.path, err)
+					fmt.Printf("Error reading %s: %v\n", key, err)
 					continue
 				}
-				if err := dest.Put(t.key, data); err != nil {
-					fmt.Printf("Error uploading %s: %v\n", t.key, err)
+				err = storage.StreamPut(dest, key, r, obj.Size)
+				r.Close()
+				if err != nil {
+					fmt.Printf("Error uploading %s: %v\n", key, err)
 					continue
 				}
-				fmt.Printf("Synced: %s\n", t.key)
+				fmt.Printf("Synced: %s\n", key)
 			}
 		}()
 	}
@@ -60,31 +55,11 @@ func Sync(localRepoDir string, dest storage.Backend) error {
 	start := time.Now()
 	count := 0
 
-	err := filepath.Walk(objectsDir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if info.IsDir() {
-			return nil
-		}
-		if strings.HasPrefix(info.Name(), ".") {
-			return nil
-		}
-
-		// Calculate key from path logic?
-		// LocalBackend stores as objects/ab/cdef...
-		// Key is abcdef...
-		// We need to reconstruct the key.
-		// Rel path: ab/cdef...
-		rel, _ := filepath.Rel(objectsDir, path)
-		parts := strings.Split(rel, string(os.PathSeparator))
-		if len(parts) != 2 {
-			// Unexpected structure
+	err := source.List("", func(obj storage.ObjectInfo) error {
+		if strings.HasPrefix(obj.Key, storage.LockNamespace) {
 			return nil
 		}
-		key := parts[0] + parts[1]
-
-		tasks <- task{key: key, path: path}
+		tasks <- obj
 		count++
 		return nil
 	})
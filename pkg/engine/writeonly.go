@@ -0,0 +1,61 @@
+package engine
+
+import (
+	"fmt"
+
+	"github.com/pranavdwivedi/aegis/pkg/crypto"
+	"github.com/pranavdwivedi/aegis/pkg/security"
+	"github.com/pranavdwivedi/aegis/pkg/storage"
+)
+
+// EnableWriteOnly prepares the repository for write-only backup hosts and
+// returns the key to install on them (see storage.WriteOnlyKey.Save).
+// The private key is saved to privateKeyPath, which must not exist, and is
+// not stored in the repository: importing, restoring and auditing the
+// snapshots of write-only hosts needs it (see UnlockWriteOnly) as well as
+// the passphrase.
+func EnableWriteOnly(repoDir string, backend storage.Backend, key crypto.MasterKey, privateKeyPath string) (*storage.WriteOnlyKey, error) {
+	security.RepoDir = repoDir
+
+	store, err := storage.NewContentAddressableStore(backend, key)
+	if err != nil {
+		return nil, err
+	}
+	wk, err := store.EnableWriteOnly(privateKeyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	security.LogAction("WRITE_ONLY_ENABLE", fmt.Sprintf("Write-only key issued (public key %x)", wk.PublicKey[:8]))
+	return wk, nil
+}
+
+// UnlockWriteOnly returns key holding the write-only private key saved by
+// EnableWriteOnly, after checking it belongs to the repository. Snapshots
+// of write-only hosts can only be read with the returned key.
+func UnlockWriteOnly(backend storage.Backend, key crypto.MasterKey, privateKeyPath string) (crypto.MasterKey, error) {
+	sk, err := storage.LoadPrivateKey(privateKeyPath)
+	if err != nil {
+		return crypto.MasterKey{}, err
+	}
+	store, err := storage.NewContentAddressableStore(backend, key)
+	if err != nil {
+		return crypto.MasterKey{}, err
+	}
+	if err := store.CheckPrivateKey(sk); err != nil {
+		return crypto.MasterKey{}, err
+	}
+	return key.WithPrivateKey(sk), nil
+}
+
+// BackupWriteOnly is Backup for hosts that only hold a write-only key. The
+// snapshot is sealed with a fresh data key, stored sealed to the repository
+// public key and forgotten afterwards, so the host cannot read this or any
+// other snapshot once the backup is done.
+func BackupWriteOnly(repoDir string, backend storage.Backend, wk *storage.WriteOnlyKey, sourcePath string, opts Options) (int64, error) {
+	dk, err := storage.NewDataKey(backend, wk)
+	if err != nil {
+		return 0, err
+	}
+	return backup(repoDir, backend, dk, wk, sourcePath, opts)
+}
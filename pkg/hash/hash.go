@@ -30,6 +30,33 @@ func Sum(data []byte) Hash {
 	return blake3.Sum256(data)
 }
 
+// SumKeyed computes the keyed BLAKE3 hash of the given data.
+// key must be 32 bytes.
+func SumKeyed(key, data []byte) (Hash, error) {
+	h, err := blake3.NewKeyed(key)
+	if err != nil {
+		return Hash{}, err
+	}
+	h.Write(data)
+	var out Hash
+	copy(out[:], h.Sum(nil))
+	return out, nil
+}
+
+// NewKeyed returns a keyed BLAKE3 hasher, the streaming form of SumKeyed.
+// key must be 32 bytes.
+func NewKeyed(key []byte) (*blake3.Hasher, error) {
+	return blake3.NewKeyed(key)
+}
+
+// DeriveKey derives a 32-byte subkey from material for the given context
+// using the BLAKE3 key derivation mode.
+func DeriveKey(context string, material []byte) []byte {
+	out := make([]byte, 32)
+	blake3.DeriveKey(context, material, out)
+	return out
+}
+
 // SumReader computes the BLAKE3 hash of the data from the reader
 func SumReader(r io.Reader) (Hash, error) {
 	h := blake3.New()
@@ -1,10 +1,14 @@
 package index
 
 import (
+	"crypto/rand"
 	"database/sql"
+	"encoding/binary"
 	"encoding/hex"
 	"fmt"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -43,7 +47,10 @@ func (i *Index) initSchema() error {
 		`CREATE TABLE IF NOT EXISTS snapshots (
 			id INTEGER PRIMARY KEY AUTOINCREMENT,
 			timestamp DATETIME NOT NULL,
-			description TEXT
+			description TEXT,
+			tag TEXT NOT NULL DEFAULT '',
+			host TEXT NOT NULL DEFAULT '',
+			uploaded INTEGER
 		)`,
 		`CREATE TABLE IF NOT EXISTS files (
 			id INTEGER PRIMARY KEY AUTOINCREMENT,
@@ -63,6 +70,10 @@ func (i *Index) initSchema() error {
 			FOREIGN KEY(file_id) REFERENCES files(id)
 		)`,
 		`CREATE INDEX IF NOT EXISTS idx_chunks_hash ON chunks(hash)`,
+		`CREATE TABLE IF NOT EXISTS meta (
+			name TEXT PRIMARY KEY,
+			value TEXT NOT NULL
+		)`,
 	}
 
 	for _, q := range queries {
@@ -70,31 +81,162 @@ func (i *Index) initSchema() error {
 			return err
 		}
 	}
-	return nil
+
+	// Migrations for indexes created by older versions
+	if err := i.addColumnIfMissing("snapshots", "tag", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := i.addColumnIfMissing("snapshots", "host", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	// NULL marks snapshots indexed before uploads were tracked
+	return i.addColumnIfMissing("snapshots", "uploaded", "INTEGER")
+}
+
+func (i *Index) addColumnIfMissing(table, column, def string) error {
+	rows, err := i.db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid     int
+			name    string
+			typ     string
+			notNull bool
+			dflt    sql.NullString
+			pk      int
+		)
+		if err := rows.Scan(&cid, &name, &typ, &notNull, &dflt, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	_, err = i.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, def))
+	return err
+}
+
+// getMeta returns a setting of the index, or "" if it is not set
+func (i *Index) getMeta(name string) (string, error) {
+	var value string
+	err := i.db.QueryRow("SELECT value FROM meta WHERE name = ?", name).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return value, err
+}
+
+func (i *Index) setMeta(name, value string) error {
+	_, err := i.db.Exec("INSERT INTO meta (name, value) VALUES (?, ?) ON CONFLICT(name) DO UPDATE SET value = excluded.value", name, value)
+	return err
+}
+
+// MasterKeyID returns the id of the master key the paths of the index are
+// sealed with; ok is false for indexes that never recorded it
+func (i *Index) MasterKeyID() (id crypto.KeyID, ok bool, err error) {
+	value, err := i.getMeta("master_key_id")
+	if err != nil || value == "" {
+		return id, false, err
+	}
+	b, err := hex.DecodeString(value)
+	if err != nil || len(b) != len(id) {
+		return id, false, fmt.Errorf("corrupt master key id %q in index", value)
+	}
+	copy(id[:], b)
+	return id, true, nil
+}
+
+// SetMasterKeyID records the master key the paths of the index are sealed with
+func (i *Index) SetMasterKeyID(id crypto.KeyID) error {
+	return i.setMeta("master_key_id", hex.EncodeToString(id[:]))
+}
+
+// Epoch returns the repository index epoch the index was built at (see
+// storage.RepoConfig.IndexEpoch)
+func (i *Index) Epoch() (int, error) {
+	value, err := i.getMeta("index_epoch")
+	if err != nil || value == "" {
+		return 0, err
+	}
+	return strconv.Atoi(value)
+}
+
+// SetEpoch records the repository index epoch the index is up to date with
+func (i *Index) SetEpoch(epoch int) error {
+	return i.setMeta("index_epoch", strconv.Itoa(epoch))
 }
 
 // CreateSnapshot starts a new snapshot
 func (i *Index) CreateSnapshot(desc string) (int64, error) {
-	res, err := i.db.Exec("INSERT INTO snapshots (timestamp, description) VALUES (?, ?)", time.Now(), desc)
+	return i.CreateTaggedSnapshot("", "", desc)
+}
+
+// CreateTaggedSnapshot starts a new snapshot of host grouped under tag (e.g.
+// the job name). Snapshot ids are random, so hosts sharing a backend do not
+// pick the same one.
+func (i *Index) CreateTaggedSnapshot(host, tag, desc string) (int64, error) {
+	for range 8 {
+		id, err := newSnapshotID()
+		if err != nil {
+			return 0, err
+		}
+		res, err := i.db.Exec(
+			"INSERT OR IGNORE INTO snapshots (id, timestamp, description, tag, host, uploaded) VALUES (?, ?, ?, ?, ?, 0)",
+			id, time.Now(), desc, tag, host,
+		)
+		if err != nil {
+			return 0, err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return 0, err
+		} else if n == 1 {
+			return id, nil
+		}
+	}
+	return 0, fmt.Errorf("failed to pick an unused snapshot id")
+}
+
+// newSnapshotID returns a random positive snapshot id
+func newSnapshotID() (int64, error) {
+	var b [8]byte
+	for {
+		if _, err := rand.Read(b[:]); err != nil {
+			return 0, err
+		}
+		if id := int64(binary.BigEndian.Uint64(b[:]) >> 1); id != 0 {
+			return id, nil
+		}
+	}
+}
+
+// SetSnapshotUploaded records whether the metadata of a snapshot is in the backend
+func (i *Index) SetSnapshotUploaded(snapshotID int64, uploaded bool) error {
+	res, err := i.db.Exec("UPDATE snapshots SET uploaded = ? WHERE id = ?", uploaded, snapshotID)
 	if err != nil {
-		return 0, err
+		return err
 	}
-	return res.LastInsertId()
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("snapshot %d not found", snapshotID)
+	}
+	return nil
 }
 
 // AddFile adds a file to a snapshot
 func (i *Index) AddFile(snapshotID int64, path string, size int64, mode uint32, modTime time.Time) (int64, error) {
-	// Encrypt path
-	encryptedPath, err := i.key.Encrypt([]byte(path))
+	encodedPath, err := sealPath(i.key, snapshotID, path)
 	if err != nil {
 		return 0, err
 	}
 
-	// We store encrypted path as a hex string or base64 to be safe in TEXT field,
-	// but raw bytes might be okay in SQLite blob if defining column as BLOB.
-	// However, Schema says TEXT. Let's use hex for safety/easier debugging view.
-	encodedPath := hex.EncodeToString(encryptedPath)
-
 	res, err := i.db.Exec(
 		"INSERT INTO files (snapshot_id, path, size, mode, mod_time) VALUES (?, ?, ?, ?, ?)",
 		snapshotID, encodedPath, size, mode, modTime,
@@ -105,6 +247,121 @@ func (i *Index) AddFile(snapshotID int64, path string, size int64, mode uint32,
 	return res.LastInsertId()
 }
 
+// Path encodings in the files table:
+//
+//	<hex>                legacy: AES-256-GCM, no associated data
+//	v1:<hex>             AES-256-GCM bound to the snapshot id
+//	v2:<hex>             first byte is the cipher, bound to the snapshot id
+const (
+	pathPrefixV1 = "v1:"
+	pathPrefixV2 = "v2:"
+)
+
+// pathAD binds an encrypted path to its snapshot, so rows cannot be moved
+// between snapshots without failing decryption
+func pathAD(snapshotID int64) []byte {
+	return []byte(fmt.Sprintf("aegis path %d", snapshotID))
+}
+
+// sealPath encrypts a file path for storage in the files table with the key's cipher
+func sealPath(key crypto.MasterKey, snapshotID int64, path string) (string, error) {
+	encryptedPath, err := key.EncryptWithAD([]byte(path), pathAD(snapshotID))
+	if err != nil {
+		return "", err
+	}
+
+	// We store encrypted path as a hex string or base64 to be safe in TEXT field,
+	// but raw bytes might be okay in SQLite blob if defining column as BLOB.
+	// However, Schema says TEXT. Let's use hex for safety/easier debugging view.
+	return pathPrefixV2 + hex.EncodeToString(append([]byte{byte(key.Cipher())}, encryptedPath...)), nil
+}
+
+// openPath decrypts a path written by sealPath, or an older encoding
+func openPath(key crypto.MasterKey, snapshotID int64, encodedPath string) (string, error) {
+	c, ad := crypto.CipherAES256GCM, []byte(nil)
+	hexPath, v2 := strings.CutPrefix(encodedPath, pathPrefixV2)
+	if !v2 {
+		var v1 bool
+		if hexPath, v1 = strings.CutPrefix(encodedPath, pathPrefixV1); v1 {
+			ad = pathAD(snapshotID)
+		}
+	}
+
+	encryptedPath, err := hex.DecodeString(hexPath)
+	if err != nil {
+		return "", fmt.Errorf("metadata corruption (hex decode): %w", err)
+	}
+	if v2 {
+		if len(encryptedPath) == 0 {
+			return "", fmt.Errorf("metadata corruption (empty path of snapshot %d)", snapshotID)
+		}
+		c, encryptedPath, ad = crypto.Cipher(encryptedPath[0]), encryptedPath[1:], pathAD(snapshotID)
+	}
+
+	decryptedPath, err := key.DecryptWith(c, encryptedPath, ad)
+	if err != nil {
+		return "", fmt.Errorf("metadata corruption (decrypt path of snapshot %d): %w", snapshotID, err)
+	}
+	return string(decryptedPath), nil
+}
+
+// RekeyPaths re-encrypts up to limit file paths with id > afterID under newKey.
+// Paths that already decrypt with newKey are left alone, so a batch can be
+// repeated after a crash. It returns the last id seen and the number of rows
+// visited; zero rows means every path has been processed.
+func (i *Index) RekeyPaths(newKey crypto.MasterKey, afterID int64, limit int) (int64, int, error) {
+	rows, err := i.db.Query("SELECT id, snapshot_id, path FROM files WHERE id > ? ORDER BY id LIMIT ?", afterID, limit)
+	if err != nil {
+		return afterID, 0, err
+	}
+
+	type row struct {
+		id         int64
+		snapshotID int64
+		path       string
+	}
+	var batch []row
+	for rows.Next() {
+		var r row
+		if err := rows.Scan(&r.id, &r.snapshotID, &r.path); err != nil {
+			rows.Close()
+			return afterID, 0, err
+		}
+		batch = append(batch, r)
+	}
+	rows.Close()
+	if len(batch) == 0 {
+		return afterID, 0, nil
+	}
+
+	tx, err := i.db.Begin()
+	if err != nil {
+		return afterID, 0, err
+	}
+	defer tx.Rollback()
+
+	for _, r := range batch {
+		if _, err := openPath(newKey, r.snapshotID, r.path); err == nil {
+			continue // Already rotated
+		}
+		plain, err := openPath(i.key, r.snapshotID, r.path)
+		if err != nil {
+			return afterID, 0, fmt.Errorf("file %d: %w", r.id, err)
+		}
+		rekeyed, err := sealPath(newKey, r.snapshotID, plain)
+		if err != nil {
+			return afterID, 0, err
+		}
+		if _, err := tx.Exec("UPDATE files SET path = ? WHERE id = ?", rekeyed, r.id); err != nil {
+			return afterID, 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return afterID, 0, err
+	}
+	return batch[len(batch)-1].id, len(batch), nil
+}
+
 // AddChunk adds a chunk reference to a file
 func (i *Index) AddChunk(fileID int64, h hash.Hash, offset int64, size int64) error {
 	_, err := i.db.Exec(
@@ -114,6 +371,66 @@ func (i *Index) AddChunk(fileID int64, h hash.Hash, offset int64, size int64) er
 	return err
 }
 
+// DeleteSnapshot removes a snapshot together with its file and chunk rows.
+// The chunks themselves stay in the store until the repository is pruned.
+func (i *Index) DeleteSnapshot(snapshotID int64) error {
+	tx, err := i.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM chunks WHERE file_id IN (SELECT id FROM files WHERE snapshot_id = ?)", snapshotID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM files WHERE snapshot_id = ?", snapshotID); err != nil {
+		return err
+	}
+	res, err := tx.Exec("DELETE FROM snapshots WHERE id = ?", snapshotID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("snapshot %d not found", snapshotID)
+	}
+	return tx.Commit()
+}
+
+// RenameChunks points every chunk row using an old id at its new id
+func (i *Index) RenameChunks(renames map[string]string) error {
+	tx, err := i.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for from, to := range renames {
+		if _, err := tx.Exec("UPDATE chunks SET hash = ? WHERE hash = ?", to, from); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// ReferencedHashes returns the set of chunk hashes used by any snapshot
+func (i *Index) ReferencedHashes() (map[string]bool, error) {
+	rows, err := i.db.Query("SELECT DISTINCT hash FROM chunks")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	refs := make(map[string]bool)
+	for rows.Next() {
+		var h string
+		if err := rows.Scan(&h); err != nil {
+			return nil, err
+		}
+		refs[h] = true
+	}
+	return refs, rows.Err()
+}
+
 type FileSnapshot struct {
 	ID      int64
 	Path    string
@@ -121,36 +438,76 @@ type FileSnapshot struct {
 	ModTime time.Time
 }
 
-// ListSnapshots returns all snapshots
-func (i *Index) ListSnapshots() ([]struct {
-	ID   int64
-	Time time.Time
-	Desc string
-}, error) {
-	rows, err := i.db.Query("SELECT id, timestamp, description FROM snapshots ORDER BY id DESC")
+// Snapshot describes a snapshot in the index
+type Snapshot struct {
+	ID     int64
+	Time   time.Time
+	Desc   string
+	Tag    string
+	Host   string // the host that took the snapshot
+	Upload UploadState
+}
+
+// UploadState tells whether the metadata of a snapshot is in the backend
+type UploadState int
+
+const (
+	UploadUnknown UploadState = iota // indexed before uploads were tracked
+	UploadPending
+	UploadDone
+)
+
+const snapshotColumns = "id, timestamp, description, tag, host, uploaded"
+
+// ListSnapshots returns all snapshots, newest first
+func (i *Index) ListSnapshots() ([]Snapshot, error) {
+	return i.querySnapshots("SELECT " + snapshotColumns + " FROM snapshots ORDER BY timestamp DESC, id DESC")
+}
+
+// ListSnapshotsByTag returns the snapshots host took under tag, newest
+// first. Hosts sharing a backend may use the same tags, so snapshots
+// imported from other hosts are not included.
+func (i *Index) ListSnapshotsByTag(host, tag string) ([]Snapshot, error) {
+	return i.querySnapshots("SELECT "+snapshotColumns+" FROM snapshots WHERE host = ? AND tag = ? ORDER BY timestamp DESC, id DESC", host, tag)
+}
+
+// GetSnapshot returns one snapshot
+func (i *Index) GetSnapshot(snapshotID int64) (Snapshot, error) {
+	snapshots, err := i.querySnapshots("SELECT "+snapshotColumns+" FROM snapshots WHERE id = ?", snapshotID)
 	if err != nil {
-		return nil, err
+		return Snapshot{}, err
 	}
-	defer rows.Close()
+	if len(snapshots) == 0 {
+		return Snapshot{}, fmt.Errorf("snapshot %d not found", snapshotID)
+	}
+	return snapshots[0], nil
+}
 
-	var snapshots []struct {
-		ID   int64
-		Time time.Time
-		Desc string
+func (i *Index) querySnapshots(query string, args ...any) ([]Snapshot, error) {
+	rows, err := i.db.Query(query, args...)
+	if err != nil {
+		return nil, err
 	}
+	defer rows.Close()
 
+	var snapshots []Snapshot
 	for rows.Next() {
-		var s struct {
-			ID   int64
-			Time time.Time
-			Desc string
-		}
-		if err := rows.Scan(&s.ID, &s.Time, &s.Desc); err != nil {
+		var s Snapshot
+		var uploaded sql.NullBool
+		if err := rows.Scan(&s.ID, &s.Time, &s.Desc, &s.Tag, &s.Host, &uploaded); err != nil {
 			return nil, err
 		}
+		switch {
+		case !uploaded.Valid:
+			s.Upload = UploadUnknown
+		case uploaded.Bool:
+			s.Upload = UploadDone
+		default:
+			s.Upload = UploadPending
+		}
 		snapshots = append(snapshots, s)
 	}
-	return snapshots, nil
+	return snapshots, rows.Err()
 }
 
 // FileRecord represents a file inside a snapshot
@@ -164,7 +521,7 @@ type FileRecord struct {
 
 // GetFiles returns all files for a given snapshot
 func (i *Index) GetFiles(snapshotID int64) ([]FileRecord, error) {
-	rows, err := i.db.Query("SELECT id, path, size, mode, mod_time FROM files WHERE snapshot_id = ?", snapshotID)
+	rows, err := i.db.Query("SELECT id, path, size, mode, mod_time FROM files WHERE snapshot_id = ? ORDER BY id", snapshotID)
 	if err != nil {
 		return nil, err
 	}
@@ -179,15 +536,9 @@ func (i *Index) GetFiles(snapshotID int64) ([]FileRecord, error) {
 		}
 
 		// Decrypt Path
-		encryptedPath, err := hex.DecodeString(encodedPath)
-		if err != nil {
-			return nil, fmt.Errorf("metadata corruption (hex decode): %w", err)
-		}
-		decryptedPath, err := i.key.Decrypt(encryptedPath)
-		if err != nil {
-			return nil, fmt.Errorf("metadata corruption (decrypt): %w", err)
+		if f.Path, err = openPath(i.key, snapshotID, encodedPath); err != nil {
+			return nil, err
 		}
-		f.Path = string(decryptedPath)
 
 		files = append(files, f)
 	}
@@ -196,9 +547,9 @@ func (i *Index) GetFiles(snapshotID int64) ([]FileRecord, error) {
 
 // ChunkRecord represents a chunk of a file
 type ChunkRecord struct {
-	Hash   string
-	Offset int64
-	Size   int64
+	Hash   string `json:"hash"`
+	Offset int64  `json:"offset"`
+	Size   int64  `json:"size"`
 }
 
 // GetChunks returns all chunks for a file, ordered by offset
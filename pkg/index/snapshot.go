@@ -0,0 +1,120 @@
+package index
+
+import (
+	"database/sql"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// SnapshotRecord is the self-contained form of a snapshot with all of its
+// files and chunk lists. It is what gets stored (encrypted) in the backend
+// so the index can be rebuilt without the local database.
+type SnapshotRecord struct {
+	ID    int64        `json:"id"`
+	Time  time.Time    `json:"time"`
+	Desc  string       `json:"description"`
+	Tag   string       `json:"tag,omitempty"`
+	Host  string       `json:"host,omitempty"`
+	Files []FileExport `json:"files"`
+}
+
+// FileExport is a file of a SnapshotRecord
+type FileExport struct {
+	Path    string        `json:"path"`
+	Size    int64         `json:"size"`
+	Mode    uint32        `json:"mode"`
+	ModTime time.Time     `json:"mod_time"`
+	Chunks  []ChunkRecord `json:"chunks"`
+}
+
+// Equal reports whether r and o describe the same snapshot
+func (r *SnapshotRecord) Equal(o *SnapshotRecord) bool {
+	if r.ID != o.ID || !r.Time.Equal(o.Time) || r.Desc != o.Desc || r.Tag != o.Tag || r.Host != o.Host || len(r.Files) != len(o.Files) {
+		return false
+	}
+	for i, f := range r.Files {
+		g := o.Files[i]
+		if f.Path != g.Path || f.Size != g.Size || f.Mode != g.Mode || !f.ModTime.Equal(g.ModTime) || !slices.Equal(f.Chunks, g.Chunks) {
+			return false
+		}
+	}
+	return true
+}
+
+// ExportSnapshot collects everything the index knows about a snapshot
+func (i *Index) ExportSnapshot(snapshotID int64) (*SnapshotRecord, error) {
+	rec := &SnapshotRecord{ID: snapshotID}
+	err := i.db.QueryRow("SELECT timestamp, description, tag, host FROM snapshots WHERE id = ?", snapshotID).
+		Scan(&rec.Time, &rec.Desc, &rec.Tag, &rec.Host)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("snapshot %d not found", snapshotID)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := i.GetFiles(snapshotID)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		chunks, err := i.GetChunks(f.ID)
+		if err != nil {
+			return nil, err
+		}
+		rec.Files = append(rec.Files, FileExport{
+			Path:    f.Path,
+			Size:    f.Size,
+			Mode:    f.Mode,
+			ModTime: f.ModTime,
+			Chunks:  chunks,
+		})
+	}
+	return rec, nil
+}
+
+// ImportSnapshot inserts a snapshot exported by ExportSnapshot, keeping its ID.
+// It came from the backend, so it counts as uploaded.
+func (i *Index) ImportSnapshot(rec *SnapshotRecord) error {
+	tx, err := i.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(
+		"INSERT INTO snapshots (id, timestamp, description, tag, host, uploaded) VALUES (?, ?, ?, ?, ?, 1)",
+		rec.ID, rec.Time, rec.Desc, rec.Tag, rec.Host,
+	); err != nil {
+		return fmt.Errorf("snapshot %d: %w", rec.ID, err)
+	}
+
+	for _, f := range rec.Files {
+		encodedPath, err := sealPath(i.key, rec.ID, f.Path)
+		if err != nil {
+			return err
+		}
+		res, err := tx.Exec(
+			"INSERT INTO files (snapshot_id, path, size, mode, mod_time) VALUES (?, ?, ?, ?, ?)",
+			rec.ID, encodedPath, f.Size, f.Mode, f.ModTime,
+		)
+		if err != nil {
+			return err
+		}
+		fileID, err := res.LastInsertId()
+		if err != nil {
+			return err
+		}
+
+		for _, c := range f.Chunks {
+			if _, err := tx.Exec(
+				"INSERT INTO chunks (file_id, hash, offset, size) VALUES (?, ?, ?, ?)",
+				fileID, c.Hash, c.Offset, c.Size,
+			); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
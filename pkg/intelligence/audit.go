@@ -15,10 +15,17 @@ type AuditReport struct {
 	CorruptChunks int
 	Healthy       bool
 	Score         int // 0-100
+
+	// Set by a repairing audit
+	HealedChunks        []string
+	UnrecoverableChunks []string
 }
 
-// AuditRepository checks every chunk in the repository for integrity
-func AuditRepository(idx *index.Index, store *storage.ContentAddressableStore) (AuditReport, error) {
+// AuditRepository checks every chunk in the repository for integrity.
+// With repair, missing and corrupt chunks are rebuilt from parity and stored
+// again (through a Packer the caller must flush afterwards); the repository
+// counts as healthy if every damaged chunk was healed.
+func AuditRepository(idx *index.Index, store *storage.ContentAddressableStore, repair bool) (AuditReport, error) {
 	snapshots, err := idx.ListSnapshots()
 	if err != nil {
 		return AuditReport{}, err
@@ -26,6 +33,7 @@ func AuditRepository(idx *index.Index, store *storage.ContentAddressableStore) (
 
 	report := AuditReport{Healthy: true, Score: 100}
 	checkedChunks := make(map[string]bool)
+	var damaged []hash.Hash
 
 	for _, s := range snapshots {
 		files, err := idx.GetFiles(s.ID)
@@ -61,6 +69,7 @@ func AuditRepository(idx *index.Index, store *storage.ContentAddressableStore) (
 				// Store.Get() decrypts and verifies hash.
 				_, err = store.Get(h)
 				if err != nil {
+					damaged = append(damaged, h)
 					// Distinguish missing vs corrupt?
 					// Store.Get returns error for both.
 					// We can check existence first.
@@ -82,5 +91,25 @@ func AuditRepository(idx *index.Index, store *storage.ContentAddressableStore) (
 		report.Score = 0 // Simply fail score for now if any corruption
 	}
 
+	if repair && len(damaged) > 0 {
+		healed, unrecoverable, err := store.Repair(damaged)
+		for _, h := range healed {
+			report.HealedChunks = append(report.HealedChunks, h.String())
+			fmt.Printf("HEALED CHUNK: %s\n", h)
+		}
+		for _, h := range unrecoverable {
+			report.UnrecoverableChunks = append(report.UnrecoverableChunks, h.String())
+			fmt.Printf("UNRECOVERABLE CHUNK: %s\n", h)
+		}
+		if err != nil {
+			return report, fmt.Errorf("repair failed: %w", err)
+		}
+		// Unparseable ids were never candidates for repair
+		if len(healed) == report.MissingChunks+report.CorruptChunks {
+			report.Healthy = true
+			report.Score = 100
+		}
+	}
+
 	return report, nil
 }
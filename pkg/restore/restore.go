@@ -2,6 +2,7 @@ package restore
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"sort"
@@ -74,53 +75,75 @@ func restoreFile(idx *index.Index, store *storage.ContentAddressableStore, f ind
 		return err
 	}
 
-	var out *os.File
+	var out io.Writer = io.Discard
+	var file *os.File
 	if !dryRun {
 		// Ensure parent dir exists
 		if err := os.MkdirAll(filepath.Dir(destPath), 0700); err != nil {
 			return err
 		}
 
-		// Create file
-		out, err = os.Create(destPath)
+		// Write to a temporary file, renamed into place once every chunk
+		// verified: a corrupt chunk must not leave a partial file behind,
+		// nor replace an existing one
+		file, err = os.CreateTemp(filepath.Dir(destPath), "."+filepath.Base(destPath)+".tmp-*")
 		if err != nil {
 			return err
 		}
-		defer out.Close()
+		defer func() {
+			if file != nil {
+				file.Close()
+				os.Remove(file.Name())
+			}
+		}()
+		out = file
 	}
 
-	// Reassemble
+	// Reassemble, streaming each chunk into the file
 	for _, c := range chunks {
-		h, err := hash.Parse(c.Hash)
-		if err != nil {
+		if err := copyChunk(store, c.Hash, out); err != nil {
 			return err
 		}
-
-		data, err := store.Get(h)
-		if err != nil {
-			return fmt.Errorf("chunk missing or corrupted %s: %w", c.Hash, err)
-		}
-
-		if !dryRun {
-			if _, err := out.Write(data); err != nil {
-				return err
-			}
-		}
 	}
 
-	if !dryRun {
+	if file != nil {
 		// Set permissions
-		if err := out.Chmod(os.FileMode(f.Mode)); err != nil {
+		if err := file.Chmod(os.FileMode(f.Mode)); err != nil {
+			return err
+		}
+		if err := file.Close(); err != nil {
 			return err
 		}
-		if err := os.Chtimes(destPath, time.Now(), f.ModTime); err != nil {
+		if err := os.Chtimes(file.Name(), time.Now(), f.ModTime); err != nil {
 			// ignore error
 		}
+		if err := os.Rename(file.Name(), destPath); err != nil {
+			return err
+		}
+		file = nil
 	}
 
 	return nil
 }
 
+// copyChunk writes the data of one chunk to out. A chunk that fails
+// verification is reported by the final read, after its data was written.
+func copyChunk(store *storage.ContentAddressableStore, id string, out io.Writer) error {
+	h, err := hash.Parse(id)
+	if err != nil {
+		return err
+	}
+	r, err := store.GetReader(h)
+	if err != nil {
+		return fmt.Errorf("chunk missing or corrupted %s: %w", id, err)
+	}
+	defer r.Close()
+	if _, err := io.Copy(out, r); err != nil {
+		return fmt.Errorf("chunk missing or corrupted %s: %w", id, err)
+	}
+	return nil
+}
+
 func getPriorityScore(path string, patterns []string) int {
 	// Lower score = Higher Priority (Sorted first)
 	for i, p := range patterns {
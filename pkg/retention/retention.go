@@ -0,0 +1,78 @@
+package retention
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/pranavdwivedi/aegis/pkg/config"
+	"github.com/pranavdwivedi/aegis/pkg/index"
+)
+
+// rule keeps the newest snapshot of each of the last count buckets
+type rule struct {
+	count  int
+	bucket func(t time.Time, id int64) string
+}
+
+// Apply splits snapshots into the ones kept by policy and the ones to forget.
+// Both results are ordered newest first. A policy without any rule keeps everything.
+func Apply(policy config.Retention, snapshots []index.Snapshot) (keep, forget []index.Snapshot) {
+	sorted := append([]index.Snapshot(nil), snapshots...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if !sorted[i].Time.Equal(sorted[j].Time) {
+			return sorted[i].Time.After(sorted[j].Time)
+		}
+		return sorted[i].ID > sorted[j].ID
+	})
+
+	rules := []rule{
+		// Every snapshot is its own bucket for keep-last
+		{policy.KeepLast, func(_ time.Time, id int64) string { return fmt.Sprint(id) }},
+		{policy.KeepHourly, func(t time.Time, _ int64) string { return t.Format("2006-01-02 15") }},
+		{policy.KeepDaily, func(t time.Time, _ int64) string { return t.Format("2006-01-02") }},
+		{policy.KeepWeekly, func(t time.Time, _ int64) string {
+			y, w := t.ISOWeek()
+			return fmt.Sprintf("%d-W%02d", y, w)
+		}},
+		{policy.KeepMonthly, func(t time.Time, _ int64) string { return t.Format("2006-01") }},
+		{policy.KeepYearly, func(t time.Time, _ int64) string { return t.Format("2006") }},
+	}
+
+	active := false
+	for _, r := range rules {
+		if r.count > 0 {
+			active = true
+		}
+	}
+	if !active {
+		return sorted, nil
+	}
+
+	kept := make([]bool, len(sorted))
+	for _, r := range rules {
+		remaining := r.count
+		last := "\x00" // No bucket seen yet
+		for i, s := range sorted {
+			if remaining <= 0 {
+				break
+			}
+			b := r.bucket(s.Time.Local(), s.ID)
+			if b == last {
+				continue
+			}
+			last = b
+			kept[i] = true
+			remaining--
+		}
+	}
+
+	for i, s := range sorted {
+		if kept[i] {
+			keep = append(keep, s)
+		} else {
+			forget = append(forget, s)
+		}
+	}
+	return keep, forget
+}
@@ -0,0 +1,140 @@
+package retention
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/pranavdwivedi/aegis/pkg/config"
+	"github.com/pranavdwivedi/aegis/pkg/index"
+)
+
+// at parses a local time, the zone buckets are computed in
+func at(t *testing.T, s string) time.Time {
+	t.Helper()
+	ts, err := time.ParseInLocation("2006-01-02 15:04", s, time.Local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ts
+}
+
+func ids(snapshots []index.Snapshot) []int64 {
+	out := make([]int64, 0, len(snapshots))
+	for _, s := range snapshots {
+		out = append(out, s.ID)
+	}
+	return out
+}
+
+func TestApply(t *testing.T) {
+	tests := []struct {
+		name      string
+		policy    config.Retention
+		snapshots map[int64]string // id -> time
+		keep      []int64          // newest first
+		forget    []int64
+	}{
+		{
+			name:      "no rules keeps everything",
+			snapshots: map[int64]string{1: "2024-01-01 10:00", 2: "2024-01-02 10:00"},
+			keep:      []int64{2, 1},
+		},
+		{
+			name:      "keep last",
+			policy:    config.Retention{KeepLast: 2},
+			snapshots: map[int64]string{1: "2024-01-01 10:00", 2: "2024-01-01 10:00", 3: "2024-01-01 11:00", 4: "2024-01-02 09:00"},
+			keep:      []int64{4, 3},
+			forget:    []int64{2, 1},
+		},
+		{
+			name:      "keep last breaks ties by id",
+			policy:    config.Retention{KeepLast: 1},
+			snapshots: map[int64]string{7: "2024-01-01 10:00", 9: "2024-01-01 10:00"},
+			keep:      []int64{9},
+			forget:    []int64{7},
+		},
+		{
+			name:      "hourly keeps the newest of each hour",
+			policy:    config.Retention{KeepHourly: 2},
+			snapshots: map[int64]string{1: "2024-01-01 10:10", 2: "2024-01-01 10:50", 3: "2024-01-01 11:05", 4: "2024-01-01 11:40", 5: "2024-01-01 12:00"},
+			keep:      []int64{5, 4},
+			forget:    []int64{3, 2, 1},
+		},
+		{
+			name:      "daily",
+			policy:    config.Retention{KeepDaily: 2},
+			snapshots: map[int64]string{1: "2024-01-01 08:00", 2: "2024-01-01 20:00", 3: "2024-01-02 09:00", 4: "2024-01-03 07:00", 5: "2024-01-03 22:00"},
+			keep:      []int64{5, 3},
+			forget:    []int64{4, 2, 1},
+		},
+		{
+			name:   "weekly uses ISO weeks",
+			policy: config.Retention{KeepWeekly: 2},
+			// 2024-01-01 is a Monday; the 7th ends its week
+			snapshots: map[int64]string{1: "2024-01-01 10:00", 2: "2024-01-07 10:00", 3: "2024-01-08 10:00", 4: "2024-01-15 10:00"},
+			keep:      []int64{4, 3},
+			forget:    []int64{2, 1},
+		},
+		{
+			name:   "weekly across a year boundary",
+			policy: config.Retention{KeepWeekly: 1},
+			// 2024-12-30 is in week 1 of 2025
+			snapshots: map[int64]string{1: "2024-12-30 10:00", 2: "2025-01-02 10:00"},
+			keep:      []int64{2},
+			forget:    []int64{1},
+		},
+		{
+			name:      "monthly",
+			policy:    config.Retention{KeepMonthly: 3},
+			snapshots: map[int64]string{1: "2024-01-05 10:00", 2: "2024-01-25 10:00", 3: "2024-02-10 10:00", 4: "2024-03-01 10:00", 5: "2024-03-31 10:00"},
+			keep:      []int64{5, 3, 2},
+			forget:    []int64{4, 1},
+		},
+		{
+			name:      "yearly",
+			policy:    config.Retention{KeepYearly: 2},
+			snapshots: map[int64]string{1: "2022-06-01 10:00", 2: "2023-01-01 10:00", 3: "2023-12-31 10:00", 4: "2024-03-01 10:00"},
+			keep:      []int64{4, 3},
+			forget:    []int64{2, 1},
+		},
+		{
+			name:   "overlapping rules keep the union",
+			policy: config.Retention{KeepLast: 1, KeepDaily: 2, KeepMonthly: 2},
+			snapshots: map[int64]string{
+				1: "2023-12-31 10:00",
+				2: "2024-01-10 10:00",
+				3: "2024-01-20 10:00",
+				4: "2024-02-01 10:00",
+				5: "2024-02-02 08:00",
+				6: "2024-02-02 12:00",
+			},
+			// 6 is the last, and the newest of its day and month; 4 the
+			// newest of the day before; 3 the newest of January
+			keep:   []int64{6, 4, 3},
+			forget: []int64{5, 2, 1},
+		},
+		{
+			name:      "more buckets than snapshots",
+			policy:    config.Retention{KeepDaily: 10, KeepYearly: 5},
+			snapshots: map[int64]string{1: "2024-01-01 10:00", 2: "2024-01-02 10:00", 3: "2024-01-03 10:00"},
+			keep:      []int64{3, 2, 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var snapshots []index.Snapshot
+			for id, ts := range tt.snapshots {
+				snapshots = append(snapshots, index.Snapshot{ID: id, Time: at(t, ts)})
+			}
+			keep, forget := Apply(tt.policy, snapshots)
+			if got := ids(keep); !slices.Equal(got, tt.keep) {
+				t.Errorf("kept %v, want %v", got, tt.keep)
+			}
+			if got := ids(forget); !slices.Equal(got, tt.forget) && len(got)+len(tt.forget) > 0 {
+				t.Errorf("forgot %v, want %v", got, tt.forget)
+			}
+		})
+	}
+}
@@ -1,23 +1,29 @@
 package scheduler
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"os/signal"
+	"path"
 	"sync"
 	"syscall"
 	"time"
 
+	"github.com/pranavdwivedi/aegis/pkg/chunker"
 	"github.com/pranavdwivedi/aegis/pkg/config"
 	"github.com/pranavdwivedi/aegis/pkg/crypto"
 	"github.com/pranavdwivedi/aegis/pkg/engine"
+	"github.com/pranavdwivedi/aegis/pkg/index"
+	"github.com/pranavdwivedi/aegis/pkg/retention"
 	"github.com/pranavdwivedi/aegis/pkg/storage"
 )
 
 type Scheduler struct {
-	cfg     *config.Config
-	key     crypto.MasterKey
-	repoDir string
+	cfg      *config.Config
+	key      crypto.MasterKey
+	writeKey *storage.WriteOnlyKey // set on write-only hosts, which have no key
+	repoDir  string
 }
 
 func New(cfg *config.Config, repoDir string, key crypto.MasterKey) *Scheduler {
@@ -28,6 +34,17 @@ func New(cfg *config.Config, repoDir string, key crypto.MasterKey) *Scheduler {
 	}
 }
 
+// NewWriteOnly creates a scheduler for a host that holds only a write-only
+// key. It can add snapshots but not read them, so retention is not applied;
+// forget old snapshots from a machine that has the passphrase.
+func NewWriteOnly(cfg *config.Config, repoDir string, wk *storage.WriteOnlyKey) *Scheduler {
+	return &Scheduler{
+		cfg:      cfg,
+		repoDir:  repoDir,
+		writeKey: wk,
+	}
+}
+
 func (s *Scheduler) Start() {
 	var wg sync.WaitGroup
 	quit := make(chan os.Signal, 1)
@@ -35,25 +52,16 @@ func (s *Scheduler) Start() {
 
 	fmt.Printf("Starting Aegis Daemon with %d jobs...\n", len(s.cfg.Jobs))
 
+	// Cancelled on shutdown, aborting backend I/O in flight
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
 	// Create Backend
-	var backend storage.Backend
-	var err error
-
-	if s.cfg.Storage != nil && s.cfg.Storage.Type == "s3" {
-		// Use S3
-		fmt.Printf("Using S3 Storage Backend (%s)\n", s.cfg.Storage.Bucket)
-		backend, err = storage.NewS3Backend(
-			s.cfg.Storage.Endpoint,
-			s.cfg.Storage.AccessKey, // Should use Env but Config allows override
-			s.cfg.Storage.SecretKey,
-			s.cfg.Storage.Bucket,
-			s.cfg.Storage.UseSSL,
-		)
-	} else {
-		// Default to Local
-		fmt.Println("Using Local Storage Backend")
-		backend, err = storage.NewLocalBackend(s.repoDir)
+	sc := s.cfg.Storage
+	if sc == nil {
+		sc = &config.Storage{}
 	}
+	backend, err := newBackend(ctx, *sc, s.repoDir)
 	if err != nil {
 		fmt.Printf("[%s] ERROR initializing backend: %v\n", time.Now().Format(time.TimeOnly), err)
 		return
@@ -64,15 +72,119 @@ func (s *Scheduler) Start() {
 		wg.Add(1)
 		go func(j config.Job) {
 			defer wg.Done()
-			s.runJobLoop(j, backend, quit)
+			s.runJobLoop(ctx, j, backend)
 		}(job)
 	}
 
 	<-quit
 	fmt.Println("\nShutting down scheduler...")
+	cancel()
+	wg.Wait()
+}
+
+// newBackend creates the backend described by sc. Every backend other than
+// a mirror is wrapped with retries and the limits of its config; mirrors
+// get them per replica. Cancelling ctx aborts their I/O.
+func newBackend(ctx context.Context, sc config.Storage, repoDir string) (storage.Backend, error) {
+	if sc.Type == "mirror" {
+		return newMirror(ctx, sc, repoDir)
+	}
+	b, err := openBackend(sc, repoDir)
+	if err != nil {
+		return nil, err
+	}
+	return storage.NewRetryBackend(ctx, b, storage.RetryOptions{
+		MaxRetries:    sc.MaxRetries,
+		UploadLimit:   int64(sc.UploadKBps) * 1024,
+		DownloadLimit: int64(sc.DownloadKBps) * 1024,
+		MaxConcurrent: sc.MaxConcurrent,
+	}), nil
+}
+
+// openBackend opens a single backend. Local backends default to repoDir.
+func openBackend(sc config.Storage, repoDir string) (storage.Backend, error) {
+	switch sc.Type {
+	case "s3":
+		fmt.Printf("Using S3 Storage Backend (%s)\n", path.Join(sc.Bucket, sc.Prefix))
+		return storage.NewS3Backend(storage.S3Config{
+			Endpoint:        sc.Endpoint,
+			Bucket:          sc.Bucket,
+			Region:          sc.Region,
+			UseSSL:          sc.UseSSL,
+			AccessKey:       sc.AccessKey, // Should use Env but Config allows override
+			SecretKey:       sc.SecretKey,
+			SessionToken:    sc.SessionToken,
+			CredentialsFile: sc.CredentialsFile,
+			Profile:         sc.Profile,
+			AddressingStyle: sc.AddressingStyle,
+			CAFile:          sc.CAFile,
+			Prefix:          sc.Prefix,
+			LockMode:        sc.LockMode,
+			LockDays:        sc.LockDays,
+		})
+	case "sftp":
+		fmt.Printf("Using SFTP Storage Backend (%s@%s:%s)\n", sc.User, sc.Host, sc.Path)
+		return storage.NewSFTPBackend(storage.SFTPConfig{
+			Host:          sc.Host,
+			User:          sc.User,
+			BasePath:      sc.Path,
+			KeyFile:       sc.KeyFile,
+			KeyPassphrase: os.Getenv("AEGIS_SFTP_KEY_PASSPHRASE"),
+			KnownHosts:    sc.KnownHosts,
+		})
+	case "rest":
+		fmt.Printf("Using REST Storage Backend (%s)\n", sc.URL)
+		token := sc.Token
+		if env := os.Getenv("AEGIS_REST_TOKEN"); env != "" {
+			token = env
+		}
+		return storage.NewRESTBackend(sc.URL, token)
+	default:
+		// Default to Local
+		path := sc.Path
+		if path == "" {
+			path = repoDir
+		}
+		fmt.Printf("Using Local Storage Backend (%s)\n", path)
+		b, err := storage.NewLocalBackend(path)
+		if err != nil {
+			return nil, err
+		}
+		b.VerifyExisting = sc.VerifyExisting
+		return b, nil
+	}
+}
+
+// newMirror creates a mirror of the replicas of sc
+func newMirror(ctx context.Context, sc config.Storage, repoDir string) (storage.Backend, error) {
+	fmt.Printf("Using Mirrored Storage Backend (%d replicas)\n", len(sc.Replicas))
+	replicas := make([]storage.Backend, 0, len(sc.Replicas))
+	closeAll := func() {
+		for _, r := range replicas {
+			r.Close()
+		}
+	}
+	for _, rc := range sc.Replicas {
+		if rc.Type == "mirror" {
+			closeAll()
+			return nil, fmt.Errorf("mirror replicas cannot be mirrors")
+		}
+		r, err := newBackend(ctx, rc, repoDir)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		replicas = append(replicas, r)
+	}
+	m, err := storage.NewMirrorBackend(replicas, sc.WriteQuorum)
+	if err != nil {
+		closeAll()
+		return nil, err
+	}
+	return m, nil
 }
 
-func (s *Scheduler) runJobLoop(job config.Job, backend storage.Backend, quit <-chan os.Signal) {
+func (s *Scheduler) runJobLoop(ctx context.Context, job config.Job, backend storage.Backend) {
 	interval, err := job.GetDuration()
 	if err != nil {
 		fmt.Printf("Error parsing interval for job %s: %v\n", job.Name, err)
@@ -88,14 +200,83 @@ func (s *Scheduler) runJobLoop(job config.Job, backend storage.Backend, quit <-c
 		select {
 		case <-ticker.C:
 			fmt.Printf("[%s] Starting backup: %s\n", time.Now().Format(time.TimeOnly), job.Name)
-			snapshotID, err := engine.Backup(s.repoDir, backend, s.key, job.Path)
+			snapshotID, err := s.backup(job, backend)
 			if err != nil {
 				fmt.Printf("[%s] ERROR backup %s: %v\n", time.Now().Format(time.TimeOnly), job.Name, err)
 			} else {
 				fmt.Printf("[%s] SUCCESS %s (Snapshot %d)\n", time.Now().Format(time.TimeOnly), job.Name, snapshotID)
+				if err := s.applyRetention(job, backend); err != nil {
+					fmt.Printf("[%s] ERROR retention %s: %v\n", time.Now().Format(time.TimeOnly), job.Name, err)
+				}
 			}
-		case <-quit:
+		case <-ctx.Done():
 			return
 		}
 	}
 }
+
+// backup runs one backup of job with whichever key the scheduler holds
+func (s *Scheduler) backup(job config.Job, backend storage.Backend) (int64, error) {
+	if s.writeKey != nil {
+		return engine.BackupWriteOnly(s.repoDir, backend, s.writeKey, job.Path, s.backupOptions(job))
+	}
+	return engine.Backup(s.repoDir, backend, s.key, job.Path, s.backupOptions(job))
+}
+
+// backupOptions translates the repository settings from the config
+func (s *Scheduler) backupOptions(job config.Job) engine.Options {
+	opts := engine.Options{Tag: job.Name, Host: s.cfg.Hostname}
+	if c := s.cfg.Chunker; c != nil {
+		opts.Chunker = chunker.Params{
+			Algorithm: c.Algorithm,
+			MinSize:   c.MinSize,
+			AvgSize:   c.AvgSize,
+			MaxSize:   c.MaxSize,
+		}
+	}
+	if p := s.cfg.Parity; p != nil {
+		opts.Parity = storage.DefaultParityParams
+		if p.DataShards > 0 {
+			opts.Parity.DataShards = p.DataShards
+		}
+		if p.ParityShards > 0 {
+			opts.Parity.ParityShards = p.ParityShards
+		}
+	}
+	return opts
+}
+
+// applyRetention forgets the snapshots of job that its policy no longer keeps.
+// Only snapshots this host took under the job name are considered; other
+// hosts sharing the backend apply their own policies to theirs.
+func (s *Scheduler) applyRetention(job config.Job, backend storage.Backend) error {
+	if job.Retention == nil || s.writeKey != nil {
+		return nil
+	}
+
+	host := s.cfg.Hostname
+	if host == "" {
+		var err error
+		if host, err = os.Hostname(); err != nil {
+			return err
+		}
+	}
+	idx, err := index.NewIndex(s.repoDir, s.key)
+	if err != nil {
+		return err
+	}
+	snapshots, err := idx.ListSnapshotsByTag(host, job.Name)
+	idx.Close()
+	if err != nil {
+		return err
+	}
+
+	_, forget := retention.Apply(*job.Retention, snapshots)
+	for _, snap := range forget {
+		if err := engine.Forget(s.repoDir, backend, s.key, snap.ID); err != nil {
+			return err
+		}
+		fmt.Printf("[%s] Forgot snapshot %d of %s (retention)\n", time.Now().Format(time.TimeOnly), snap.ID, job.Name)
+	}
+	return nil
+}
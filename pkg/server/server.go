@@ -0,0 +1,352 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pranavdwivedi/aegis/pkg/config"
+	"github.com/pranavdwivedi/aegis/pkg/storage"
+)
+
+// MaxObjectSize bounds the body of a PUT. Packs are the largest objects
+// (storage.DefaultPackSize), so this leaves plenty of headroom.
+const MaxObjectSize = 256 * 1024 * 1024
+
+// Client is a token that may use the server
+type Client struct {
+	Name  string
+	Token string
+	// AppendOnly restricts this client to adding objects
+	AppendOnly bool
+}
+
+// Options configures a Server
+type Options struct {
+	Clients []Client
+	// AppendOnly refuses deletes and overwrites for every client, so a
+	// compromised client cannot destroy existing backups
+	AppendOnly bool
+}
+
+// Server exposes a storage.Backend over HTTP (see docs/REST.md). Every
+// request must carry the token of one of its clients.
+type Server struct {
+	backend    storage.Backend
+	clients    []client
+	appendOnly bool
+	mux        *http.ServeMux
+}
+
+type client struct {
+	name       string
+	digest     [sha256.Size]byte
+	appendOnly bool
+}
+
+// New serves backend to the given clients
+func New(backend storage.Backend, opts Options) (*Server, error) {
+	if len(opts.Clients) == 0 {
+		return nil, fmt.Errorf("server needs at least one client token")
+	}
+	s := &Server{backend: backend, appendOnly: opts.AppendOnly, mux: http.NewServeMux()}
+	for _, c := range opts.Clients {
+		if len(c.Token) < 16 {
+			return nil, fmt.Errorf("token of client %q is too short (at least 16 characters)", c.Name)
+		}
+		s.clients = append(s.clients, client{
+			name:       c.Name,
+			digest:     sha256.Sum256([]byte(c.Token)),
+			appendOnly: c.AppendOnly,
+		})
+	}
+
+	s.mux.HandleFunc("GET /v1/objects", s.auth(s.list))
+	s.mux.HandleFunc("GET /v1/objects/{key...}", s.auth(s.get))
+	s.mux.HandleFunc("HEAD /v1/objects/{key...}", s.auth(s.has))
+	s.mux.HandleFunc("PUT /v1/objects/{key...}", s.auth(s.put))
+	s.mux.HandleFunc("DELETE /v1/objects/{key...}", s.auth(s.delete))
+	return s, nil
+}
+
+// Run serves the local repository described by cfg until the listener fails
+func Run(cfg config.Server) error {
+	backend, err := storage.NewLocalBackend(cfg.Path)
+	if err != nil {
+		return err
+	}
+	defer backend.Close()
+
+	opts := Options{AppendOnly: cfg.AppendOnly}
+	for _, c := range cfg.Clients {
+		opts.Clients = append(opts.Clients, Client{Name: c.Name, Token: c.Token, AppendOnly: c.AppendOnly})
+	}
+	s, err := New(backend, opts)
+	if err != nil {
+		return err
+	}
+
+	hs := &http.Server{
+		Addr:              cfg.Listen,
+		Handler:           s,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	fmt.Printf("Serving %s on %s (%d clients, append-only: %v)\n", cfg.Path, cfg.Listen, len(opts.Clients), cfg.AppendOnly)
+	if cfg.TLSCert != "" {
+		return hs.ListenAndServeTLS(cfg.TLSCert, cfg.TLSKey)
+	}
+	return hs.ListenAndServe()
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// request is an authenticated request
+type request struct {
+	*http.Request
+	client client
+}
+
+// appendOnly reports whether the request may only add objects
+func (r request) appendOnly(s *Server) bool {
+	return s.appendOnly || r.client.appendOnly
+}
+
+// auth checks the bearer token and the key of a request
+func (s *Server) auth(h func(http.ResponseWriter, request)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		c, found := s.client(token)
+		if !ok || !found {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="aegis"`)
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+			return
+		}
+		if r.Pattern != "GET /v1/objects" {
+			if err := storage.ValidateKey(r.PathValue("key")); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		h(w, request{Request: r, client: c})
+	}
+}
+
+// client finds the client holding token, comparing in constant time
+func (s *Server) client(token string) (client, bool) {
+	digest := sha256.Sum256([]byte(token))
+	var match client
+	found := 0
+	for _, c := range s.clients {
+		if subtle.ConstantTimeCompare(digest[:], c.digest[:]) == 1 {
+			match = c
+			found = 1
+		}
+	}
+	return match, found == 1
+}
+
+// fail reports a backend error, as 404 if the object does not exist
+func (s *Server) fail(w http.ResponseWriter, key string, err error) {
+	if exists, herr := s.backend.Has(key); herr == nil && !exists {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	fmt.Printf("REST: %s: %v\n", key, err)
+	http.Error(w, "storage error", http.StatusInternalServerError)
+}
+
+// refuse rejects a write that append-only mode does not allow
+func refuse(w http.ResponseWriter, r request, what string) {
+	fmt.Printf("REST: refused %s of %s by %s (append-only)\n", what, r.PathValue("key"), r.client.name)
+	http.Error(w, what+" refused: append-only", http.StatusForbidden)
+}
+
+func (s *Server) get(w http.ResponseWriter, r request) {
+	key := r.PathValue("key")
+	if rng := r.Header.Get("Range"); rng != "" {
+		s.getRange(w, key, rng)
+		return
+	}
+	obj, err := storage.StreamGet(s.backend, key)
+	if err != nil {
+		s.fail(w, key, err)
+		return
+	}
+	defer obj.Close()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if _, err := io.Copy(w, obj); err != nil {
+		fmt.Printf("REST: %s: %v\n", key, err)
+	}
+}
+
+// getRange serves a single "bytes=first-last" range
+func (s *Server) getRange(w http.ResponseWriter, key, rng string) {
+	spec, ok := strings.CutPrefix(rng, "bytes=")
+	first, last, ok2 := strings.Cut(spec, "-")
+	offset, err1 := strconv.ParseInt(first, 10, 64)
+	end, err2 := strconv.ParseInt(last, 10, 64)
+	if !ok || !ok2 || err1 != nil || err2 != nil || offset < 0 || end < offset {
+		http.Error(w, "only single byte ranges are supported", http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	length := end - offset + 1
+
+	var data []byte
+	var err error
+	if rr, ok := s.backend.(storage.RangeReader); ok {
+		data, err = rr.GetRange(key, offset, length)
+	} else if data, err = s.backend.Get(key); err == nil {
+		if end >= int64(len(data)) {
+			err = io.ErrUnexpectedEOF
+		} else {
+			data = data[offset : end+1]
+		}
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		http.Error(w, "range beyond end of object", http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	if err != nil {
+		s.fail(w, key, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/*", offset, end))
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(http.StatusPartialContent)
+	w.Write(data)
+}
+
+func (s *Server) has(w http.ResponseWriter, r request) {
+	exists, err := s.backend.Has(r.PathValue("key"))
+	if err != nil {
+		fmt.Printf("REST: %s: %v\n", r.PathValue("key"), err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) put(w http.ResponseWriter, r request) {
+	key := r.PathValue("key")
+	body := http.MaxBytesReader(w, r.Body, MaxObjectSize)
+
+	if r.appendOnly(s) {
+		exists, err := s.backend.Has(key)
+		if err != nil {
+			fmt.Printf("REST: %s: %v\n", key, err)
+			http.Error(w, "storage error", http.StatusInternalServerError)
+			return
+		}
+		if exists {
+			// Storing the same object again is harmless (and common: the
+			// store re-puts objects); replacing it is not
+			same, err := s.sameObject(key, body)
+			if err != nil {
+				fmt.Printf("REST: %s: %v\n", key, err)
+				http.Error(w, "storage error", http.StatusInternalServerError)
+				return
+			}
+			if !same {
+				refuse(w, r, "overwrite")
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+
+	if err := storage.StreamPut(s.backend, key, body, r.ContentLength); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "object too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		fmt.Printf("REST: %s: %v\n", key, err)
+		http.Error(w, "storage error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// sameObject compares the stored object with body, a block at a time
+func (s *Server) sameObject(key string, body io.Reader) (bool, error) {
+	stored, err := storage.StreamGet(s.backend, key)
+	if err != nil {
+		return false, err
+	}
+	defer stored.Close()
+
+	a := make([]byte, 32*1024)
+	b := make([]byte, len(a))
+	for {
+		na, erra := io.ReadFull(stored, a)
+		nb, errb := io.ReadFull(body, b)
+		if erra != nil && erra != io.EOF && erra != io.ErrUnexpectedEOF {
+			return false, erra
+		}
+		if errb != nil && errb != io.EOF && errb != io.ErrUnexpectedEOF {
+			return false, errb
+		}
+		if na != nb || !bytes.Equal(a[:na], b[:nb]) {
+			return false, nil
+		}
+		if erra != nil || errb != nil {
+			return erra != nil && errb != nil, nil
+		}
+	}
+}
+
+func (s *Server) delete(w http.ResponseWriter, r request) {
+	key := r.PathValue("key")
+	// Locks are not data: backups must remove their own
+	if r.appendOnly(s) && !strings.HasPrefix(key, storage.LockNamespace) {
+		// Deleting what is not there changes nothing, so it stays allowed
+		exists, err := s.backend.Has(key)
+		if err != nil {
+			s.fail(w, key, err)
+			return
+		}
+		if exists {
+			refuse(w, r, "delete")
+			return
+		}
+	}
+	if err := s.backend.Delete(key); err != nil {
+		fmt.Printf("REST: %s: %v\n", key, err)
+		http.Error(w, "storage error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// list streams the objects under ?prefix= as newline-delimited JSON,
+// ending with a {"done":true} or {"error":...} line so clients can tell a
+// complete listing from a cut connection
+func (s *Server) list(w http.ResponseWriter, r request) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	err := s.backend.List(r.URL.Query().Get("prefix"), func(obj storage.ObjectInfo) error {
+		return enc.Encode(storage.RESTListEntry{Key: obj.Key, Size: obj.Size})
+	})
+	if err != nil {
+		fmt.Printf("REST: list: %v\n", err)
+		enc.Encode(storage.RESTListEntry{Error: "storage error"})
+		return
+	}
+	enc.Encode(storage.RESTListEntry{Done: true})
+}
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pranavdwivedi/aegis/pkg/storage"
+)
+
+const (
+	adminToken  = "admin-token-0123456789"
+	backupToken = "backup-token-0123456789"
+)
+
+// newTestServer serves a local repository over HTTP and returns it with a
+// client for each token
+func newTestServer(t *testing.T, opts Options) (storage.Backend, map[string]*storage.RESTBackend) {
+	t.Helper()
+	local, err := storage.NewLocalBackend(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := New(local, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(s)
+	t.Cleanup(ts.Close)
+
+	clients := map[string]*storage.RESTBackend{}
+	for _, c := range opts.Clients {
+		rb, err := storage.NewRESTBackend(ts.URL, c.Token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { rb.Close() })
+		clients[c.Name] = rb
+	}
+	return local, clients
+}
+
+func TestAppendOnlyClient(t *testing.T) {
+	local, clients := newTestServer(t, Options{Clients: []Client{
+		{Name: "admin", Token: adminToken},
+		{Name: "backup", Token: backupToken, AppendOnly: true},
+	}})
+	admin, backup := clients["admin"], clients["backup"]
+
+	if err := backup.Put("snapshots/1", []byte("first")); err != nil {
+		t.Fatalf("append-only put of a new object: %v", err)
+	}
+	// Storing the same object again is allowed, replacing it is not
+	if err := backup.Put("snapshots/1", []byte("first")); err != nil {
+		t.Errorf("append-only put of the same object: %v", err)
+	}
+	if err := backup.Put("snapshots/1", []byte("other")); !errors.Is(err, storage.ErrAppendOnly) {
+		t.Errorf("append-only overwrite returned %v", err)
+	}
+	if err := backup.Delete("snapshots/1"); !errors.Is(err, storage.ErrAppendOnly) {
+		t.Errorf("append-only delete returned %v", err)
+	}
+	if got, err := local.Get("snapshots/1"); err != nil || string(got) != "first" {
+		t.Errorf("stored object is %q, %v after refused writes", got, err)
+	}
+
+	// Deleting a missing object changes nothing
+	if err := backup.Delete("snapshots/2"); err != nil {
+		t.Errorf("append-only delete of a missing object: %v", err)
+	}
+	// Backups remove their own locks
+	lock := storage.LockNamespace + "0011"
+	if err := backup.Put(lock, []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := backup.Delete(lock); err != nil {
+		t.Errorf("append-only delete of a lock: %v", err)
+	}
+	if exists, _ := local.Has(lock); exists {
+		t.Error("lock was not deleted")
+	}
+
+	// Other clients keep full access
+	if err := admin.Put("snapshots/1", []byte("other")); err != nil {
+		t.Errorf("overwrite by a full client: %v", err)
+	}
+	if err := admin.Delete("snapshots/1"); err != nil {
+		t.Errorf("delete by a full client: %v", err)
+	}
+	if exists, _ := local.Has("snapshots/1"); exists {
+		t.Error("delete by a full client left the object")
+	}
+}
+
+func TestAppendOnlyServer(t *testing.T) {
+	_, clients := newTestServer(t, Options{
+		Clients:    []Client{{Name: "admin", Token: adminToken}},
+		AppendOnly: true,
+	})
+	admin := clients["admin"]
+
+	if err := admin.Put("aa11", []byte("chunk")); err != nil {
+		t.Fatal(err)
+	}
+	if err := admin.Put("aa11", []byte("changed")); !errors.Is(err, storage.ErrAppendOnly) {
+		t.Errorf("overwrite on an append-only server returned %v", err)
+	}
+	if err := admin.Delete("aa11"); !errors.Is(err, storage.ErrAppendOnly) {
+		t.Errorf("delete on an append-only server returned %v", err)
+	}
+}
+
+func TestAuth(t *testing.T) {
+	local, err := storage.NewLocalBackend(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(local, Options{}); err == nil {
+		t.Error("server without clients accepted")
+	}
+	if _, err := New(local, Options{Clients: []Client{{Name: "short", Token: "secret"}}}); err == nil {
+		t.Error("short token accepted")
+	}
+	s, err := New(local, Options{Clients: []Client{{Name: "admin", Token: adminToken}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	if _, err := storage.NewRESTBackend(ts.URL, backupToken); err == nil {
+		t.Error("unknown token accepted")
+	}
+	req, err := http.NewRequest(http.MethodDelete, ts.URL+"/v1/objects/aa11", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("request without a token returned %s", resp.Status)
+	}
+}
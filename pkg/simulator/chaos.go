@@ -3,9 +3,8 @@ package simulator
 import (
 	"crypto/rand"
 	"fmt"
-	"os"
-	"path/filepath"
-	"strings"
+
+	"github.com/pranavdwivedi/aegis/pkg/storage"
 )
 
 type DamageReport struct {
@@ -14,61 +13,57 @@ type DamageReport struct {
 	Files     []string
 }
 
-// CorruptChunks overwrites random bytes in random files within the objects directory
-func CorruptChunks(repoDir string, rate float64) (*DamageReport, error) {
+// CorruptChunks overwrites random bytes in random objects of the backend
+func CorruptChunks(backend storage.Backend, rate float64) (*DamageReport, error) {
 	report := &DamageReport{}
-	objectsDir := filepath.Join(repoDir, "objects")
 
-	err := filepath.Walk(objectsDir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if info.IsDir() {
-			return nil
-		}
-		// Skip hidden system files if any, but objects are usually hex
-		if strings.HasPrefix(info.Name(), ".") {
-			return nil
-		}
+	// Pick victims first so we never mutate the backend while listing it
+	victims, err := pickObjects(backend, rate)
+	if err != nil {
+		return report, err
+	}
 
-		// Roll dice
-		if shouldAct(rate) {
-			if err := corruptFile(path); err != nil {
-				return err
-			}
-			report.Corrupted++
-			report.Files = append(report.Files, fmt.Sprintf("CORRUPTED: %s", filepath.Base(path)))
+	for _, key := range victims {
+		if err := corruptObject(backend, key); err != nil {
+			return report, err
 		}
-		return nil
-	})
+		report.Corrupted++
+		report.Files = append(report.Files, fmt.Sprintf("CORRUPTED: %s", key))
+	}
 
-	return report, err
+	return report, nil
 }
 
-// DeleteChunks deletes random files within the objects directory
-func DeleteChunks(repoDir string, rate float64) (*DamageReport, error) {
+// DeleteChunks deletes random objects from the backend
+func DeleteChunks(backend storage.Backend, rate float64) (*DamageReport, error) {
 	report := &DamageReport{}
-	objectsDir := filepath.Join(repoDir, "objects")
 
-	err := filepath.Walk(objectsDir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if info.IsDir() {
-			return nil
+	victims, err := pickObjects(backend, rate)
+	if err != nil {
+		return report, err
+	}
+
+	for _, key := range victims {
+		if err := backend.Delete(key); err != nil {
+			return report, err
 		}
+		report.Deleted++
+		report.Files = append(report.Files, fmt.Sprintf("DELETED: %s", key))
+	}
+
+	return report, nil
+}
 
+func pickObjects(backend storage.Backend, rate float64) ([]string, error) {
+	var keys []string
+	err := backend.List("", func(obj storage.ObjectInfo) error {
+		// Roll dice
 		if shouldAct(rate) {
-			if err := os.Remove(path); err != nil {
-				return err
-			}
-			report.Deleted++
-			report.Files = append(report.Files, fmt.Sprintf("DELETED: %s", filepath.Base(path)))
+			keys = append(keys, obj.Key)
 		}
 		return nil
 	})
-
-	return report, err
+	return keys, err
 }
 
 func shouldAct(rate float64) bool {
@@ -81,18 +76,23 @@ func shouldAct(rate float64) bool {
 	return val < rate
 }
 
-func corruptFile(path string) error {
-	f, err := os.OpenFile(path, os.O_RDWR, 0600)
+func corruptObject(backend storage.Backend, key string) error {
+	data, err := backend.Get(key)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
 
-	// Corrupt first 100 bytes or random
-	b := make([]byte, 50)
-	rand.Read(b)
+	// Corrupt first 50 bytes or random
+	n := 50
+	if len(data) < n {
+		n = len(data)
+	}
+	rand.Read(data[:n])
 
-	// Seek to random position? Or just start. Start is fine, header corruption is worst case.
-	_, err = f.WriteAt(b, 0)
-	return err
+	// Start is fine, header corruption is worst case.
+	// LocalBackend skips Puts of existing keys, so replace the object explicitly.
+	if err := backend.Delete(key); err != nil {
+		return err
+	}
+	return backend.Put(key, data)
 }
@@ -1,6 +1,13 @@
 package storage
 
-import "io"
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
 
 // Backend defines the interface for physical storage systems (Local, S3, etc.)
 type Backend interface {
@@ -13,11 +20,180 @@ type Backend interface {
 	// Has checks if the key exists
 	Has(key string) (bool, error)
 
+	// List calls fn for every stored object whose key starts with prefix.
+	// Iteration stops at the first error returned by fn.
+	List(prefix string, fn func(ObjectInfo) error) error
+
+	// Delete removes the object. Deleting a missing key is not an error.
+	Delete(key string) error
+
 	// Close releases any resources
 	Close() error
 }
 
+// ObjectInfo describes a stored object
+type ObjectInfo struct {
+	Key  string
+	Size int64
+}
+
 // Reader is an optional interface for backends that support streaming read
 type Reader interface {
 	GetReader(key string) (io.ReadCloser, error)
 }
+
+// Writer is an optional interface for backends that can store an object
+// from a stream without holding it in memory. size is the length of r, or
+// -1 if it is not known in advance.
+type Writer interface {
+	PutReader(key string, r io.Reader, size int64) error
+}
+
+// Replacer is an optional interface for backends that can replace the
+// stored copy of an object (e.g. one found damaged) without a moment where
+// no copy is stored
+type Replacer interface {
+	Replace(key string, data []byte) error
+}
+
+// ContextBinder is an optional interface for backends whose requests can
+// be cancelled, e.g. so a shutdown aborts uploads in flight
+type ContextBinder interface {
+	// WithContext returns a view of the backend whose requests are
+	// cancelled with ctx
+	WithContext(ctx context.Context) Backend
+}
+
+// StreamGet opens an object for reading, streaming it if the backend
+// supports it. The reader must be closed.
+func StreamGet(b Backend, key string) (io.ReadCloser, error) {
+	if r, ok := b.(Reader); ok {
+		return r.GetReader(key)
+	}
+	data, err := b.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+// StreamPut stores an object read from r, streaming it if the backend
+// supports it. size is the length of r, or -1 if unknown.
+func StreamPut(b Backend, key string, r io.Reader, size int64) error {
+	if w, ok := b.(Writer); ok {
+		return w.PutReader(key, r, size)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return b.Put(key, data)
+}
+
+// RangeReader is an optional interface for backends that can read part of an object
+type RangeReader interface {
+	GetRange(key string, offset, length int64) ([]byte, error)
+}
+
+// Retainer is an optional interface for backends that can lock objects
+// against deletion until a date, e.g. S3 Object Lock
+type Retainer interface {
+	// RetainedUntil returns the date until which key cannot be deleted,
+	// or the zero time if it is not locked
+	RetainedUntil(key string) (time.Time, error)
+}
+
+// RetainedUntil returns the retention date of key, or the zero time if
+// it is not locked or the backend does not lock objects
+func RetainedUntil(b Backend, key string) (time.Time, error) {
+	if r, ok := b.(Retainer); ok {
+		return r.RetainedUntil(key)
+	}
+	return time.Time{}, nil
+}
+
+// RetentionExtender is an optional interface for Retainers that can push
+// the retention of a stored object forward, so that objects a new snapshot
+// reuses stay locked as long as the ones it writes
+type RetentionExtender interface {
+	ExtendRetention(key string) error
+}
+
+// ExtendRetention extends the retention of key, if the backend locks
+// objects
+func ExtendRetention(b Backend, key string) error {
+	if r, ok := b.(RetentionExtender); ok {
+		return r.ExtendRetention(key)
+	}
+	return nil
+}
+
+// objectName maps a key to its slash-separated location inside a backend.
+// Plain keys (chunk hashes) live under objects/ab/cdef...; namespaced keys
+// such as "packs/<id>" live under objects/packs/ab/cdef...
+// Namespaces must be longer than two characters so they never collide
+// with the hash fan-out directories.
+func objectName(key string) string {
+	dir, name := "objects", key
+	if i := strings.Index(key, "/"); i >= 0 {
+		dir, name = "objects/"+key[:i], key[i+1:]
+	}
+	if len(name) < 2 {
+		return dir + "/" + name
+	}
+	return dir + "/" + name[:2] + "/" + name[2:]
+}
+
+// isNamespaced reports whether key lives outside the plain chunk namespace
+func isNamespaced(key string) bool {
+	return strings.Contains(key, "/")
+}
+
+// keyFromObjectName is the inverse of objectName.
+// It returns false for names that are not part of the object layout.
+func keyFromObjectName(name string) (string, bool) {
+	rest, ok := strings.CutPrefix(name, "objects/")
+	if !ok {
+		return "", false
+	}
+	parts := strings.Split(rest, "/")
+	switch len(parts) {
+	case 1:
+		return parts[0], len(parts[0]) < 2
+	case 2:
+		if len(parts[0]) == 2 {
+			return parts[0] + parts[1], true
+		}
+		return parts[0] + "/" + parts[1], len(parts[1]) < 2
+	case 3:
+		return parts[0] + "/" + parts[1] + parts[2], true
+	default:
+		return "", false
+	}
+}
+
+// listRoot is the object name prefix that contains every key starting with prefix
+func listRoot(prefix string) string {
+	if i := strings.Index(prefix, "/"); i >= 0 {
+		return "objects/" + prefix[:i+1]
+	}
+	return "objects/"
+}
+
+// ValidateKey rejects keys that objectName cannot map safely, e.g. keys
+// received over the network that could escape the objects/ directory
+func ValidateKey(key string) error {
+	parts := strings.Split(key, "/")
+	if len(parts) > 2 {
+		return fmt.Errorf("invalid key %q: only one namespace level is allowed", key)
+	}
+	if len(parts) == 2 && len(parts[0]) <= 2 {
+		return fmt.Errorf("invalid key %q: namespace must be longer than two characters", key)
+	}
+	for _, p := range parts {
+		if p == "" || strings.HasPrefix(p, ".") || strings.ContainsAny(p, "\\\x00") {
+			return fmt.Errorf("invalid key %q", key)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/pranavdwivedi/aegis/pkg/chunker"
+	"github.com/pranavdwivedi/aegis/pkg/crypto"
+	"github.com/pranavdwivedi/aegis/pkg/hash"
+)
+
+// ConfigNamespace holds repository-wide objects sealed with the master key
+const ConfigNamespace = "config/"
+
+// ConfigKey is where the repository config is stored, sealed with the master key
+const ConfigKey = ConfigNamespace + "repository"
+
+// chunkIDContext is the BLAKE3 derive-key context for the chunk id secret
+const chunkIDContext = "aegis 2026-01 chunk id key"
+
+// FormatVersion is the repository format written by this version of aegis.
+// Repositories without a config predate format versioning (version 0).
+//
+//	1: objects in versioned envelopes, keyed chunk ids
+const FormatVersion = 1
+
+// ErrUnsupportedFormat is returned for repositories written by a newer version
+var ErrUnsupportedFormat = errors.New("unsupported repository format")
+
+// ErrChunkerMismatch is returned when a backup would chunk differently from
+// what the repository records
+var ErrChunkerMismatch = errors.New("chunker params differ from the repository")
+
+// RepoConfig holds repository-wide settings
+type RepoConfig struct {
+	// Version is the repository format version (see FormatVersion)
+	Version int `json:"version"`
+
+	// ChunkIDKey keys the BLAKE3 hash that names chunks, so object names do
+	// not reveal the plaintext hash. Empty for legacy repositories, whose
+	// chunks are named by the plain BLAKE3 hash.
+	ChunkIDKey []byte `json:"chunk_id_key,omitempty"`
+
+	// Chunker records how files are split, so every host chunks alike and
+	// deduplicates. Nil for repositories created before it was recorded;
+	// the first backup records it then.
+	Chunker *chunker.Params `json:"chunker,omitempty"`
+
+	// IndexEpoch is raised whenever stored snapshot metadata is rewritten in
+	// a way that invalidates local indexes (e.g. a chunk id migration). A
+	// host whose index was built at an older epoch rebuilds it.
+	IndexEpoch int `json:"index_epoch,omitempty"`
+}
+
+// loadConfig reads the repository config; a missing config is a legacy repository
+func (s *ContentAddressableStore) loadConfig() (RepoConfig, error) {
+	var cfg RepoConfig
+
+	exists, err := s.HasMetadata(ConfigKey)
+	if err != nil {
+		return cfg, err
+	}
+	if !exists {
+		return cfg, nil
+	}
+
+	data, err := s.GetLatestMetadata(ConfigKey)
+	if err != nil {
+		return cfg, err
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("corrupt repository config: %w", err)
+	}
+	if err := cfg.CheckFormat(); err != nil {
+		return cfg, err
+	}
+	if err := cfg.validate(); err != nil {
+		return cfg, fmt.Errorf("corrupt repository config: %w", err)
+	}
+	return cfg, nil
+}
+
+func (c RepoConfig) validate() error {
+	if n := len(c.ChunkIDKey); n != 0 && n != 32 {
+		return fmt.Errorf("chunk id key must be 32 bytes, got %d", n)
+	}
+	return nil
+}
+
+// CheckFormat reports whether this version of aegis can use a repository
+// with this config
+func (c RepoConfig) CheckFormat() error {
+	if c.Version > FormatVersion {
+		return fmt.Errorf("%w: version %d, this build supports up to %d (upgrade aegis)", ErrUnsupportedFormat, c.Version, FormatVersion)
+	}
+	return nil
+}
+
+// CheckChunker reports whether p chunks the way the repository records.
+// Anything goes while nothing is recorded.
+func (c RepoConfig) CheckChunker(p chunker.Params) error {
+	p, err := p.Normalize()
+	if err != nil {
+		return err
+	}
+	if c.Chunker != nil && *c.Chunker != p {
+		return fmt.Errorf("%w: repository uses %s, got %s", ErrChunkerMismatch, c.Chunker, p)
+	}
+	return nil
+}
+
+// LoadConfig reads the repository config from the backend and checks that
+// this version of aegis supports its format
+func LoadConfig(backend Backend, key crypto.MasterKey) (RepoConfig, error) {
+	s, err := NewContentAddressableStore(backend, key)
+	if err != nil {
+		return RepoConfig{}, err
+	}
+	return s.config, nil
+}
+
+// saveConfig replaces the repository config. The old config stays until
+// the new one is stored, so the chunk id key is never lost.
+func (s *ContentAddressableStore) saveConfig(cfg RepoConfig) error {
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	return s.ReplaceMetadata(ConfigKey, data)
+}
+
+// Config returns the repository config the store operates with
+func (s *ContentAddressableStore) Config() RepoConfig {
+	return s.config
+}
+
+// EnableKeyedIDs switches the repository to keyed chunk ids. The id secret
+// is derived from the master key once and then stored in the config, so it
+// survives master key rotation. Existing chunks keep their plain ids until
+// they are migrated.
+func (s *ContentAddressableStore) EnableKeyedIDs() error {
+	if len(s.config.ChunkIDKey) > 0 {
+		return nil
+	}
+
+	cfg := s.config
+	cfg.Version = max(cfg.Version, FormatVersion)
+	cfg.ChunkIDKey = hash.DeriveKey(chunkIDContext, s.key.Bytes())
+	if err := s.saveConfig(cfg); err != nil {
+		return fmt.Errorf("failed to store repository config: %w", err)
+	}
+	s.config = cfg
+	return nil
+}
+
+// BumpIndexEpoch raises the index epoch of the repository, so every other
+// host rebuilds its local index, and returns the new epoch
+func (s *ContentAddressableStore) BumpIndexEpoch() (int, error) {
+	cfg := s.config
+	cfg.IndexEpoch++
+	if err := s.saveConfig(cfg); err != nil {
+		return 0, fmt.Errorf("failed to store repository config: %w", err)
+	}
+	s.config = cfg
+	return cfg.IndexEpoch, nil
+}
+
+// UseChunker checks p against the chunker params recorded in the
+// repository, recording p if there are none yet
+func (s *ContentAddressableStore) UseChunker(p chunker.Params) error {
+	if err := s.config.CheckChunker(p); err != nil || s.config.Chunker != nil {
+		return err
+	}
+
+	p, _ = p.Normalize()
+	cfg := s.config
+	cfg.Chunker = &p
+	if err := s.saveConfig(cfg); err != nil {
+		return fmt.Errorf("failed to store repository config: %w", err)
+	}
+	s.config = cfg
+	return nil
+}
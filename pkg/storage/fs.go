@@ -1,44 +1,209 @@
 package storage
 
 import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 )
 
-// LocalBackend implements Backend for local filesystem
+// QuarantineDir is the directory, next to objects/, that leftover temporary
+// files and damaged objects are moved to
+const QuarantineDir = "quarantine"
+
+// staleTempAge is how old a temporary file must be before the startup scan
+// quarantines it, so writes of another running process are left alone
+const staleTempAge = time.Hour
+
+// LocalBackend implements Backend for local filesystem.
+// Objects are written to a temporary file, synced and renamed into place,
+// so a crash never leaves a truncated object behind.
 type LocalBackend struct {
 	BasePath string
+	// VerifyExisting makes Put check an object that already exists (size,
+	// and hash or envelope) and replace it if it is damaged, instead of
+	// trusting any existing file. Only content-addressed objects (chunks,
+	// packs and key files) are checked; any other existing object is kept.
+	VerifyExisting bool
 }
 
+// NewLocalBackend opens the repository at basePath and quarantines
+// temporary files left behind by interrupted writes
 func NewLocalBackend(basePath string) (*LocalBackend, error) {
 	// Ensure objects dir exists
 	if err := os.MkdirAll(filepath.Join(basePath, "objects"), 0700); err != nil {
 		return nil, err
 	}
-	return &LocalBackend{BasePath: basePath}, nil
+	l := &LocalBackend{BasePath: basePath}
+	if _, err := l.QuarantineTempFiles(); err != nil {
+		return nil, fmt.Errorf("failed to scan for leftover temporary files: %w", err)
+	}
+	return l, nil
 }
 
-func (l *LocalBackend) objectPath(key string) string {
-	if len(key) < 2 {
-		return filepath.Join(l.BasePath, "objects", key)
+// isTempName reports whether name is a temporary file of an object write
+func isTempName(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.Contains(name, ".tmp-")
+}
+
+// QuarantineTempFiles moves temporary files older than an hour out of
+// objects/ into quarantine/ and returns their paths relative to BasePath
+func (l *LocalBackend) QuarantineTempFiles() ([]string, error) {
+	var moved []string
+	root := filepath.Join(l.BasePath, "objects")
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !isTempName(d.Name()) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil // Finished or removed meanwhile
+		}
+		if time.Since(info.ModTime()) < staleTempAge {
+			return nil // May still be in progress
+		}
+
+		rel, err := l.quarantine(path)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("QUARANTINED: leftover temporary file %s\n", rel)
+		moved = append(moved, rel)
+		return nil
+	})
+	return moved, err
+}
+
+// quarantine moves a file under objects/ to the same relative path under
+// quarantine/ and returns that path relative to BasePath
+func (l *LocalBackend) quarantine(path string) (string, error) {
+	rel, err := filepath.Rel(l.BasePath, path)
+	if err != nil {
+		return "", err
+	}
+	dest := filepath.Join(l.BasePath, QuarantineDir, rel)
+	if err := os.MkdirAll(filepath.Dir(dest), 0700); err != nil {
+		return "", err
 	}
-	return filepath.Join(l.BasePath, "objects", key[:2], key[2:])
+	if err := os.Rename(path, dest); err != nil {
+		return "", err
+	}
+	return filepath.Join(QuarantineDir, rel), nil
+}
+
+func (l *LocalBackend) objectPath(key string) string {
+	return filepath.Join(l.BasePath, filepath.FromSlash(objectName(key)))
 }
 
 func (l *LocalBackend) Put(key string, data []byte) error {
+	return l.PutReader(key, bytes.NewReader(data), int64(len(data)))
+}
+
+// PutReader streams r into a temporary file, syncs it and renames it into
+// place, then syncs the directory so the rename survives a crash
+func (l *LocalBackend) PutReader(key string, r io.Reader, size int64) error {
 	path := l.objectPath(key)
 
 	// Check exist
 	if _, err := os.Stat(path); err == nil {
-		return nil // Already exists
+		// Only the content of content-addressed objects is implied by
+		// their key; other objects are never overwritten
+		if !l.VerifyExisting || !repairable(key) || l.intact(key, path, size) {
+			return nil // Already exists
+		}
+		rel, err := l.quarantine(path)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("QUARANTINED: damaged copy of %s moved to %s\n", key, rel)
 	}
 
 	// Create dir (e.g. objects/ab/)
-	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+	dir := filepath.Dir(path)
+	if err := mkdirSynced(dir); err != nil {
+		return err
+	}
+
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, "."+filepath.Base(path)+".tmp-"+hex.EncodeToString(suffix))
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(f, r)
+	if err == nil && size >= 0 && n != size {
+		err = fmt.Errorf("short write of %s: %d of %d bytes", key, n, size)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return syncDir(dir)
+}
+
+// intact reports whether the stored copy of key has the expected size (if
+// known) and passes verifyObject
+func (l *LocalBackend) intact(key, path string, size int64) bool {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false
+	}
+	if size >= 0 && int64(len(data)) != size {
+		return false
+	}
+	return verifyObject(key, data) == nil
+}
+
+// mkdirSynced creates dir and its missing parents, syncing each parent
+// that gained an entry
+func mkdirSynced(dir string) error {
+	if _, err := os.Stat(dir); err == nil {
+		return nil
+	}
+	parent := filepath.Dir(dir)
+	if parent != dir {
+		if err := mkdirSynced(parent); err != nil {
+			return err
+		}
+	}
+	if err := os.Mkdir(dir, 0700); err != nil && !os.IsExist(err) {
 		return err
 	}
+	return syncDir(parent)
+}
 
-	return os.WriteFile(path, data, 0600)
+// syncDir flushes a directory, making renames and new entries in it durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
 }
 
 func (l *LocalBackend) Get(key string) ([]byte, error) {
@@ -46,6 +211,25 @@ func (l *LocalBackend) Get(key string) ([]byte, error) {
 	return os.ReadFile(path)
 }
 
+// GetReader opens the object file for streaming. The reader must be closed.
+func (l *LocalBackend) GetReader(key string) (io.ReadCloser, error) {
+	return os.Open(l.objectPath(key))
+}
+
+func (l *LocalBackend) GetRange(key string, offset, length int64) ([]byte, error) {
+	f, err := os.Open(l.objectPath(key))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	buf := make([]byte, length)
+	if _, err := f.ReadAt(buf, offset); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
 func (l *LocalBackend) Has(key string) (bool, error) {
 	path := l.objectPath(key)
 	_, err := os.Stat(path)
@@ -55,6 +239,41 @@ func (l *LocalBackend) Has(key string) (bool, error) {
 	return err == nil, err
 }
 
+func (l *LocalBackend) List(prefix string, fn func(ObjectInfo) error) error {
+	root := filepath.Join(l.BasePath, filepath.FromSlash(listRoot(prefix)))
+
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(l.BasePath, path)
+		if err != nil {
+			return err
+		}
+		key, ok := keyFromObjectName(filepath.ToSlash(rel))
+		if !ok || !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		return fn(ObjectInfo{Key: key, Size: info.Size()})
+	})
+	if os.IsNotExist(err) {
+		return nil // Nothing stored under this namespace yet
+	}
+	return err
+}
+
+func (l *LocalBackend) Delete(key string) error {
+	err := os.Remove(l.objectPath(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
 func (l *LocalBackend) Close() error {
 	return nil
 }
@@ -0,0 +1,343 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+
+	"github.com/pranavdwivedi/aegis/pkg/crypto"
+	"github.com/pranavdwivedi/aegis/pkg/hash"
+)
+
+// KeyNamespace is the reserved namespace holding the repository key files.
+// Key files are stored as plain KeyFile JSON; they are protected by the passphrase.
+const KeyNamespace = "keys/"
+
+// ErrNoKeys is returned when a backend holds no key file
+var ErrNoKeys = fmt.Errorf("no key files in repository")
+
+// SaveKey stores the master key in the backend, encrypted by the passphrase
+// with the given Argon2id parameters (zero for the defaults).
+// It returns the id of the new key file.
+func SaveKey(backend Backend, mk crypto.MasterKey, passphrase string, params crypto.KDFParams) (string, error) {
+	data, err := crypto.SealKey(mk, passphrase, params)
+	if err != nil {
+		return "", err
+	}
+
+	id := hash.Sum(data).String()
+	if err := backend.Put(KeyNamespace+id, data); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// LoadKey opens the master key with the passphrase, trying every key file
+// stored in the backend.
+func LoadKey(backend Backend, passphrase string) (crypto.MasterKey, error) {
+	ids, err := ListKeys(backend)
+	if err != nil {
+		return crypto.MasterKey{}, err
+	}
+	if len(ids) == 0 {
+		return crypto.MasterKey{}, ErrNoKeys
+	}
+
+	for _, id := range ids {
+		data, err := backend.Get(KeyNamespace + id)
+		if err != nil {
+			return crypto.MasterKey{}, fmt.Errorf("failed to read key %s: %w", id, err)
+		}
+		if mk, err := crypto.OpenKey(data, passphrase); err == nil {
+			return mk, nil
+		}
+	}
+	return crypto.MasterKey{}, fmt.Errorf("invalid passphrase or corrupted key file")
+}
+
+// ListKeys returns the ids of the key files stored in the backend, sorted.
+// Key files are always tried in this order, so while a key rotation
+// replaces them a passphrase opening both keys opens the same one on every host.
+func ListKeys(backend Backend) ([]string, error) {
+	var ids []string
+	err := backend.List(KeyNamespace, func(obj ObjectInfo) error {
+		ids = append(ids, obj.Key[len(KeyNamespace):])
+		return nil
+	})
+	slices.Sort(ids)
+	return ids, err
+}
+
+// readKeyFiles loads every key file of the backend, keyed by id
+func readKeyFiles(backend Backend) (map[string]*crypto.KeyFile, error) {
+	ids, err := ListKeys(backend)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make(map[string]*crypto.KeyFile, len(ids))
+	for _, id := range ids {
+		data, err := backend.Get(KeyNamespace + id)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key %s: %w", id, err)
+		}
+		kf, err := crypto.ParseKeyFile(data)
+		if err != nil {
+			return nil, fmt.Errorf("corrupt key %s: %w", id, err)
+		}
+		files[id] = kf
+	}
+	return files, nil
+}
+
+// replaceKeyFile stores kf under its new content id, then removes oldID.
+// A crash in between leaves two valid key files, never zero.
+func replaceKeyFile(backend Backend, oldID string, kf *crypto.KeyFile) error {
+	data, err := json.Marshal(kf)
+	if err != nil {
+		return err
+	}
+
+	id := hash.Sum(data).String()
+	if err := backend.Put(KeyNamespace+id, data); err != nil {
+		return err
+	}
+	if id == oldID {
+		return nil
+	}
+	return backend.Delete(KeyNamespace + oldID)
+}
+
+// sortedIDs returns the ids of files in the order ListKeys returns them
+func sortedIDs(files map[string]*crypto.KeyFile) []string {
+	return slices.Sorted(maps.Keys(files))
+}
+
+// unlockKeyFile finds the first key file the passphrase opens
+func unlockKeyFile(files map[string]*crypto.KeyFile, passphrase string) (string, crypto.MasterKey, error) {
+	for _, id := range sortedIDs(files) {
+		if mk, err := files[id].Unlock(passphrase); err == nil {
+			return id, mk, nil
+		}
+	}
+	return "", crypto.MasterKey{}, fmt.Errorf("invalid passphrase or corrupted key file")
+}
+
+// AddKeySlot lets newPassphrase unlock the repository as well.
+// passphrase must unlock an existing slot. Returns the new slot id.
+func AddKeySlot(backend Backend, passphrase, label, newPassphrase string, params crypto.KDFParams) (string, error) {
+	files, err := readKeyFiles(backend)
+	if err != nil {
+		return "", err
+	}
+	if len(files) == 0 {
+		return "", ErrNoKeys
+	}
+
+	id, mk, err := unlockKeyFile(files, passphrase)
+	if err != nil {
+		return "", err
+	}
+
+	kf := files[id]
+	slotID, err := kf.AddSlot(mk, label, newPassphrase, params)
+	if err != nil {
+		return "", err
+	}
+	if err := replaceKeyFile(backend, id, kf); err != nil {
+		return "", err
+	}
+	return slotID, nil
+}
+
+// AddKeySlotWithKey stores a new key file whose single slot lets passphrase
+// unlock mk. Unlike AddKeySlot it needs the master key itself instead of an
+// existing passphrase, e.g. after recovering it from shares; the caller
+// must have checked that mk belongs to the repository. Returns the slot id.
+func AddKeySlotWithKey(backend Backend, mk crypto.MasterKey, label, passphrase string, params crypto.KDFParams) (string, error) {
+	kf := &crypto.KeyFile{Algorithm: "argon2id_aes256gcm", Cipher: mk.Cipher()}
+	slotID, err := kf.AddSlot(mk, label, passphrase, params)
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(kf)
+	if err != nil {
+		return "", err
+	}
+	if err := backend.Put(KeyNamespace+hash.Sum(data).String(), data); err != nil {
+		return "", err
+	}
+	return slotID, nil
+}
+
+// RewrapKeySlot re-derives the slot unlocked by passphrase with new Argon2id
+// parameters, e.g. to harden an existing repository. Returns the slot id.
+func RewrapKeySlot(backend Backend, passphrase string, params crypto.KDFParams) (string, error) {
+	if params != (crypto.KDFParams{}) {
+		if err := params.Validate(); err != nil {
+			return "", err
+		}
+	}
+
+	files, err := readKeyFiles(backend)
+	if err != nil {
+		return "", err
+	}
+
+	for _, id := range sortedIDs(files) {
+		kf := files[id]
+		slotID, err := kf.RewrapSlot(passphrase, params)
+		if err != nil {
+			continue
+		}
+		if err := replaceKeyFile(backend, id, kf); err != nil {
+			return "", err
+		}
+		return slotID, nil
+	}
+	return "", fmt.Errorf("invalid passphrase or corrupted key file")
+}
+
+// ListKeySlots returns the slots of every key file in the backend
+func ListKeySlots(backend Backend) ([]crypto.KeySlot, error) {
+	files, err := readKeyFiles(backend)
+	if err != nil {
+		return nil, err
+	}
+
+	var slots []crypto.KeySlot
+	for _, id := range sortedIDs(files) {
+		slots = append(slots, files[id].Slots...)
+	}
+	return slots, nil
+}
+
+// RemoveKeySlot revokes a slot. passphrase must unlock the repository
+// (through any slot, including the one being removed). The last remaining
+// slot of the repository can never be removed.
+func RemoveKeySlot(backend Backend, passphrase, slotID string) error {
+	files, err := readKeyFiles(backend)
+	if err != nil {
+		return err
+	}
+	if _, _, err := unlockKeyFile(files, passphrase); err != nil {
+		return err
+	}
+
+	total := 0
+	for _, kf := range files {
+		total += len(kf.Slots)
+	}
+
+	for _, id := range sortedIDs(files) {
+		kf := files[id]
+		for _, s := range kf.Slots {
+			if s.ID != slotID {
+				continue
+			}
+			if total == 1 {
+				return crypto.ErrLastSlot
+			}
+			if len(kf.Slots) == 1 {
+				// Other key files still hold slots; drop this file entirely
+				return backend.Delete(KeyNamespace + id)
+			}
+			if err := kf.RemoveSlot(slotID); err != nil {
+				return err
+			}
+			return replaceKeyFile(backend, id, kf)
+		}
+	}
+	return fmt.Errorf("key slot %s not found", slotID)
+}
+
+// UnlockKeySlot opens the master key with the passphrase and reports the slot used
+func UnlockKeySlot(backend Backend, passphrase string) (crypto.MasterKey, crypto.KeySlot, error) {
+	unlocked, err := unlockKeySlots(backend, passphrase, true)
+	if err != nil {
+		return crypto.MasterKey{}, crypto.KeySlot{}, err
+	}
+	return unlocked[0].Key, unlocked[0].Slot, nil
+}
+
+// UnlockedSlot is a master key and the slot that opened it
+type UnlockedSlot struct {
+	Key  crypto.MasterKey
+	Slot crypto.KeySlot
+}
+
+// UnlockKeySlots opens every key file the passphrase unlocks, in the order
+// of ListKeys. Only an interrupted key rotation leaves a passphrase able to
+// open two different master keys.
+func UnlockKeySlots(backend Backend, passphrase string) ([]UnlockedSlot, error) {
+	return unlockKeySlots(backend, passphrase, false)
+}
+
+func unlockKeySlots(backend Backend, passphrase string, first bool) ([]UnlockedSlot, error) {
+	files, err := readKeyFiles(backend)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, ErrNoKeys
+	}
+
+	var unlocked []UnlockedSlot
+	for _, id := range sortedIDs(files) {
+		kf := files[id]
+		mk, slotID, err := kf.UnlockSlot(passphrase)
+		if err != nil {
+			continue
+		}
+		for _, s := range kf.Slots {
+			if s.ID == slotID {
+				unlocked = append(unlocked, UnlockedSlot{Key: mk, Slot: s})
+			}
+		}
+		if first && len(unlocked) > 0 {
+			break
+		}
+	}
+	if len(unlocked) == 0 {
+		return nil, fmt.Errorf("invalid passphrase or corrupted key file")
+	}
+	return unlocked, nil
+}
+
+// ReplaceKeys makes mk the only repository key, unlocked by a single slot
+// with the given label, passphrase and KDF params. Every other key file is
+// deleted; the labels of the slots that were dropped are returned.
+func ReplaceKeys(backend Backend, mk crypto.MasterKey, label, passphrase string, params crypto.KDFParams) ([]string, error) {
+	files, err := readKeyFiles(backend)
+	if err != nil {
+		return nil, err
+	}
+
+	kf := &crypto.KeyFile{Algorithm: "argon2id_aes256gcm", Cipher: mk.Cipher()}
+	if _, err := kf.AddSlot(mk, label, passphrase, params); err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(kf)
+	if err != nil {
+		return nil, err
+	}
+	newID := hash.Sum(data).String()
+	if err := backend.Put(KeyNamespace+newID, data); err != nil {
+		return nil, err
+	}
+
+	var dropped []string
+	for _, id := range sortedIDs(files) {
+		if id == newID {
+			continue
+		}
+		for _, s := range files[id].Slots {
+			dropped = append(dropped, s.Label)
+		}
+		if err := backend.Delete(KeyNamespace + id); err != nil {
+			return dropped, err
+		}
+	}
+	return dropped, nil
+}
@@ -0,0 +1,200 @@
+package storage
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// LockNamespace holds the locks of the operations running on a repository.
+// Locks are plain JSON; they hold nothing but their kind and age.
+const LockNamespace = "locks/"
+
+// Lock timing. A lock is refreshed while its operation runs, so a lock
+// older than LockStaleAfter belongs to a host that crashed and is ignored.
+var (
+	LockRefreshInterval = 5 * time.Minute
+	LockStaleAfter      = 30 * time.Minute
+)
+
+// ErrLocked is returned when a conflicting lock is held
+var ErrLocked = errors.New("repository is locked")
+
+// lockInfo is the stored content of a lock
+type lockInfo struct {
+	Exclusive bool      `json:"exclusive"`
+	Created   time.Time `json:"created"`
+}
+
+// Lock is a lock held on a repository. Backups hold shared locks, which
+// only conflict with exclusive ones; operations that delete data (prune,
+// key rotation, migrations) hold an exclusive lock, which conflicts with
+// every other lock.
+type Lock struct {
+	backend   Backend
+	exclusive bool
+	key       string // owned by refresh until it stops
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+// AcquireLock takes a shared or exclusive lock on the repository in
+// backend, failing with ErrLocked if a conflicting lock is held. The lock
+// is refreshed in the background until Release.
+func AcquireLock(backend Backend, exclusive bool) (*Lock, error) {
+	if err := checkLocks(backend, exclusive, ""); err != nil {
+		return nil, err
+	}
+	key, err := putLock(backend, exclusive)
+	if err != nil {
+		return nil, err
+	}
+	// Another host may have locked between the check and the put; if so,
+	// both back off
+	if err := checkLocks(backend, exclusive, key); err != nil {
+		if derr := backend.Delete(key); derr != nil {
+			fmt.Printf("LOCK: failed to remove %s: %v\n", key, derr)
+		}
+		return nil, err
+	}
+
+	l := &Lock{
+		backend:   backend,
+		exclusive: exclusive,
+		key:       key,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	go l.refresh()
+	return l, nil
+}
+
+// checkLocks returns ErrLocked if a lock other than own conflicts with a
+// lock of the given kind
+func checkLocks(backend Backend, exclusive bool, own string) error {
+	var keys []string
+	err := backend.List(LockNamespace, func(obj ObjectInfo) error {
+		if obj.Key != own {
+			keys = append(keys, obj.Key)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list locks: %w", err)
+	}
+
+	for _, k := range keys {
+		info, err := readLock(backend, k)
+		if errors.Is(err, errStaleLock) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if exclusive || info.Exclusive {
+			kind := "shared"
+			if info.Exclusive {
+				kind = "exclusive"
+			}
+			return fmt.Errorf("%w: %s lock %s taken %s", ErrLocked, kind, k, info.Created.Format(time.RFC3339))
+		}
+	}
+	return nil
+}
+
+// errStaleLock reports a lock that is gone, corrupt or too old to be held
+var errStaleLock = errors.New("stale lock")
+
+func readLock(backend Backend, key string) (lockInfo, error) {
+	var info lockInfo
+	data, err := backend.Get(key)
+	if err != nil {
+		// Released since it was listed
+		if exists, herr := backend.Has(key); herr == nil && !exists {
+			return info, errStaleLock
+		}
+		return info, fmt.Errorf("failed to read lock %s: %w", key, err)
+	}
+	// A lock no host could have written is not held by anyone either
+	if err := json.Unmarshal(data, &info); err != nil || time.Since(info.Created) > LockStaleAfter {
+		return info, errStaleLock
+	}
+	return info, nil
+}
+
+// putLock stores a new lock and returns its key
+func putLock(backend Backend, exclusive bool) (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(lockInfo{Exclusive: exclusive, Created: time.Now().UTC()})
+	if err != nil {
+		return "", err
+	}
+	key := LockNamespace + hex.EncodeToString(id)
+	if err := backend.Put(key, data); err != nil {
+		return "", fmt.Errorf("failed to store lock: %w", err)
+	}
+	return key, nil
+}
+
+// refresh replaces the lock with a new one every LockRefreshInterval, so
+// other hosts never take it for stale. Objects are never overwritten, so
+// a refresh stores a new lock before removing the old one.
+func (l *Lock) refresh() {
+	defer close(l.done)
+	t := time.NewTicker(LockRefreshInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-t.C:
+		}
+		key, err := putLock(l.backend, l.exclusive)
+		if err != nil {
+			fmt.Printf("LOCK: refresh failed: %v\n", err)
+			continue
+		}
+		old := l.key
+		l.key = key
+		if err := l.backend.Delete(old); err != nil {
+			fmt.Printf("LOCK: failed to remove %s: %v\n", old, err)
+		}
+	}
+}
+
+// Release stops refreshing the lock and removes it
+func (l *Lock) Release() error {
+	close(l.stop)
+	<-l.done
+	return l.backend.Delete(l.key)
+}
+
+// RemoveStaleLocks deletes the locks left by hosts that crashed and
+// returns how many it removed
+func RemoveStaleLocks(backend Backend) (int, error) {
+	var keys []string
+	err := backend.List(LockNamespace, func(obj ObjectInfo) error {
+		keys = append(keys, obj.Key)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, k := range keys {
+		if _, err := readLock(backend, k); !errors.Is(err, errStaleLock) {
+			continue
+		}
+		if err := backend.Delete(k); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
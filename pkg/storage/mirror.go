@@ -0,0 +1,554 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pranavdwivedi/aegis/pkg/hash"
+)
+
+// ErrReplicaCorrupt is returned when a replica holds a copy of an object
+// that fails verification
+var ErrReplicaCorrupt = errors.New("replica holds a corrupt copy")
+
+// MirrorBackend is a Backend that stores every object on several replicas
+// (e.g. local disk plus S3).
+//
+// Writes go to all replicas in parallel and succeed once quorum of them
+// acknowledged. Reads try the replicas in order and return the first copy
+// that verifies. Content-addressed objects (see repairable) are repaired
+// from it on the spot on the replicas that held a bad copy; other objects
+// are only read. Scrub does the same for every object.
+//
+// Whole objects are verified without the master key: content-addressed
+// objects (packs, key files) by their hash, other objects by their
+// envelope. Ranged reads through a Packer are verified against the
+// checksum of the packed object.
+//
+// A delete that misses a replica leaves a copy there that must not come
+// back: a forgotten snapshot or a revoked key file. Unless the object is
+// restorable, the delete is recorded in a tombstone on the replicas it
+// reached, and reads ignore the object until Scrub has deleted it
+// everywhere.
+type MirrorBackend struct {
+	replicas []Backend
+	quorum   int
+}
+
+// NewMirrorBackend mirrors objects across replicas, in read preference
+// order. quorum is the number of replicas a write must reach (zero for all).
+func NewMirrorBackend(replicas []Backend, quorum int) (*MirrorBackend, error) {
+	if len(replicas) == 0 {
+		return nil, fmt.Errorf("mirror needs at least one replica")
+	}
+	if quorum == 0 {
+		quorum = len(replicas)
+	}
+	if quorum < 1 || quorum > len(replicas) {
+		return nil, fmt.Errorf("write quorum %d out of range for %d replicas", quorum, len(replicas))
+	}
+	return &MirrorBackend{replicas: replicas, quorum: quorum}, nil
+}
+
+// verifyObject checks a copy of key as far as possible without the master
+// key: content-addressed objects must hash to their id, enveloped objects
+// must be sealed for key
+func verifyObject(key string, data []byte) error {
+	if id, ok := strings.CutPrefix(key, packNamespace); ok {
+		return verifyContentID(key, id, data)
+	}
+	if id, ok := strings.CutPrefix(key, KeyNamespace); ok {
+		return verifyContentID(key, id, data)
+	}
+
+	e, _, _, err := parseEnvelope(data)
+	if err == errLegacyObject {
+		return nil // Nothing to check
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrReplicaCorrupt, key, err)
+	}
+	if e.Key != key || e.Type != objectType(key) {
+		return fmt.Errorf("%w: %s holds an object sealed for %s", ErrReplicaCorrupt, key, e.Key)
+	}
+	return nil
+}
+
+// repairable reports whether a bad copy of key may be rewritten from a good
+// one. Only content-addressed objects qualify: every valid copy of a chunk,
+// pack or key file holds the same content. Snapshot metadata, the config,
+// parity and data keys are replaced and deleted over time, and a replica
+// that missed an update or a delete holds an old copy that still verifies,
+// so their copies are never rewritten.
+func repairable(key string) bool {
+	return !strings.Contains(key, "/") || strings.HasPrefix(key, packNamespace) || strings.HasPrefix(key, KeyNamespace)
+}
+
+// restorable reports whether a replica missing key may get a copy back.
+// That may bring back an object deleted while the replica was unreachable:
+// harmless for chunks and packs, which prune removes again, but not for key
+// files, whose deletion revokes a passphrase.
+func restorable(key string) bool {
+	return repairable(key) && !strings.HasPrefix(key, KeyNamespace)
+}
+
+// tombstoneNamespace records the deletes some replica missed, one object
+// per deleted key, named by the hex of the key
+const tombstoneNamespace = "tombstones/"
+
+func tombstoneKey(key string) string {
+	return tombstoneNamespace + hex.EncodeToString([]byte(key))
+}
+
+// hidable reports whether a missed delete of key needs a tombstone
+func hidable(key string) bool {
+	return !restorable(key) && !strings.HasPrefix(key, tombstoneNamespace)
+}
+
+func verifyContentID(key, id string, data []byte) error {
+	if _, err := hash.Parse(id); err != nil {
+		return nil // Not named by content
+	}
+	if hash.Sum(data).String() != id {
+		return fmt.Errorf("%w: %s does not match its hash", ErrReplicaCorrupt, key)
+	}
+	return nil
+}
+
+// each runs fn on every replica in parallel and returns the error of each
+func (m *MirrorBackend) each(fn func(b Backend) error) []error {
+	errs := make([]error, len(m.replicas))
+	var wg sync.WaitGroup
+	for i, b := range m.replicas {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = fn(b)
+		}()
+	}
+	wg.Wait()
+	return errs
+}
+
+// quorumErr fails unless at least quorum replicas succeeded
+func (m *MirrorBackend) quorumErr(op, key string, errs []error) error {
+	ok := 0
+	for _, err := range errs {
+		if err == nil {
+			ok++
+		}
+	}
+	if ok >= m.quorum {
+		for i, err := range errs {
+			if err != nil {
+				fmt.Printf("MIRROR: %s %s failed on replica %d (left for scrub): %v\n", op, key, i, err)
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("%s %s reached %d of %d replicas, quorum is %d: %w", op, key, ok, len(m.replicas), m.quorum, errors.Join(errs...))
+}
+
+func (m *MirrorBackend) Put(key string, data []byte) error {
+	errs := m.each(func(b Backend) error { return b.Put(key, data) })
+	if err := m.quorumErr("put", key, errs); err != nil {
+		return err
+	}
+	return m.revive(key)
+}
+
+// revive removes the tombstone of a key stored again
+func (m *MirrorBackend) revive(key string) error {
+	if !hidable(key) {
+		return nil
+	}
+	dead, err := m.deleted(key)
+	if err != nil || !dead {
+		return err
+	}
+	tomb := tombstoneKey(key)
+	errs := m.each(func(b Backend) error { return b.Delete(tomb) })
+	return m.quorumErr("delete", tomb, errs)
+}
+
+// deleted reports whether a tombstone hides key
+func (m *MirrorBackend) deleted(key string) (bool, error) {
+	return m.has(tombstoneKey(key))
+}
+
+// tombstones returns the keys hidden by a tombstone
+func (m *MirrorBackend) tombstones() (map[string]bool, error) {
+	objects, err := m.list(tombstoneNamespace)
+	if err != nil {
+		return nil, err
+	}
+	dead := make(map[string]bool, len(objects))
+	for k := range objects {
+		key, err := hex.DecodeString(strings.TrimPrefix(k, tombstoneNamespace))
+		if err != nil {
+			continue // Not a tombstone
+		}
+		dead[string(key)] = true
+	}
+	return dead, nil
+}
+
+// PutReader streams r to every replica in parallel when r can be read at
+// several offsets at once (e.g. a spooled pack); other readers are buffered
+func (m *MirrorBackend) PutReader(key string, r io.Reader, size int64) error {
+	ra, ok := r.(io.ReaderAt)
+	if !ok || size < 0 {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		return m.Put(key, data)
+	}
+	errs := m.each(func(b Backend) error {
+		return StreamPut(b, key, io.NewSectionReader(ra, 0, size), size)
+	})
+	if err := m.quorumErr("put", key, errs); err != nil {
+		return err
+	}
+	return m.revive(key)
+}
+
+// Get returns the first copy of key that verifies and repairs the replicas
+// before it that lacked the object or held a bad copy
+func (m *MirrorBackend) Get(key string) ([]byte, error) {
+	if err := m.checkDeleted(key); err != nil {
+		return nil, err
+	}
+	data, i, err := m.firstGood(key)
+	if err != nil {
+		return nil, err
+	}
+	m.repair(key, data, m.replicas[:i])
+	return data, nil
+}
+
+// checkDeleted fails with os.ErrNotExist if a tombstone hides key
+func (m *MirrorBackend) checkDeleted(key string) error {
+	if !hidable(key) {
+		return nil
+	}
+	dead, err := m.deleted(key)
+	if err != nil {
+		return err
+	}
+	if dead {
+		return fmt.Errorf("mirror: %s was deleted: %w", key, os.ErrNotExist)
+	}
+	return nil
+}
+
+// firstGood returns the first copy of key that verifies and its replica
+func (m *MirrorBackend) firstGood(key string) ([]byte, int, error) {
+	var errs []error
+	for i, b := range m.replicas {
+		data, err := b.Get(key)
+		if err == nil {
+			err = verifyObject(key, data)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("replica %d: %w", i, err))
+			continue
+		}
+		return data, i, nil
+	}
+	return nil, -1, errors.Join(errs...)
+}
+
+// repair rewrites key from good on the replicas that hold a copy failing
+// verification or, if restorable, are missing it. A copy that verifies is
+// never overwritten, even if it differs from good. Replicas that cannot be
+// reached are left alone. It returns the copies rewritten and the replicas
+// still missing key or holding a different copy.
+func (m *MirrorBackend) repair(key string, good []byte, replicas []Backend) (repaired, divergent int) {
+	for _, b := range replicas {
+		data, err := b.Get(key)
+		if err == nil && bytes.Equal(data, good) {
+			continue
+		}
+		if err == nil && (!repairable(key) || verifyObject(key, data) == nil) {
+			divergent++
+			continue
+		}
+		if err != nil {
+			// Only rewrite when the replica answers that the object is gone
+			if exists, herr := b.Has(key); herr != nil || exists {
+				continue
+			}
+			if !restorable(key) {
+				divergent++
+				continue
+			}
+		}
+		// Backends may refuse to overwrite, so replace explicitly
+		if err := b.Delete(key); err != nil {
+			fmt.Printf("MIRROR: repair of %s failed: %v\n", key, err)
+			continue
+		}
+		if err := b.Put(key, good); err != nil {
+			fmt.Printf("MIRROR: repair of %s failed: %v\n", key, err)
+			continue
+		}
+		repaired++
+	}
+	return repaired, divergent
+}
+
+// GetRange reads part of an object from the first replica that answers
+func (m *MirrorBackend) GetRange(key string, offset, length int64) ([]byte, error) {
+	return m.getRangeVerified(key, offset, length, func([]byte) error { return nil })
+}
+
+// replicaRange reads part of an object from one replica, falling back to a full read
+func replicaRange(b Backend, key string, offset, length int64) ([]byte, error) {
+	if rr, ok := b.(RangeReader); ok {
+		return rr.GetRange(key, offset, length)
+	}
+	data, err := b.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	if offset < 0 || length < 0 || offset+length > int64(len(data)) {
+		return nil, fmt.Errorf("%s is truncated", key)
+	}
+	return data[offset : offset+length], nil
+}
+
+// getRangeVerified reads part of an object from the first replica whose
+// range passes verify. If that is not the first replica, the whole object
+// is repaired on the replicas before the good one.
+func (m *MirrorBackend) getRangeVerified(key string, offset, length int64, verify func([]byte) error) ([]byte, error) {
+	var errs []error
+	for i, b := range m.replicas {
+		data, err := replicaRange(b, key, offset, length)
+		if err == nil {
+			err = verify(data)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("replica %d: %w", i, err))
+			continue
+		}
+		if i > 0 {
+			if good, j, gerr := m.firstGood(key); gerr == nil {
+				m.repair(key, good, m.replicas[:j])
+			}
+		}
+		return data, nil
+	}
+	return nil, errors.Join(errs...)
+}
+
+// Has reports whether any replica holds key, unless it was deleted
+func (m *MirrorBackend) Has(key string) (bool, error) {
+	if hidable(key) {
+		if dead, err := m.deleted(key); err != nil || dead {
+			return false, err
+		}
+	}
+	return m.has(key)
+}
+
+func (m *MirrorBackend) has(key string) (bool, error) {
+	var errs []error
+	for i, b := range m.replicas {
+		exists, err := b.Has(key)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("replica %d: %w", i, err))
+			continue
+		}
+		if exists {
+			return true, nil
+		}
+	}
+	if len(errs) == len(m.replicas) {
+		return false, errors.Join(errs...)
+	}
+	return false, nil
+}
+
+// List lists the union of the objects of all replicas, in key order,
+// without the deleted ones a replica still holds. Replicas that fail to
+// list are skipped as long as one succeeds.
+func (m *MirrorBackend) List(prefix string, fn func(ObjectInfo) error) error {
+	objects, err := m.live(prefix)
+	if err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(objects))
+	for k := range objects {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if err := fn(objects[k]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// live lists the union of the replicas without the tombstones and the keys
+// they hide
+func (m *MirrorBackend) live(prefix string) (map[string]ObjectInfo, error) {
+	objects, err := m.list(prefix)
+	if err != nil || strings.HasPrefix(prefix, packNamespace) || strings.HasPrefix(prefix, tombstoneNamespace) {
+		return objects, err
+	}
+	dead, err := m.tombstones()
+	if err != nil {
+		return nil, err
+	}
+	for k := range objects {
+		if strings.HasPrefix(k, tombstoneNamespace) || (dead[k] && hidable(k)) {
+			delete(objects, k)
+		}
+	}
+	return objects, nil
+}
+
+func (m *MirrorBackend) list(prefix string) (map[string]ObjectInfo, error) {
+	objects := make(map[string]ObjectInfo)
+	var errs []error
+	for i, b := range m.replicas {
+		err := b.List(prefix, func(obj ObjectInfo) error {
+			if _, ok := objects[obj.Key]; !ok {
+				objects[obj.Key] = obj
+			}
+			return nil
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("replica %d: %w", i, err))
+		}
+	}
+	if len(errs) == len(m.replicas) {
+		return nil, errors.Join(errs...)
+	}
+	return objects, nil
+}
+
+// Delete removes key from every replica; it succeeds once quorum did.
+// A replica that was unreachable keeps its copy until Scrub deletes it;
+// unless key is restorable, a tombstone hides that copy in the meantime.
+func (m *MirrorBackend) Delete(key string) error {
+	errs := m.each(func(b Backend) error { return b.Delete(key) })
+	if err := m.quorumErr("delete", key, errs); err != nil {
+		return err
+	}
+	if !hidable(key) || errors.Join(errs...) == nil {
+		return nil
+	}
+	if err := m.Put(tombstoneKey(key), []byte(key)); err != nil {
+		return fmt.Errorf("delete of %s missed a replica and could not be recorded: %w", key, err)
+	}
+	return nil
+}
+
+// RetainedUntil returns the latest retention date of key on any replica
+func (m *MirrorBackend) RetainedUntil(key string) (time.Time, error) {
+	var until time.Time
+	for i, b := range m.replicas {
+		t, err := RetainedUntil(b, key)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("replica %d: %w", i, err)
+		}
+		if t.After(until) {
+			until = t
+		}
+	}
+	return until, nil
+}
+
+// ExtendRetention extends the retention of key on every replica that
+// locks objects; it succeeds once quorum did
+func (m *MirrorBackend) ExtendRetention(key string) error {
+	errs := m.each(func(b Backend) error { return ExtendRetention(b, key) })
+	return m.quorumErr("extend retention of", key, errs)
+}
+
+func (m *MirrorBackend) Close() error {
+	var errs []error
+	for _, b := range m.replicas {
+		errs = append(errs, b.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// ScrubReport summarizes a Scrub pass
+type ScrubReport struct {
+	Objects       int
+	Repaired      int      // replica copies rewritten
+	Divergent     []string // keys some replica lacks or holds another valid copy of, left as is
+	Unrecoverable []string // keys without a single good copy
+	Purged        int      // deletes a replica missed, completed
+}
+
+// Scrub first completes the deletes under prefix that a replica missed,
+// dropping their tombstones once every replica confirmed them. It then
+// reads every object under prefix from every replica and repairs the
+// copies of content-addressed objects from a copy that verifies (see
+// repair). Chunks and packs deleted while a replica was unreachable are
+// copied back to the others, and a later prune removes them again. Other
+// objects whose replicas disagree, e.g. snapshot metadata replaced on only
+// some of them, are reported as divergent and left for the operator.
+func (m *MirrorBackend) Scrub(prefix string) (ScrubReport, error) {
+	var report ScrubReport
+	dead, err := m.tombstones()
+	if err != nil {
+		return report, err
+	}
+	for k := range dead {
+		if !strings.HasPrefix(k, prefix) || !hidable(k) {
+			continue
+		}
+		if errors.Join(m.each(func(b Backend) error { return b.Delete(k) })...) != nil {
+			continue // Still unreachable; the tombstone stays
+		}
+		tomb := tombstoneKey(k)
+		if err := errors.Join(m.each(func(b Backend) error { return b.Delete(tomb) })...); err != nil {
+			fmt.Printf("MIRROR: failed to drop the tombstone of %s: %v\n", k, err)
+			continue
+		}
+		report.Purged++
+	}
+
+	objects, err := m.live(prefix)
+	if err != nil {
+		return report, err
+	}
+
+	keys := make([]string, 0, len(objects))
+	for k := range objects {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		report.Objects++
+		good, i, err := m.firstGood(k)
+		if err != nil {
+			fmt.Printf("MIRROR: no good copy of %s: %v\n", k, err)
+			report.Unrecoverable = append(report.Unrecoverable, k)
+			continue
+		}
+		others := append(append([]Backend(nil), m.replicas[:i]...), m.replicas[i+1:]...)
+		repaired, divergent := m.repair(k, good, others)
+		report.Repaired += repaired
+		if divergent > 0 {
+			fmt.Printf("MIRROR: %d replicas lack or hold another copy of %s; left as is\n", divergent, k)
+			report.Divergent = append(report.Divergent, k)
+		}
+	}
+	return report, nil
+}
@@ -0,0 +1,283 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/pranavdwivedi/aegis/pkg/hash"
+)
+
+var errReplicaDown = errors.New("replica unreachable")
+
+// downBackend is a replica that can be taken offline
+type downBackend struct {
+	Backend
+	down atomic.Bool
+}
+
+func (b *downBackend) check() error {
+	if b.down.Load() {
+		return errReplicaDown
+	}
+	return nil
+}
+
+func (b *downBackend) Put(key string, data []byte) error {
+	if err := b.check(); err != nil {
+		return err
+	}
+	return b.Backend.Put(key, data)
+}
+
+func (b *downBackend) Get(key string) ([]byte, error) {
+	if err := b.check(); err != nil {
+		return nil, err
+	}
+	return b.Backend.Get(key)
+}
+
+func (b *downBackend) Has(key string) (bool, error) {
+	if err := b.check(); err != nil {
+		return false, err
+	}
+	return b.Backend.Has(key)
+}
+
+func (b *downBackend) List(prefix string, fn func(ObjectInfo) error) error {
+	if err := b.check(); err != nil {
+		return err
+	}
+	return b.Backend.List(prefix, fn)
+}
+
+func (b *downBackend) Delete(key string) error {
+	if err := b.check(); err != nil {
+		return err
+	}
+	return b.Backend.Delete(key)
+}
+
+func newTestMirror(t *testing.T, n, quorum int) (*MirrorBackend, []*downBackend) {
+	t.Helper()
+	var replicas []*downBackend
+	var backends []Backend
+	for range n {
+		local, err := NewLocalBackend(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := &downBackend{Backend: local}
+		replicas = append(replicas, r)
+		backends = append(backends, r)
+	}
+	m, err := NewMirrorBackend(backends, quorum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m, replicas
+}
+
+// replace stores data as the only copy of key on one replica
+func replace(t *testing.T, b Backend, key string, data []byte) {
+	t.Helper()
+	if err := b.Delete(key); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Put(key, data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func mirrorKeys(t *testing.T, b Backend, prefix string) []string {
+	t.Helper()
+	var keys []string
+	if err := b.List(prefix, func(obj ObjectInfo) error {
+		keys = append(keys, obj.Key)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func TestMirrorQuorum(t *testing.T) {
+	m, replicas := newTestMirror(t, 3, 2)
+
+	replicas[2].down.Store(true)
+	if err := m.Put("aa11", []byte("one down")); err != nil {
+		t.Fatalf("put with a quorum of replicas failed: %v", err)
+	}
+	if got, err := m.Get("aa11"); err != nil || string(got) != "one down" {
+		t.Fatalf("get with one replica down: %q, %v", got, err)
+	}
+
+	replicas[1].down.Store(true)
+	if err := m.Put("bb22", []byte("two down")); err == nil {
+		t.Error("put below the quorum succeeded")
+	}
+	if got, err := m.Get("aa11"); err != nil || string(got) != "one down" {
+		t.Errorf("get from the last replica: %q, %v", got, err)
+	}
+	if err := m.Delete("aa11"); err == nil {
+		t.Error("delete below the quorum succeeded")
+	}
+
+	replicas[0].down.Store(true)
+	if _, err := m.Has("aa11"); err == nil {
+		t.Error("has with every replica down succeeded")
+	}
+	if err := m.List("", func(ObjectInfo) error { return nil }); err == nil {
+		t.Error("list with every replica down succeeded")
+	}
+
+	if _, err := NewMirrorBackend([]Backend{replicas[0]}, 2); err == nil {
+		t.Error("quorum above the number of replicas accepted")
+	}
+}
+
+func TestMirrorRepair(t *testing.T) {
+	m, replicas := newTestMirror(t, 2, 0)
+
+	pack := bytes.Repeat([]byte("pack data "), 100)
+	packKey := packNamespace + hash.Sum(pack).String()
+	keyFile := []byte(`{"algo":"argon2id_aes256gcm"}`)
+	keyKey := KeyNamespace + hash.Sum(keyFile).String()
+	for k, v := range map[string][]byte{packKey: pack, "aa11": []byte("chunk"), keyKey: keyFile, "snapshots/1": []byte("first")} {
+		if err := m.Put(k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A bad copy on the preferred replica is read past and repaired
+	replace(t, replicas[0], packKey, []byte("bit rot"))
+	if got, err := m.Get(packKey); err != nil || !bytes.Equal(got, pack) {
+		t.Fatalf("get of a pack with a corrupt first copy: %v", err)
+	}
+	if got, _ := replicas[0].Get(packKey); !bytes.Equal(got, pack) {
+		t.Error("corrupt copy was not repaired")
+	}
+
+	// Missing chunks come back, missing key files do not
+	for _, k := range []string{"aa11", keyKey} {
+		if err := replicas[0].Delete(k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := m.Get("aa11"); err != nil {
+		t.Fatal(err)
+	}
+	if exists, _ := replicas[0].Has("aa11"); !exists {
+		t.Error("missing chunk was not copied back")
+	}
+	if _, err := m.Get(keyKey); err != nil {
+		t.Fatal(err)
+	}
+	if exists, _ := replicas[0].Has(keyKey); exists {
+		t.Error("missing key file was copied back")
+	}
+
+	// Snapshot metadata that verifies is never overwritten
+	replace(t, replicas[1], "snapshots/1", []byte("second"))
+	report, err := m.Scrub("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := replicas[1].Get("snapshots/1"); string(got) != "second" {
+		t.Error("scrub overwrote snapshot metadata")
+	}
+	if len(report.Unrecoverable) != 0 {
+		t.Errorf("unrecoverable: %v", report.Unrecoverable)
+	}
+	divergent := map[string]bool{}
+	for _, k := range report.Divergent {
+		divergent[k] = true
+	}
+	if !divergent["snapshots/1"] || !divergent[keyKey] || len(divergent) != 2 {
+		t.Errorf("divergent %v, want the snapshot and the key file", report.Divergent)
+	}
+
+	// Every copy bad
+	replace(t, replicas[0], packKey, []byte("bad one"))
+	replace(t, replicas[1], packKey, []byte("bad two"))
+	if _, err := m.Get(packKey); !errors.Is(err, ErrReplicaCorrupt) {
+		t.Errorf("get without a good copy returned %v", err)
+	}
+}
+
+func TestMirrorDeleteWhileReplicaDown(t *testing.T) {
+	m, replicas := newTestMirror(t, 3, 2)
+
+	keyFile := []byte(`{"algo":"argon2id_aes256gcm"}`)
+	keyKey := KeyNamespace + hash.Sum(keyFile).String()
+	for k, v := range map[string][]byte{"snapshots/1": []byte("forgotten"), "snapshots/2": []byte("kept"), keyKey: keyFile, "aa11": []byte("chunk")} {
+		if err := m.Put(k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	replicas[2].down.Store(true)
+	for _, k := range []string{"snapshots/1", keyKey, "aa11"} {
+		if err := m.Delete(k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	replicas[2].down.Store(false)
+
+	// The returning replica still holds the deleted objects
+	if exists, _ := replicas[2].Has("snapshots/1"); !exists {
+		t.Fatal("test setup: replica 2 should have missed the delete")
+	}
+	if got := mirrorKeys(t, m, "snapshots/"); len(got) != 1 || got[0] != "snapshots/2" {
+		t.Errorf("snapshots listed %v, want only snapshots/2", got)
+	}
+	if got := mirrorKeys(t, m, KeyNamespace); len(got) != 0 {
+		t.Errorf("revoked key file listed: %v", got)
+	}
+	if exists, err := m.Has("snapshots/1"); err != nil || exists {
+		t.Errorf("has of a deleted snapshot: %v, %v", exists, err)
+	}
+	if _, err := m.Get("snapshots/1"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("get of a deleted snapshot returned %v", err)
+	}
+	for _, k := range mirrorKeys(t, m, "") {
+		if k == "snapshots/1" || k == keyKey || strings.HasPrefix(k, tombstoneNamespace) {
+			t.Errorf("full listing includes %s", k)
+		}
+	}
+
+	// Scrub completes the deletes and drops the tombstones
+	report, err := m.Scrub("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Purged != 2 {
+		t.Errorf("scrub completed %d deletes, want 2", report.Purged)
+	}
+	for _, k := range []string{"snapshots/1", keyKey} {
+		if exists, _ := replicas[2].Has(k); exists {
+			t.Errorf("scrub left %s on the returning replica", k)
+		}
+	}
+	for i, r := range replicas {
+		if got := mirrorKeys(t, r, tombstoneNamespace); len(got) != 0 {
+			t.Errorf("replica %d keeps tombstones %v", i, got)
+		}
+	}
+
+	// A key stored again after its delete is visible
+	replicas[2].down.Store(true)
+	if err := m.Delete("snapshots/2"); err != nil {
+		t.Fatal(err)
+	}
+	replicas[2].down.Store(false)
+	if err := m.Put("snapshots/2", []byte("again")); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := m.Get("snapshots/2"); err != nil || string(got) != "again" {
+		t.Errorf("get of a key stored again: %q, %v", got, err)
+	}
+}
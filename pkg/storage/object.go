@@ -0,0 +1,171 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/pranavdwivedi/aegis/pkg/crypto"
+)
+
+// ErrObjectMismatch is returned when an object was sealed for a different
+// key than the one it is stored under, i.e. the storage provider swapped it
+var ErrObjectMismatch = errors.New("object substituted")
+
+// ErrKeyMismatch is returned when an object was sealed with another master key
+var ErrKeyMismatch = errors.New("object sealed with a different master key")
+
+// Object types, bound into the associated data of every sealed object
+const (
+	objectChunk    byte = 1
+	objectMetadata byte = 2
+)
+
+// Compression recorded in the object envelope
+const (
+	CompressionNone byte = 0
+	CompressionZstd byte = 1
+)
+
+// objectMagic starts every object written with an envelope. Objects without
+// it are legacy nonce||ciphertext: AES-256-GCM over zstd, no associated data.
+var objectMagic = []byte("AEGS")
+
+// envelopeVersion is the envelope format: magic (4) | version (1) |
+// type (1) | cipher (1) | compression (1) | key id (8) | key length (2) | key
+const envelopeVersion byte = 1
+
+// envelope is the header of a stored object. The encoded header is the
+// associated data of the ciphertext that follows it.
+type envelope struct {
+	Version     byte
+	Type        byte
+	Cipher      crypto.Cipher
+	Compression byte
+	KeyID       crypto.KeyID
+	Key         string
+}
+
+// errLegacyObject reports an object without an envelope
+var errLegacyObject = errors.New("legacy object")
+
+// encode returns the header in the current envelope version
+func (e envelope) encode() []byte {
+	hdr := make([]byte, 0, 18+len(e.Key))
+	hdr = append(hdr, objectMagic...)
+	hdr = append(hdr, envelopeVersion, e.Type, byte(e.Cipher), e.Compression)
+	hdr = append(hdr, e.KeyID[:]...)
+	hdr = binary.LittleEndian.AppendUint16(hdr, uint16(len(e.Key)))
+	return append(hdr, e.Key...)
+}
+
+// parseEnvelope splits a sealed object into its envelope, the encoded header
+// and the ciphertext. It returns errLegacyObject for objects without one.
+func parseEnvelope(data []byte) (envelope, []byte, []byte, error) {
+	var e envelope
+	if len(data) < 5 || !bytes.Equal(data[:4], objectMagic) {
+		return e, nil, nil, errLegacyObject
+	}
+
+	e.Version = data[4]
+	if e.Version != envelopeVersion {
+		return e, nil, nil, fmt.Errorf("unsupported object format version %d", e.Version)
+	}
+	if len(data) < 18 {
+		return e, nil, nil, fmt.Errorf("truncated object header")
+	}
+	e.Type, e.Cipher, e.Compression = data[5], crypto.Cipher(data[6]), data[7]
+	copy(e.KeyID[:], data[8:16])
+	rest := data[16:]
+	n := int(binary.LittleEndian.Uint16(rest))
+	if len(rest) < 2+n {
+		return e, nil, nil, fmt.Errorf("truncated object header")
+	}
+	e.Key = string(rest[2 : 2+n])
+
+	hdrLen := len(data) - len(rest) + 2 + n
+	return e, data[:hdrLen], data[hdrLen:], nil
+}
+
+// sealedKeyID returns the id of the key an object was sealed with, if it
+// has an envelope
+func sealedKeyID(data []byte) (crypto.KeyID, bool) {
+	e, _, _, err := parseEnvelope(data)
+	if err != nil {
+		return crypto.KeyID{}, false
+	}
+	return e.KeyID, true
+}
+
+// objectType returns the type of the object stored under key
+func objectType(key string) byte {
+	if isNamespaced(key) {
+		return objectMetadata
+	}
+	return objectChunk
+}
+
+func objectTypeName(typ byte) string {
+	if typ == objectMetadata {
+		return "metadata"
+	}
+	return "chunk"
+}
+
+// sealObject encrypts payload with mk's cipher, bound to the key it is stored under.
+// compression records how payload was compressed.
+func sealObject(mk crypto.MasterKey, key string, payload []byte, compression byte) ([]byte, error) {
+	hdr := envelope{
+		Type:        objectType(key),
+		Cipher:      mk.Cipher(),
+		Compression: compression,
+		KeyID:       mk.ID(),
+		Key:         key,
+	}.encode()
+
+	encrypted, err := mk.EncryptWithAD(payload, hdr)
+	if err != nil {
+		return nil, fmt.Errorf("encryption failed: %w", err)
+	}
+	return append(hdr, encrypted...), nil
+}
+
+// openObject decrypts an object read from key and returns the payload and
+// its compression. Objects sealed for another key fail with
+// ErrObjectMismatch, and objects sealed with another master key with
+// ErrKeyMismatch, before decryption is attempted.
+func openObject(mk crypto.MasterKey, key string, data []byte) ([]byte, byte, error) {
+	e, hdr, body, err := parseEnvelope(data)
+	if err != nil {
+		// A legacy object whose random nonce happens to start with the magic
+		// fails to parse; try it as legacy before reporting the header error.
+		payload, lerr := mk.DecryptWith(crypto.CipherAES256GCM, data, nil)
+		if lerr == nil {
+			return payload, CompressionZstd, nil
+		}
+		if err == errLegacyObject {
+			return nil, 0, fmt.Errorf("decryption failed (wrong key or data corruption): %w", lerr)
+		}
+		return nil, 0, err
+	}
+
+	if e.Type != objectType(key) || e.Key != key {
+		return nil, 0, fmt.Errorf("%w (sealed for %s %s)", ErrObjectMismatch, objectTypeName(e.Type), e.Key)
+	}
+	if e.KeyID != mk.ID() {
+		return nil, 0, fmt.Errorf("%w (key id %x)", ErrKeyMismatch, e.KeyID[:])
+	}
+	if e.Compression != CompressionNone && e.Compression != CompressionZstd {
+		return nil, 0, fmt.Errorf("unsupported compression %d", e.Compression)
+	}
+
+	if !e.Cipher.Valid() {
+		return nil, 0, fmt.Errorf("unsupported cipher %d", uint8(e.Cipher))
+	}
+	payload, err := mk.DecryptWith(e.Cipher, body, hdr)
+	if err != nil {
+		return nil, 0, fmt.Errorf("decryption failed (data corruption or tampered header): %w", err)
+	}
+	return payload, e.Compression, nil
+}
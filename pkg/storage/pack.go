@@ -0,0 +1,814 @@
+package storage
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/pranavdwivedi/aegis/pkg/hash"
+)
+
+// DefaultPackSize is the target size of a packfile (16MB)
+const DefaultPackSize = 16 * 1024 * 1024
+
+// PackIndexName is the file name of the local pack index inside the repo dir
+const PackIndexName = "packs.db"
+
+// packNamespace is the key namespace packfiles are stored under
+const packNamespace = "packs/"
+
+// PackEntry locates one object inside a packfile
+type PackEntry struct {
+	Key    string `json:"key"`
+	Offset int64  `json:"offset"`
+	Length int64  `json:"length"`
+	// Sum is the BLAKE3 hash of the packed bytes, so ranged reads can be
+	// verified
+	Sum string `json:"sum"`
+}
+
+// packHeader is appended to every packfile so the pack index can be
+// rebuilt from the backend alone.
+// Layout: blob || blob || ... || header JSON || uint32 LE header length
+type packHeader struct {
+	Entries []PackEntry `json:"entries"`
+}
+
+// Packer is a Backend that aggregates small objects (encrypted chunks) into
+// packfiles before handing them to the underlying backend. Lookups are
+// answered from a local SQLite pack index, and reads of packed objects use
+// ranged reads when the backend supports them. The pack being built is
+// spooled to a temporary file next to the pack index and streamed to the
+// backend, so memory use does not grow with the pack size.
+//
+// Namespaced keys (e.g. "keys/<id>") are passed through untouched.
+// Objects stored before packing existed are still readable through Get.
+type Packer struct {
+	backend  Backend
+	db       *sql.DB
+	packSize int
+	spoolDir string
+
+	mu       sync.Mutex
+	spool    *os.File // pack being built, created on first use
+	size     int64    // bytes of objects in spool
+	entries  []PackEntry
+	pending  map[string]int  // key -> position in entries
+	written  []string        // packs flushed since the last dropPacks
+	extended map[string]bool // packs whose retention was extended
+}
+
+// NewPacker wraps backend, keeping the pack index at indexPath
+func NewPacker(backend Backend, indexPath string, packSize int) (*Packer, error) {
+	if packSize <= 0 {
+		packSize = DefaultPackSize
+	}
+
+	db, err := sql.Open("sqlite3", indexPath)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS pack_entries (
+		key TEXT PRIMARY KEY,
+		pack TEXT NOT NULL,
+		offset INTEGER NOT NULL,
+		length INTEGER NOT NULL,
+		sum TEXT NOT NULL
+	)`)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	if _, err := db.Exec(`CREATE INDEX IF NOT EXISTS idx_pack_entries_pack ON pack_entries(pack)`); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &Packer{
+		backend:  backend,
+		db:       db,
+		packSize: packSize,
+		spoolDir: filepath.Dir(indexPath),
+		pending:  make(map[string]int),
+		extended: make(map[string]bool),
+	}, nil
+}
+
+// lookup finds key in the local pack index
+func (p *Packer) lookup(key string) (string, PackEntry, bool, error) {
+	var pack string
+	e := PackEntry{Key: key}
+	err := p.db.QueryRow("SELECT pack, offset, length, sum FROM pack_entries WHERE key = ?", key).Scan(&pack, &e.Offset, &e.Length, &e.Sum)
+	if err == sql.ErrNoRows {
+		return "", e, false, nil
+	}
+	if err != nil {
+		return "", e, false, err
+	}
+	return pack, e, true, nil
+}
+
+func (p *Packer) Put(key string, data []byte) error {
+	if isNamespaced(key) {
+		return p.backend.Put(key, data)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, ok := p.pending[key]; ok {
+		return nil
+	}
+	if _, _, found, err := p.lookup(key); err != nil {
+		return err
+	} else if found {
+		return nil // Already packed
+	}
+
+	return p.addLocked(key, data)
+}
+
+// addLocked appends data to the pack being built, flushing it once full
+func (p *Packer) addLocked(key string, data []byte) error {
+	if p.spool == nil {
+		f, err := os.CreateTemp(p.spoolDir, ".pack-*.tmp")
+		if err != nil {
+			return fmt.Errorf("failed to create pack spool: %w", err)
+		}
+		p.spool = f
+	}
+	// WriteAt keeps the spool consistent with size if a write fails halfway
+	if _, err := p.spool.WriteAt(data, p.size); err != nil {
+		return fmt.Errorf("failed to spool %s: %w", key, err)
+	}
+
+	p.pending[key] = len(p.entries)
+	p.entries = append(p.entries, PackEntry{Key: key, Offset: p.size, Length: int64(len(data)), Sum: hash.Sum(data).String()})
+	p.size += int64(len(data))
+
+	if p.size >= int64(p.packSize) {
+		return p.flushLocked()
+	}
+	return nil
+}
+
+func (p *Packer) Get(key string) ([]byte, error) {
+	if isNamespaced(key) {
+		return p.backend.Get(key)
+	}
+
+	// Not yet flushed?
+	p.mu.Lock()
+	if i, ok := p.pending[key]; ok {
+		e := p.entries[i]
+		data := make([]byte, e.Length)
+		_, err := p.spool.ReadAt(data, e.Offset)
+		p.mu.Unlock()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s from pack spool: %w", key, err)
+		}
+		return data, nil
+	}
+	p.mu.Unlock()
+
+	pack, e, found, err := p.lookup(key)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		// Legacy loose object
+		return p.backend.Get(key)
+	}
+	return p.readEntry(pack, e)
+}
+
+// verifiedRangeReader is implemented by backends that hold several copies
+// of an object and can fall back to another one when a range fails verify
+type verifiedRangeReader interface {
+	getRangeVerified(key string, offset, length int64, verify func([]byte) error) ([]byte, error)
+}
+
+// readEntry reads a packed object and checks it against its recorded sum
+func (p *Packer) readEntry(pack string, e PackEntry) ([]byte, error) {
+	verify := func(data []byte) error {
+		if hash.Sum(data).String() != e.Sum {
+			return fmt.Errorf("%s in pack %s does not match its checksum", e.Key, pack)
+		}
+		return nil
+	}
+	if vr, ok := p.backend.(verifiedRangeReader); ok {
+		return vr.getRangeVerified(packNamespace+pack, e.Offset, e.Length, verify)
+	}
+
+	data, err := p.readRange(packNamespace+pack, e.Offset, e.Length)
+	if err != nil {
+		return nil, err
+	}
+	if err := verify(data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// readRange reads part of a packfile, falling back to a full read
+func (p *Packer) readRange(key string, offset, length int64) ([]byte, error) {
+	if rr, ok := p.backend.(RangeReader); ok {
+		return rr.GetRange(key, offset, length)
+	}
+
+	data, err := p.backend.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	if offset < 0 || length < 0 || offset+length > int64(len(data)) {
+		return nil, fmt.Errorf("pack %s is truncated", key)
+	}
+	return data[offset : offset+length], nil
+}
+
+// Has answers from the pack index only; it never asks the backend about
+// plain keys, so backups of already-stored data cost no round-trips.
+func (p *Packer) Has(key string) (bool, error) {
+	if isNamespaced(key) {
+		return p.backend.Has(key)
+	}
+
+	p.mu.Lock()
+	_, ok := p.pending[key]
+	p.mu.Unlock()
+	if ok {
+		return true, nil
+	}
+
+	_, _, found, err := p.lookup(key)
+	return found, err
+}
+
+// ExtendRetention extends the retention of the pack holding key, once per
+// pack for the life of the Packer. Keys still spooled get a fresh retention
+// when their pack is written.
+func (p *Packer) ExtendRetention(key string) error {
+	if isNamespaced(key) {
+		return ExtendRetention(p.backend, key)
+	}
+
+	p.mu.Lock()
+	_, spooled := p.pending[key]
+	p.mu.Unlock()
+	if spooled {
+		return nil
+	}
+	pack, _, found, err := p.lookup(key)
+	if err != nil || !found {
+		return err
+	}
+
+	p.mu.Lock()
+	done := p.extended[pack]
+	p.mu.Unlock()
+	if done {
+		return nil
+	}
+	if err := ExtendRetention(p.backend, packNamespace+pack); err != nil {
+		return fmt.Errorf("failed to extend retention of pack %s: %w", pack, err)
+	}
+	p.mu.Lock()
+	p.extended[pack] = true
+	p.mu.Unlock()
+	return nil
+}
+
+// List lists the physical objects of the underlying backend (packs and
+// loose objects), not the individual packed keys.
+func (p *Packer) List(prefix string, fn func(ObjectInfo) error) error {
+	return p.backend.List(prefix, fn)
+}
+
+// Delete forgets a packed key and removes any loose copy.
+// The bytes stay inside their packfile until the pack is rewritten.
+func (p *Packer) Delete(key string) error {
+	if isNamespaced(key) {
+		return p.backend.Delete(key)
+	}
+
+	p.mu.Lock()
+	if _, ok := p.pending[key]; ok {
+		p.mu.Unlock()
+		return fmt.Errorf("cannot delete %s: not yet flushed", key)
+	}
+	p.mu.Unlock()
+
+	if _, err := p.db.Exec("DELETE FROM pack_entries WHERE key = ?", key); err != nil {
+		return err
+	}
+	return p.backend.Delete(key)
+}
+
+// Replace stores data as the new copy of key, e.g. a chunk rebuilt from
+// parity. The new copy is flushed to a new pack before the pack holding the
+// old one is rewritten without it, so a copy is stored at all times. A pack
+// under retention is left as is; Rebuild prefers the copy that verifies.
+func (p *Packer) Replace(key string, data []byte) error {
+	if isNamespaced(key) {
+		return fmt.Errorf("cannot replace %s: only packed objects can be replaced", key)
+	}
+
+	p.mu.Lock()
+	if _, ok := p.pending[key]; ok {
+		p.mu.Unlock()
+		return fmt.Errorf("cannot replace %s: not yet flushed", key)
+	}
+	oldPack, _, packed, err := p.lookup(key)
+	if err == nil {
+		err = p.addLocked(key, data)
+	}
+	if err == nil {
+		err = p.flushLocked()
+	}
+	p.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if !packed {
+		// A legacy loose copy; the pack index now answers first
+		return p.backend.Delete(key)
+	}
+	if err := p.dropEntry(oldPack, key); err != nil {
+		// The new copy is safe; the old one only costs space
+		fmt.Printf("STALE COPY: %s stays in pack %s - %v\n", key, oldPack, err)
+	}
+	return nil
+}
+
+// dropEntry rewrites pack without key, whose index row already points at a
+// newer copy in another pack
+func (p *Packer) dropEntry(pack, key string) error {
+	var size int64 = -1
+	err := p.backend.List(packNamespace+pack, func(obj ObjectInfo) error {
+		if obj.Key == packNamespace+pack {
+			size = obj.Size
+		}
+		return nil
+	})
+	if err != nil || size < 0 {
+		return err // Already gone
+	}
+
+	until, err := RetainedUntil(p.backend, packNamespace+pack)
+	if err != nil {
+		return fmt.Errorf("failed to check retention of pack %s: %w", pack, err)
+	}
+	if until.After(time.Now()) {
+		return nil
+	}
+	if ok, err := p.accountedFor(pack, size); err != nil || !ok {
+		return err // Holds objects the index does not know; keep it
+	}
+
+	entries, err := p.packEntries()
+	if err != nil {
+		return err
+	}
+	if err := p.repack(pack, entries[pack], nil); err != nil {
+		return err
+	}
+	return p.dropPacks([]string{pack})
+}
+
+// Flush writes the pending objects as a packfile
+func (p *Packer) Flush() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.flushLocked()
+}
+
+func (p *Packer) flushLocked() error {
+	if len(p.entries) == 0 {
+		return nil
+	}
+
+	header, err := json.Marshal(packHeader{Entries: p.entries})
+	if err != nil {
+		return err
+	}
+
+	trailer := binary.LittleEndian.AppendUint32(header, uint32(len(header)))
+	if _, err := p.spool.WriteAt(trailer, p.size); err != nil {
+		return fmt.Errorf("failed to spool pack header: %w", err)
+	}
+	total := p.size + int64(len(trailer))
+
+	sum, err := hash.SumReader(io.NewSectionReader(p.spool, 0, total))
+	if err != nil {
+		return err
+	}
+	packID := sum.String()
+	if err := StreamPut(p.backend, packNamespace+packID, io.NewSectionReader(p.spool, 0, total), total); err != nil {
+		return fmt.Errorf("failed to write pack %s: %w", packID, err)
+	}
+
+	// Only index once the pack is safely in the backend
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, e := range p.entries {
+		if _, err := tx.Exec(
+			"INSERT OR REPLACE INTO pack_entries (key, pack, offset, length, sum) VALUES (?, ?, ?, ?, ?)",
+			e.Key, packID, e.Offset, e.Length, e.Sum,
+		); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	p.written = append(p.written, packID)
+	p.entries = nil
+	p.pending = make(map[string]int)
+	return p.dropSpool()
+}
+
+// dropSpool removes the spool file of the pack being built
+func (p *Packer) dropSpool() error {
+	if p.spool == nil {
+		return nil
+	}
+	name := p.spool.Name()
+	err := p.spool.Close()
+	if rerr := os.Remove(name); err == nil {
+		err = rerr
+	}
+	p.spool, p.size = nil, 0
+	return err
+}
+
+// Rebuild repopulates the pack index from the headers of the packs in the
+// backend that it does not know yet, and forgets the packs that are gone
+// (pruned by another host), so Has no longer reports their objects as
+// stored. It returns the number of packs in the backend.
+func (p *Packer) Rebuild() (int, error) {
+	type pack struct {
+		id   string
+		size int64
+	}
+	var packs []pack
+	err := p.backend.List(packNamespace, func(obj ObjectInfo) error {
+		packs = append(packs, pack{strings.TrimPrefix(obj.Key, packNamespace), obj.Size})
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// Entries of a pack are added in one transaction, so known packs are complete
+	known := make(map[string]bool)
+	rows, err := p.db.Query("SELECT DISTINCT pack FROM pack_entries")
+	if err != nil {
+		return 0, err
+	}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		known[id] = true
+	}
+	rows.Close()
+
+	listed := make(map[string]bool, len(packs))
+	for _, pk := range packs {
+		listed[pk.id] = true
+	}
+	for id := range known {
+		if listed[id] {
+			continue
+		}
+		if _, err := p.db.Exec("DELETE FROM pack_entries WHERE pack = ?", id); err != nil {
+			return 0, err
+		}
+	}
+
+	for _, pk := range packs {
+		if known[pk.id] {
+			continue
+		}
+
+		entries, err := p.readHeader(pk.id, pk.size)
+		if err != nil {
+			return 0, fmt.Errorf("pack %s: %w", pk.id, err)
+		}
+		if entries, err = p.preferIndexed(pk.id, entries); err != nil {
+			return 0, err
+		}
+
+		tx, err := p.db.Begin()
+		if err != nil {
+			return 0, err
+		}
+		for _, e := range entries {
+			if _, err := tx.Exec(
+				"INSERT OR REPLACE INTO pack_entries (key, pack, offset, length, sum) VALUES (?, ?, ?, ?, ?)",
+				e.Key, pk.id, e.Offset, e.Length, e.Sum,
+			); err != nil {
+				tx.Rollback()
+				return 0, err
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			return 0, err
+		}
+	}
+	return len(packs), nil
+}
+
+// preferIndexed drops the entries of pack whose key is already indexed in
+// another pack with a copy that verifies. A key can be in two packs after
+// Replace (if the old pack could not be rewritten yet) or an interrupted
+// repack; whichever order packs are listed in, the intact copy wins.
+func (p *Packer) preferIndexed(pack string, entries []PackEntry) ([]PackEntry, error) {
+	kept := entries[:0:0]
+	for _, e := range entries {
+		other, existing, found, err := p.lookup(e.Key)
+		if err != nil {
+			return nil, err
+		}
+		if found && other != pack {
+			if _, err := p.readEntry(other, existing); err == nil {
+				continue
+			}
+		}
+		kept = append(kept, e)
+	}
+	return kept, nil
+}
+
+// readHeader reads the entry list stored at the end of a pack
+func (p *Packer) readHeader(packID string, size int64) ([]PackEntry, error) {
+	if size < 4 {
+		return nil, fmt.Errorf("pack too short")
+	}
+	tail, err := p.readRange(packNamespace+packID, size-4, 4)
+	if err != nil {
+		return nil, err
+	}
+	n := int64(binary.LittleEndian.Uint32(tail))
+	if n > size-4 {
+		return nil, fmt.Errorf("corrupt pack header length")
+	}
+
+	raw, err := p.readRange(packNamespace+packID, size-4-n, n)
+	if err != nil {
+		return nil, err
+	}
+	var header packHeader
+	if err := json.Unmarshal(raw, &header); err != nil {
+		return nil, fmt.Errorf("corrupt pack header: %w", err)
+	}
+	return header.Entries, nil
+}
+
+// PruneStats summarizes a pack garbage collection pass
+type PruneStats struct {
+	Packs            int
+	DeletedPacks     int
+	RewrittenPacks   int
+	RetainedPacks    int       // packs with dead objects left alone while under retention
+	RetainedUntil    time.Time // latest retention date of those
+	UnindexedPacks   int       // packs left alone because they hold objects the index does not know
+	ReclaimableBytes int64
+}
+
+// Prune drops packed objects for which keep returns false.
+// Packs without live objects are deleted, partially used packs are rewritten
+// with only their live objects. Packs under retention are left for a later
+// prune, and so are packs whose header lists objects the pack index does
+// not know (e.g. written by another host since the index was rebuilt).
+// With dryRun nothing is changed.
+func (p *Packer) Prune(keep func(key string) bool, dryRun bool) (PruneStats, error) {
+	var stats PruneStats
+	if err := p.Flush(); err != nil {
+		return stats, err
+	}
+	// Index packs written by other hosts, or lost with a local pack index
+	if _, err := p.Rebuild(); err != nil {
+		return stats, fmt.Errorf("failed to rebuild pack index: %w", err)
+	}
+
+	sizes := make(map[string]int64)
+	err := p.backend.List(packNamespace, func(obj ObjectInfo) error {
+		sizes[strings.TrimPrefix(obj.Key, packNamespace)] = obj.Size
+		return nil
+	})
+	if err != nil {
+		return stats, err
+	}
+
+	entries, err := p.packEntries()
+	if err != nil {
+		return stats, err
+	}
+
+	now := time.Now()
+	var obsolete []string
+	for pack, size := range sizes {
+		stats.Packs++
+
+		var live []PackEntry
+		var dead int64
+		for _, e := range entries[pack] {
+			if keep(e.Key) {
+				live = append(live, e)
+			} else {
+				dead += e.Length
+			}
+		}
+
+		if len(live) > 0 && len(live) == len(entries[pack]) {
+			continue
+		}
+		if ok, err := p.accountedFor(pack, size); err != nil {
+			return stats, err
+		} else if !ok {
+			stats.UnindexedPacks++
+			continue
+		}
+		until, err := RetainedUntil(p.backend, packNamespace+pack)
+		if err != nil {
+			return stats, fmt.Errorf("failed to check retention of pack %s: %w", pack, err)
+		}
+		if until.After(now) {
+			// Deleting would only hide it, and a rewrite would store its
+			// live objects twice
+			stats.RetainedPacks++
+			if until.After(stats.RetainedUntil) {
+				stats.RetainedUntil = until
+			}
+			continue
+		}
+
+		switch {
+		case len(live) == 0:
+			stats.DeletedPacks++
+			stats.ReclaimableBytes += size
+		default:
+			stats.RewrittenPacks++
+			stats.ReclaimableBytes += dead
+			if !dryRun {
+				if err := p.repack(pack, live, nil); err != nil {
+					return stats, err
+				}
+			}
+		}
+		obsolete = append(obsolete, pack)
+	}
+
+	if dryRun {
+		return stats, nil
+	}
+	return stats, p.dropPacks(obsolete)
+}
+
+// accountedFor reports whether every object listed in the header of pack is
+// in the pack index, so dropping the pack cannot lose an object the index
+// has never seen. A pack with an unreadable header is never accounted for.
+func (p *Packer) accountedFor(pack string, size int64) (bool, error) {
+	entries, err := p.readHeader(pack, size)
+	if err != nil {
+		return false, nil
+	}
+	for _, e := range entries {
+		if _, _, found, err := p.lookup(e.Key); err != nil || !found {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// ListPacks returns the ids of the packs stored in the backend
+func (p *Packer) ListPacks() ([]string, error) {
+	var packs []string
+	err := p.backend.List(packNamespace, func(obj ObjectInfo) error {
+		packs = append(packs, strings.TrimPrefix(obj.Key, packNamespace))
+		return nil
+	})
+	return packs, err
+}
+
+// RewritePacks moves every indexed object of the given packs into new packs,
+// passing it through transform (e.g. re-encryption). The old packs are
+// deleted only after the new ones are flushed, so an interrupted rewrite
+// can simply be repeated.
+func (p *Packer) RewritePacks(packs []string, transform func(key string, data []byte) ([]byte, error)) error {
+	if err := p.Flush(); err != nil {
+		return err
+	}
+
+	entries, err := p.packEntries()
+	if err != nil {
+		return err
+	}
+	for _, pack := range packs {
+		if err := p.repack(pack, entries[pack], transform); err != nil {
+			return err
+		}
+	}
+	return p.dropPacks(packs)
+}
+
+// dropPacks deletes packs once their live objects are safely in new packs.
+// Packs are named by their content, so a pack rewritten unchanged (e.g. by
+// a transform that keeps every object) is its own new pack and is kept.
+func (p *Packer) dropPacks(packs []string) error {
+	if err := p.Flush(); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	written := p.written
+	p.written = nil
+	p.mu.Unlock()
+
+	for _, pack := range packs {
+		if slices.Contains(written, pack) {
+			continue
+		}
+		if _, err := p.db.Exec("DELETE FROM pack_entries WHERE pack = ?", pack); err != nil {
+			return err
+		}
+		if err := p.backend.Delete(packNamespace + pack); err != nil {
+			return fmt.Errorf("failed to delete pack %s: %w", pack, err)
+		}
+	}
+	return nil
+}
+
+// packEntries returns the pack index grouped by pack
+func (p *Packer) packEntries() (map[string][]PackEntry, error) {
+	rows, err := p.db.Query("SELECT pack, key, offset, length, sum FROM pack_entries")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := make(map[string][]PackEntry)
+	for rows.Next() {
+		var pack string
+		var e PackEntry
+		if err := rows.Scan(&pack, &e.Key, &e.Offset, &e.Length, &e.Sum); err != nil {
+			return nil, err
+		}
+		entries[pack] = append(entries[pack], e)
+	}
+	return entries, rows.Err()
+}
+
+// repack copies the live objects of pack into the pack being built,
+// optionally through transform. Flushing re-points their index rows at the new pack.
+func (p *Packer) repack(pack string, live []PackEntry, transform func(key string, data []byte) ([]byte, error)) error {
+	for _, e := range live {
+		data, err := p.readEntry(pack, e)
+		if err != nil {
+			return fmt.Errorf("failed to read %s from pack %s: %w", e.Key, pack, err)
+		}
+		if transform != nil {
+			if data, err = transform(e.Key, data); err != nil {
+				return fmt.Errorf("%s in pack %s: %w", e.Key, pack, err)
+			}
+		}
+
+		p.mu.Lock()
+		err = p.addLocked(e.Key, data)
+		p.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close flushes pending objects and closes the pack index.
+// The underlying backend is owned by the caller and left open.
+func (p *Packer) Close() error {
+	if err := p.Flush(); err != nil {
+		p.mu.Lock()
+		p.dropSpool()
+		p.mu.Unlock()
+		p.db.Close()
+		return err
+	}
+	return p.db.Close()
+}
@@ -0,0 +1,368 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/klauspost/reedsolomon"
+	"github.com/pranavdwivedi/aegis/pkg/hash"
+)
+
+// ParityNamespace holds the headers of parity groups: which chunks a group
+// covers and how its shards are laid out. They are small, so listing groups
+// never downloads parity data.
+const ParityNamespace = "parity/"
+
+// ParityDataNamespace holds the Reed-Solomon parity shards of each group,
+// under the same id as its header
+const ParityDataNamespace = "paritydata/"
+
+// ParityParams sets how many chunks form a parity group and how many parity
+// shards protect it. Up to ParityShards chunks of a group can be rebuilt.
+type ParityParams struct {
+	DataShards   int
+	ParityShards int
+}
+
+// DefaultParityParams protect every 10 chunks with 2 parity shards (20% overhead)
+var DefaultParityParams = ParityParams{DataShards: 10, ParityShards: 2}
+
+// Validate rejects unusable parity parameters
+func (p ParityParams) Validate() error {
+	if p.DataShards < 1 || p.ParityShards < 1 {
+		return fmt.Errorf("invalid parity params: need at least 1 data and 1 parity shard")
+	}
+	if p.DataShards+p.ParityShards > 256 {
+		return fmt.Errorf("invalid parity params: at most 256 shards per group")
+	}
+	return nil
+}
+
+// ParityGroup is the header of a parity group. Parity is computed over the
+// plaintext of its chunks, each zero-padded to ShardSize, so it stays valid
+// when chunks are re-encrypted (key rotation) or moved between packs.
+type ParityGroup struct {
+	ID           string        `json:"-"`
+	ParityShards int           `json:"parity_shards"`
+	ShardSize    int           `json:"shard_size"`
+	Chunks       []ParityChunk `json:"chunks"`
+}
+
+// ParityChunk is one data shard of a parity group
+type ParityChunk struct {
+	ID   string `json:"id"`
+	Size int    `json:"size"`
+}
+
+// parityWriter collects the chunks stored by a backup into groups
+type parityWriter struct {
+	params ParityParams
+	ids    []hash.Hash
+	data   [][]byte
+}
+
+// EnableParity makes the store write a parity group for every
+// p.DataShards new chunks. Call FlushParity once the backup is done.
+func (s *ContentAddressableStore) EnableParity(p ParityParams) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	s.parity = &parityWriter{params: p}
+	return nil
+}
+
+// addParity queues a newly stored chunk, writing the group once full
+func (s *ContentAddressableStore) addParity(h hash.Hash, data []byte) error {
+	w := s.parity
+	w.ids = append(w.ids, h)
+	w.data = append(w.data, append([]byte(nil), data...)) // chunkers may reuse buffers
+	if len(w.ids) < w.params.DataShards {
+		return nil
+	}
+	return s.FlushParity()
+}
+
+// FlushParity writes the parity group of the chunks queued so far, which
+// may be fewer than DataShards
+func (s *ContentAddressableStore) FlushParity() error {
+	w := s.parity
+	if w == nil || len(w.ids) == 0 {
+		return nil
+	}
+	if _, err := s.putParity(w.ids, w.data, w.params.ParityShards); err != nil {
+		return err
+	}
+	w.ids, w.data = nil, nil
+	return nil
+}
+
+// putParity computes and stores a parity group over the given chunks.
+// It returns the group, whose ID is empty if there was nothing to protect.
+func (s *ContentAddressableStore) putParity(ids []hash.Hash, data [][]byte, parityShards int) (ParityGroup, error) {
+	g := ParityGroup{ParityShards: parityShards}
+	var names strings.Builder
+	for i, h := range ids {
+		g.Chunks = append(g.Chunks, ParityChunk{ID: h.String(), Size: len(data[i])})
+		g.ShardSize = max(g.ShardSize, len(data[i]))
+		names.WriteString(h.String())
+	}
+	if g.ShardSize == 0 {
+		return ParityGroup{}, nil // Only empty chunks, nothing to protect
+	}
+	g.ID = hash.Sum([]byte(names.String())).String()
+
+	shards := make([][]byte, len(ids)+g.ParityShards)
+	for i, d := range data {
+		shards[i] = make([]byte, g.ShardSize)
+		copy(shards[i], d)
+	}
+	for i := len(ids); i < len(shards); i++ {
+		shards[i] = make([]byte, g.ShardSize)
+	}
+	enc, err := reedsolomon.New(len(ids), g.ParityShards)
+	if err != nil {
+		return g, err
+	}
+	if err := enc.Encode(shards); err != nil {
+		return g, fmt.Errorf("parity encoding failed: %w", err)
+	}
+
+	// Shards first: a header is only ever listed once its parity is stored
+	parity := make([]byte, 0, g.ParityShards*g.ShardSize)
+	for _, p := range shards[len(ids):] {
+		parity = append(parity, p...)
+	}
+	if err := s.PutMetadata(ParityDataNamespace+g.ID, parity); err != nil {
+		return g, fmt.Errorf("failed to store parity: %w", err)
+	}
+	if err := s.putParityGroup(g); err != nil {
+		return g, err
+	}
+	return g, nil
+}
+
+// RecomputeParity replaces group g by a group over only the chunks for
+// which keep returns true, e.g. before prune deletes the others: without
+// their shards the old group would tolerate fewer damaged chunks. It
+// returns false and leaves g alone if a kept chunk cannot be read, since g
+// may be needed to heal it.
+func (s *ContentAddressableStore) RecomputeParity(g ParityGroup, keep func(id string) bool) (bool, error) {
+	var ids []hash.Hash
+	var data [][]byte
+	for _, c := range g.Chunks {
+		if !keep(c.ID) {
+			continue
+		}
+		h, err := hash.Parse(c.ID)
+		if err != nil {
+			return false, nil
+		}
+		d, err := s.Get(h)
+		if err != nil {
+			return false, nil
+		}
+		ids = append(ids, h)
+		data = append(data, d)
+	}
+
+	if len(ids) > 0 {
+		ng, err := s.putParity(ids, data, g.ParityShards)
+		if err != nil {
+			return false, err
+		}
+		if ng.ID == g.ID {
+			return true, nil // Nothing dropped
+		}
+	}
+	return true, s.DeleteParityGroup(g.ID)
+}
+
+// putParityGroup stores (or replaces) the header of g
+func (s *ContentAddressableStore) putParityGroup(g ParityGroup) error {
+	data, err := json.Marshal(g)
+	if err != nil {
+		return err
+	}
+	if err := s.ReplaceMetadata(ParityNamespace+g.ID, data); err != nil {
+		return fmt.Errorf("failed to store parity group: %w", err)
+	}
+	return nil
+}
+
+// ParityGroups returns the headers of every parity group in the backend.
+// Unreadable headers are reported and skipped; their groups are lost.
+func (s *ContentAddressableStore) ParityGroups() ([]ParityGroup, error) {
+	var ids []string
+	seen := make(map[string]bool)
+	err := s.backend.List(ParityNamespace, func(obj ObjectInfo) error {
+		id := strings.TrimPrefix(MetadataBase(obj.Key), ParityNamespace)
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	groups := make([]ParityGroup, 0, len(ids))
+	for _, id := range ids {
+		g := ParityGroup{ID: id}
+		data, err := s.GetLatestMetadata(ParityNamespace + id)
+		if err == nil {
+			err = json.Unmarshal(data, &g)
+		}
+		if err != nil {
+			fmt.Printf("UNREADABLE PARITY GROUP: %s - %v\n", id, err)
+			continue
+		}
+		groups = append(groups, g)
+	}
+	return groups, nil
+}
+
+// DeleteParityGroup removes a parity group, e.g. once Prune removed all its chunks
+func (s *ContentAddressableStore) DeleteParityGroup(id string) error {
+	if err := s.DeleteMetadata(ParityNamespace + id); err != nil {
+		return err
+	}
+	return s.DeleteMetadata(ParityDataNamespace + id)
+}
+
+// RenameParityChunks updates the chunk ids recorded in parity groups, e.g.
+// after MigrateChunkIDs re-stored chunks under keyed ids. The parity itself
+// covers the plaintext and stays valid.
+func (s *ContentAddressableStore) RenameParityChunks(renames map[string]string) error {
+	groups, err := s.ParityGroups()
+	if err != nil {
+		return err
+	}
+	for _, g := range groups {
+		changed := false
+		for i, c := range g.Chunks {
+			if to, ok := renames[c.ID]; ok {
+				g.Chunks[i].ID = to
+				changed = true
+			}
+		}
+		if !changed {
+			continue
+		}
+		if err := s.putParityGroup(g); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Repair rebuilds damaged chunks from the parity groups that cover them and
+// stores them again through the backend's Replace (a Packer writes them to
+// a new pack and rewrites the old packs without the damaged copies).
+// Chunks that no group covers, or whose group lost more shards than it has
+// parity, are returned as unrecoverable.
+func (s *ContentAddressableStore) Repair(damaged []hash.Hash) (healed, unrecoverable []hash.Hash, err error) {
+	pending := make(map[string]hash.Hash, len(damaged))
+	for _, h := range damaged {
+		pending[h.String()] = h
+	}
+	if len(pending) == 0 {
+		return nil, nil, nil
+	}
+
+	groups, err := s.ParityGroups()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, g := range groups {
+		covered := false
+		for _, c := range g.Chunks {
+			if _, ok := pending[c.ID]; ok {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			continue
+		}
+
+		rebuilt, err := s.reconstructGroup(g)
+		if err != nil {
+			fmt.Printf("PARITY GROUP %s: %v\n", g.ID, err)
+			continue
+		}
+		for i, c := range g.Chunks {
+			h, ok := pending[c.ID]
+			if !ok {
+				continue
+			}
+			data := rebuilt[i][:c.Size]
+			if s.ID(data) != h && hash.Sum(data) != h {
+				fmt.Printf("PARITY GROUP %s: rebuilt chunk %s does not match its id\n", g.ID, c.ID)
+				continue
+			}
+			if err := s.restore(h, data); err != nil {
+				return healed, nil, err
+			}
+			healed = append(healed, h)
+			delete(pending, c.ID)
+		}
+	}
+
+	for _, h := range pending {
+		unrecoverable = append(unrecoverable, h)
+	}
+	return healed, unrecoverable, nil
+}
+
+// reconstructGroup reads what is left of a parity group and rebuilds its data shards
+func (s *ContentAddressableStore) reconstructGroup(g ParityGroup) ([][]byte, error) {
+	if g.ParityShards < 1 || g.ShardSize < 0 || len(g.Chunks)+g.ParityShards > 256 {
+		return nil, fmt.Errorf("corrupt parity group")
+	}
+
+	shards := make([][]byte, len(g.Chunks)+g.ParityShards)
+	for i, c := range g.Chunks {
+		h, err := hash.Parse(c.ID)
+		if err != nil {
+			continue
+		}
+		data, err := s.Get(h)
+		if err != nil || len(data) != c.Size || c.Size > g.ShardSize {
+			continue // Damaged too: one more erasure
+		}
+		shards[i] = make([]byte, g.ShardSize)
+		copy(shards[i], data)
+	}
+
+	parity, err := s.GetLatestMetadata(ParityDataNamespace + g.ID)
+	if err == nil && len(parity) == g.ParityShards*g.ShardSize {
+		for i := range g.ParityShards {
+			shards[len(g.Chunks)+i] = parity[i*g.ShardSize : (i+1)*g.ShardSize]
+		}
+	}
+
+	enc, err := reedsolomon.New(len(g.Chunks), g.ParityShards)
+	if err != nil {
+		return nil, err
+	}
+	if err := enc.ReconstructData(shards); err != nil {
+		return nil, fmt.Errorf("too many damaged shards: %w", err)
+	}
+	return shards, nil
+}
+
+// restore replaces the stored copy of a chunk with data
+func (s *ContentAddressableStore) restore(h hash.Hash, data []byte) error {
+	r, ok := s.backend.(Replacer)
+	if !ok {
+		return fmt.Errorf("cannot replace chunk %s: the backend cannot replace objects (repair through a Packer)", h)
+	}
+	key := h.String()
+	encrypted, err := s.seal(key, data)
+	if err != nil {
+		return err
+	}
+	return r.Replace(key, encrypted)
+}
@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"bytes"
+	"math/rand"
+	"path/filepath"
+	"testing"
+
+	"github.com/pranavdwivedi/aegis/pkg/crypto"
+	"github.com/pranavdwivedi/aegis/pkg/hash"
+)
+
+// newTestStore returns a store packing into a local backend
+func newTestStore(t *testing.T) (*ContentAddressableStore, *Packer, Backend) {
+	t.Helper()
+	dir := t.TempDir()
+	backend, err := NewLocalBackend(filepath.Join(dir, "backend"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	packer, err := NewPacker(backend, filepath.Join(dir, PackIndexName), DefaultPackSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { packer.Close() })
+	key, err := crypto.NewMasterKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewContentAddressableStore(packer, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store, packer, backend
+}
+
+// corrupt flips a byte of the stored copy of a packed chunk
+func corrupt(t *testing.T, packer *Packer, backend Backend, h hash.Hash) {
+	t.Helper()
+	pack, e, found, err := packer.lookup(h.String())
+	if err != nil || !found {
+		t.Fatalf("chunk %s is not packed (%v)", h, err)
+	}
+	data, err := backend.Get(packNamespace + pack)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[e.Offset+e.Length/2] ^= 0xff
+	if err := backend.Delete(packNamespace + pack); err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.Put(packNamespace+pack, data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParityRepair(t *testing.T) {
+	store, packer, backend := newTestStore(t)
+	params := ParityParams{DataShards: 5, ParityShards: 2}
+	if err := store.EnableParity(params); err != nil {
+		t.Fatal(err)
+	}
+
+	// Two groups of chunks of different sizes
+	rng := rand.New(rand.NewSource(1))
+	var ids []hash.Hash
+	chunks := map[hash.Hash][]byte{}
+	for i := range 2 * params.DataShards {
+		data := make([]byte, 1000+i*397)
+		rng.Read(data)
+		h, err := store.Put(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, h)
+		chunks[h] = data
+	}
+	if err := store.FlushParity(); err != nil {
+		t.Fatal(err)
+	}
+	if err := packer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	groups, err := store.ParityGroups()
+	if err != nil || len(groups) != 2 {
+		t.Fatalf("parity groups %v, %v; want two", groups, err)
+	}
+
+	// Up to ParityShards damaged chunks of a group are rebuilt
+	damaged := []hash.Hash{ids[0], ids[3]}
+	for _, h := range damaged {
+		corrupt(t, packer, backend, h)
+		if _, err := store.Get(h); err == nil {
+			t.Fatal("test setup: a corrupt chunk read back fine")
+		}
+	}
+	healed, unrecoverable, err := store.Repair(damaged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(healed) != 2 || len(unrecoverable) != 0 {
+		t.Fatalf("healed %v, unrecoverable %v", healed, unrecoverable)
+	}
+	for _, h := range ids {
+		if got, err := store.Get(h); err != nil || !bytes.Equal(got, chunks[h]) {
+			t.Errorf("chunk %s after repair: %v", h, err)
+		}
+	}
+
+	// One more than that is beyond repair
+	damaged = []hash.Hash{ids[5], ids[6], ids[9]}
+	for _, h := range damaged {
+		corrupt(t, packer, backend, h)
+	}
+	healed, unrecoverable, err = store.Repair(damaged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(healed) != 0 || len(unrecoverable) != 3 {
+		t.Errorf("healed %v, unrecoverable %v; want the three chunks of the second group unrecoverable", healed, unrecoverable)
+	}
+	if got, err := store.Get(ids[7]); err != nil || !bytes.Equal(got, chunks[ids[7]]) {
+		t.Errorf("intact chunk of the group after a failed repair: %v", err)
+	}
+}
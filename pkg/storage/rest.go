@@ -0,0 +1,242 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// ErrAppendOnly is returned when an append-only REST server refuses to
+// delete or overwrite an object
+var ErrAppendOnly = errors.New("refused by append-only server")
+
+// RESTListEntry is one line of a REST listing. The last line has Done or
+// Error set instead of a key.
+type RESTListEntry struct {
+	Key   string `json:"key,omitempty"`
+	Size  int64  `json:"size,omitempty"`
+	Done  bool   `json:"done,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// restStatusError is an unexpected response status
+type restStatusError struct {
+	method, key string
+	status      int
+	text        string
+}
+
+func (e *restStatusError) Error() string {
+	return fmt.Sprintf("rest: %s %s: %s", e.method, e.key, e.text)
+}
+
+// Retryable reports whether the server may succeed later (overloaded or
+// failing, rather than rejecting the request)
+func (e *restStatusError) Retryable() bool {
+	return e.status == http.StatusTooManyRequests || e.status >= 500
+}
+
+// RESTBackend implements Backend against an `aegis serve` server
+// (see docs/REST.md)
+type RESTBackend struct {
+	baseURL string
+	token   string
+	client  *http.Client
+	ctx     context.Context // set by WithContext
+}
+
+// NewRESTBackend connects to the server at baseURL with a client token
+func NewRESTBackend(baseURL, token string) (*RESTBackend, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid REST server url %q", baseURL)
+	}
+	if token == "" {
+		return nil, fmt.Errorf("rest: a client token is required")
+	}
+	r := &RESTBackend{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		token:   token,
+		client:  &http.Client{Timeout: 10 * time.Minute},
+	}
+
+	// Fail early on a wrong url or token
+	if _, err := r.Has(ConfigKey); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// WithContext returns a view of the backend whose requests are cancelled
+// with ctx
+func (r *RESTBackend) WithContext(ctx context.Context) Backend {
+	c := *r
+	c.ctx = ctx
+	return &c
+}
+
+// context returns the context requests are made with
+func (r *RESTBackend) context() context.Context {
+	if r.ctx != nil {
+		return r.ctx
+	}
+	return context.Background()
+}
+
+func (r *RESTBackend) objectURL(key string) string {
+	return r.baseURL + "/v1/objects/" + key
+}
+
+// do sends a request and turns error statuses into errors. The caller
+// closes the body of a successful response.
+func (r *RESTBackend) do(method, key string, target string, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(r.context(), method, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	return r.send(req, key)
+}
+
+// send is do for a prepared request
+func (r *RESTBackend) send(req *http.Request, key string) (*http.Response, error) {
+	method := req.Method
+	req.Header.Set("Authorization", "Bearer "+r.token)
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 300 {
+		return resp, nil
+	}
+
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	text := strings.TrimSpace(string(msg))
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return nil, fmt.Errorf("rest: %s: %w", key, os.ErrNotExist)
+	case http.StatusForbidden:
+		return nil, fmt.Errorf("rest: %s %s: %w", method, key, ErrAppendOnly)
+	case http.StatusUnauthorized:
+		return nil, fmt.Errorf("rest: server rejected the client token")
+	default:
+		return nil, &restStatusError{method: method, key: key, status: resp.StatusCode, text: resp.Status + ": " + text}
+	}
+}
+
+func (r *RESTBackend) Put(key string, data []byte) error {
+	return r.PutReader(key, bytes.NewReader(data), int64(len(data)))
+}
+
+// PutReader sends r as the request body without buffering it
+func (r *RESTBackend) PutReader(key string, body io.Reader, size int64) error {
+	req, err := http.NewRequestWithContext(r.context(), http.MethodPut, r.objectURL(key), body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	resp, err := r.send(req, key)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (r *RESTBackend) Get(key string) ([]byte, error) {
+	resp, err := r.do(http.MethodGet, key, r.objectURL(key), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+// GetReader streams an object. The reader must be closed.
+func (r *RESTBackend) GetReader(key string) (io.ReadCloser, error) {
+	resp, err := r.do(http.MethodGet, key, r.objectURL(key), nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (r *RESTBackend) GetRange(key string, offset, length int64) ([]byte, error) {
+	header := http.Header{}
+	header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	resp, err := r.do(http.MethodGet, key, r.objectURL(key), header)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		return nil, fmt.Errorf("rest: server ignored the range request for %s", key)
+	}
+
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(resp.Body, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func (r *RESTBackend) Has(key string) (bool, error) {
+	resp, err := r.do(http.MethodHead, key, r.objectURL(key), nil)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	return true, nil
+}
+
+func (r *RESTBackend) List(prefix string, fn func(ObjectInfo) error) error {
+	resp, err := r.do(http.MethodGet, prefix, r.baseURL+"/v1/objects?prefix="+url.QueryEscape(prefix), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var e RESTListEntry
+		if err := dec.Decode(&e); err != nil {
+			return fmt.Errorf("rest: listing of %q cut short: %w", prefix, err)
+		}
+		switch {
+		case e.Error != "":
+			return fmt.Errorf("rest: listing of %q failed: %s", prefix, e.Error)
+		case e.Done:
+			return nil
+		}
+		if err := fn(ObjectInfo{Key: e.Key, Size: e.Size}); err != nil {
+			return err
+		}
+	}
+}
+
+func (r *RESTBackend) Delete(key string) error {
+	resp, err := r.do(http.MethodDelete, key, r.objectURL(key), nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (r *RESTBackend) Close() error {
+	r.client.CloseIdleConnections()
+	return nil
+}
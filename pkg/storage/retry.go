@@ -0,0 +1,381 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/pkg/sftp"
+)
+
+// RetryOptions configures a RetryBackend. Zero values pick the defaults
+// or disable a limit.
+type RetryOptions struct {
+	MaxRetries int           // retries after the first attempt (default 5, -1 for none)
+	BaseDelay  time.Duration // first backoff (default 500ms), doubled per retry
+	MaxDelay   time.Duration // backoff cap (default 30s)
+
+	UploadLimit   int64 // bytes per second, 0 for unlimited
+	DownloadLimit int64 // bytes per second, 0 for unlimited
+	MaxConcurrent int   // requests in flight at once, 0 for unlimited
+}
+
+// RetryBackend wraps a Backend with retries of transient failures
+// (exponential backoff with full jitter), bandwidth limits and a cap on
+// concurrent requests. All waiting, and the requests themselves if the
+// backend is a ContextBinder, stop once its context is cancelled.
+type RetryBackend struct {
+	ctx     context.Context
+	backend Backend
+	opts    RetryOptions
+
+	slots    chan struct{} // nil when concurrency is unlimited
+	upload   *bandwidth
+	download *bandwidth
+}
+
+// NewRetryBackend wraps backend. Cancelling ctx aborts its operations.
+func NewRetryBackend(ctx context.Context, backend Backend, opts RetryOptions) *RetryBackend {
+	if opts.MaxRetries == 0 {
+		opts.MaxRetries = 5
+	}
+	if opts.BaseDelay <= 0 {
+		opts.BaseDelay = 500 * time.Millisecond
+	}
+	if opts.MaxDelay <= 0 {
+		opts.MaxDelay = 30 * time.Second
+	}
+	if cb, ok := backend.(ContextBinder); ok {
+		backend = cb.WithContext(ctx)
+	}
+
+	r := &RetryBackend{
+		ctx:      ctx,
+		backend:  backend,
+		opts:     opts,
+		upload:   newBandwidth(opts.UploadLimit),
+		download: newBandwidth(opts.DownloadLimit),
+	}
+	if opts.MaxConcurrent > 0 {
+		r.slots = make(chan struct{}, opts.MaxConcurrent)
+	}
+	return r
+}
+
+// retryable reports whether err is a transient failure worth retrying
+func retryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		return false
+	}
+
+	var r interface{ Retryable() bool }
+	if errors.As(err, &r) {
+		return r.Retryable()
+	}
+	var s3err minio.ErrorResponse
+	if errors.As(err, &s3err) {
+		switch s3err.Code {
+		case "SlowDown", "RequestTimeout", "InternalError", "ServiceUnavailable":
+			return true
+		}
+		return s3err.StatusCode == http.StatusTooManyRequests || s3err.StatusCode >= 500
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, sftp.ErrSSHFxConnectionLost)
+}
+
+// backoff returns the wait before retry number attempt (from 1): a random
+// duration up to BaseDelay * 2^(attempt-1), capped at MaxDelay
+func (r *RetryBackend) backoff(attempt int) time.Duration {
+	d := r.opts.MaxDelay
+	if attempt < 32 {
+		d = min(r.opts.BaseDelay<<(attempt-1), r.opts.MaxDelay)
+	}
+	return rand.N(d) + 1
+}
+
+// sleep waits for d unless ctx is cancelled first
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// acquire takes a concurrency slot; the returned func gives it back
+func (r *RetryBackend) acquire() (func(), error) {
+	if r.slots == nil {
+		return func() {}, r.ctx.Err()
+	}
+	select {
+	case r.slots <- struct{}{}:
+		return func() { <-r.slots }, nil
+	case <-r.ctx.Done():
+		return nil, r.ctx.Err()
+	}
+}
+
+// do runs op until it succeeds, fails permanently or retries run out
+func (r *RetryBackend) do(name, key string, op func() error) error {
+	for attempt := 0; ; attempt++ {
+		release, err := r.acquire()
+		if err != nil {
+			return err
+		}
+		err = op()
+		release()
+
+		if err == nil || !retryable(err) || attempt >= r.opts.MaxRetries || r.ctx.Err() != nil {
+			if err != nil && r.ctx.Err() != nil {
+				return fmt.Errorf("%s %s: %w", name, key, r.ctx.Err())
+			}
+			return err
+		}
+		wait := r.backoff(attempt + 1)
+		fmt.Printf("RETRY: %s %s failed (%v), attempt %d of %d in %s\n", name, key, err, attempt+2, r.opts.MaxRetries+1, wait.Round(time.Millisecond))
+		if err := sleep(r.ctx, wait); err != nil {
+			return fmt.Errorf("%s %s: %w", name, key, err)
+		}
+	}
+}
+
+func (r *RetryBackend) Put(key string, data []byte) error {
+	return r.do("put", key, func() error {
+		if w, ok := r.backend.(Writer); ok && r.upload != nil {
+			// Stream so the limit paces the upload instead of delaying it
+			return w.PutReader(key, r.upload.reader(r.ctx, bytes.NewReader(data)), int64(len(data)))
+		}
+		if err := r.upload.wait(r.ctx, len(data)); err != nil {
+			return err
+		}
+		return r.backend.Put(key, data)
+	})
+}
+
+// PutReader streams r to the backend. Only seekable readers are retried,
+// from where they started.
+func (r *RetryBackend) PutReader(key string, rd io.Reader, size int64) error {
+	seeker, _ := rd.(io.Seeker)
+	var start int64
+	if seeker != nil {
+		var err error
+		if start, err = seeker.Seek(0, io.SeekCurrent); err != nil {
+			seeker = nil
+		}
+	}
+
+	attempts := 0
+	return r.do("put", key, func() error {
+		if attempts++; attempts > 1 {
+			if seeker == nil {
+				return fmt.Errorf("cannot retry upload of %s from a stream", key)
+			}
+			if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+				return err
+			}
+		}
+		return StreamPut(r.backend, key, r.upload.reader(r.ctx, rd), size)
+	})
+}
+
+func (r *RetryBackend) Get(key string) ([]byte, error) {
+	var data []byte
+	err := r.do("get", key, func() error {
+		var err error
+		if data, err = r.backend.Get(key); err != nil {
+			return err
+		}
+		return r.download.wait(r.ctx, len(data))
+	})
+	return data, err
+}
+
+// GetReader opens a stream, retrying the open only. The stream holds a
+// concurrency slot until it is closed.
+func (r *RetryBackend) GetReader(key string) (io.ReadCloser, error) {
+	var rc io.ReadCloser
+	err := r.do("get", key, func() error {
+		var err error
+		rc, err = StreamGet(r.backend, key)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	release, err := r.acquire()
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+	return &throttledReadCloser{Reader: r.download.reader(r.ctx, rc), closer: rc, release: release}, nil
+}
+
+func (r *RetryBackend) GetRange(key string, offset, length int64) ([]byte, error) {
+	var data []byte
+	err := r.do("get", key, func() error {
+		var err error
+		if data, err = replicaRange(r.backend, key, offset, length); err != nil {
+			return err
+		}
+		return r.download.wait(r.ctx, len(data))
+	})
+	return data, err
+}
+
+func (r *RetryBackend) Has(key string) (bool, error) {
+	var exists bool
+	err := r.do("has", key, func() error {
+		var err error
+		exists, err = r.backend.Has(key)
+		return err
+	})
+	return exists, err
+}
+
+// List is retried only until the first object was passed to fn
+func (r *RetryBackend) List(prefix string, fn func(ObjectInfo) error) error {
+	seen := false
+	return r.do("list", prefix, func() error {
+		err := r.backend.List(prefix, func(obj ObjectInfo) error {
+			if err := r.ctx.Err(); err != nil {
+				return err
+			}
+			seen = true
+			return fn(obj)
+		})
+		if err != nil && seen {
+			return errNoRetry{err} // A retry would repeat objects fn has seen
+		}
+		return err
+	})
+}
+
+// errNoRetry stops do from retrying an otherwise retryable error
+type errNoRetry struct{ err error }
+
+func (e errNoRetry) Error() string   { return e.err.Error() }
+func (e errNoRetry) Unwrap() error   { return e.err }
+func (e errNoRetry) Retryable() bool { return false }
+
+func (r *RetryBackend) RetainedUntil(key string) (time.Time, error) {
+	var until time.Time
+	err := r.do("retention", key, func() error {
+		var err error
+		until, err = RetainedUntil(r.backend, key)
+		return err
+	})
+	return until, err
+}
+
+func (r *RetryBackend) ExtendRetention(key string) error {
+	return r.do("extend retention", key, func() error { return ExtendRetention(r.backend, key) })
+}
+
+func (r *RetryBackend) Delete(key string) error {
+	return r.do("delete", key, func() error { return r.backend.Delete(key) })
+}
+
+func (r *RetryBackend) Close() error {
+	return r.backend.Close()
+}
+
+// bandwidth paces transfers to a byte rate shared by every caller. It
+// keeps the time at which the bytes granted so far are paid for.
+type bandwidth struct {
+	rate float64 // bytes per second
+
+	mu   sync.Mutex
+	next time.Time
+}
+
+// newBandwidth returns nil (no limit) for a zero rate
+func newBandwidth(rate int64) *bandwidth {
+	if rate <= 0 {
+		return nil
+	}
+	return &bandwidth{rate: float64(rate)}
+}
+
+// wait blocks until n more bytes fit into the rate
+func (b *bandwidth) wait(ctx context.Context, n int) error {
+	if b == nil || n <= 0 {
+		return nil
+	}
+	b.mu.Lock()
+	now := time.Now()
+	if b.next.Before(now) {
+		b.next = now
+	}
+	delay := b.next.Sub(now)
+	b.next = b.next.Add(time.Duration(float64(n) / b.rate * float64(time.Second)))
+	b.mu.Unlock()
+	return sleep(ctx, delay)
+}
+
+// reader paces reads from rd; it also stops at cancellation
+func (b *bandwidth) reader(ctx context.Context, rd io.Reader) io.Reader {
+	if b == nil {
+		return &ctxReader{ctx: ctx, r: rd}
+	}
+	return &ctxReader{ctx: ctx, r: rd, limit: b}
+}
+
+// ctxReader fails once ctx is cancelled and applies a bandwidth limit
+type ctxReader struct {
+	ctx   context.Context
+	r     io.Reader
+	limit *bandwidth
+}
+
+func (c *ctxReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	if len(p) > 64*1024 && c.limit != nil {
+		p = p[:64*1024] // Small steps keep the pacing smooth
+	}
+	n, err := c.r.Read(p)
+	if werr := c.limit.wait(c.ctx, n); werr != nil {
+		return n, werr
+	}
+	return n, err
+}
+
+// throttledReadCloser closes the underlying stream and gives back its slot
+type throttledReadCloser struct {
+	io.Reader
+	closer  io.Closer
+	release func()
+	once    sync.Once
+}
+
+func (t *throttledReadCloser) Close() error {
+	t.once.Do(t.release)
+	return t.closer.Close()
+}
@@ -0,0 +1,190 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakyBackend fails the next calls of each operation with a transient
+// error, and counts the calls
+type flakyBackend struct {
+	Backend
+
+	mu    sync.Mutex
+	fails map[string]int // operation -> calls left to fail
+	calls map[string]int
+	// listAfter lets List pass this many objects to fn before it fails
+	listAfter int
+}
+
+func newFlakyBackend(t *testing.T) *flakyBackend {
+	t.Helper()
+	local, err := NewLocalBackend(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &flakyBackend{Backend: local, fails: map[string]int{}, calls: map[string]int{}}
+}
+
+// call counts a call of op and fails it if failures are left
+func (b *flakyBackend) call(op string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.calls[op]++
+	if b.fails[op] > 0 {
+		b.fails[op]--
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+func (b *flakyBackend) count(op string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.calls[op]
+}
+
+func (b *flakyBackend) Put(key string, data []byte) error {
+	if err := b.call("put"); err != nil {
+		return err
+	}
+	return b.Backend.Put(key, data)
+}
+
+func (b *flakyBackend) Get(key string) ([]byte, error) {
+	if err := b.call("get"); err != nil {
+		return nil, err
+	}
+	return b.Backend.Get(key)
+}
+
+func (b *flakyBackend) List(prefix string, fn func(ObjectInfo) error) error {
+	failure := b.call("list")
+	passed := 0
+	err := b.Backend.List(prefix, func(obj ObjectInfo) error {
+		if failure != nil && passed == b.listAfter {
+			return failure
+		}
+		passed++
+		return fn(obj)
+	})
+	if err == nil && failure != nil {
+		return failure
+	}
+	return err
+}
+
+func newTestRetry(t *testing.T, ctx context.Context, maxRetries int) (*RetryBackend, *flakyBackend) {
+	t.Helper()
+	flaky := newFlakyBackend(t)
+	return NewRetryBackend(ctx, flaky, RetryOptions{MaxRetries: maxRetries, BaseDelay: time.Millisecond}), flaky
+}
+
+func TestRetryAttempts(t *testing.T) {
+	r, flaky := newTestRetry(t, context.Background(), 3)
+
+	// Transient failures are retried until the operation succeeds
+	flaky.fails["put"] = 2
+	if err := r.Put("aa11", []byte("chunk")); err != nil {
+		t.Fatalf("put after two failures: %v", err)
+	}
+	if n := flaky.count("put"); n != 3 {
+		t.Errorf("put called %d times, want 3", n)
+	}
+
+	// ... and given up after MaxRetries retries
+	flaky.fails["get"] = 10
+	if _, err := r.Get("aa11"); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("get after running out of retries returned %v", err)
+	}
+	if n := flaky.count("get"); n != 4 {
+		t.Errorf("get called %d times, want 4", n)
+	}
+
+	// Permanent failures are not retried
+	flaky.fails["get"] = 0
+	if _, err := r.Get("bb22"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("get of a missing object returned %v", err)
+	}
+	if n := flaky.count("get"); n != 5 {
+		t.Errorf("missing object read %d times, want once", n-4)
+	}
+
+	// No retries at all
+	none, flaky := newTestRetry(t, context.Background(), -1)
+	flaky.fails["put"] = 1
+	if err := none.Put("aa11", []byte("chunk")); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("put without retries returned %v", err)
+	}
+	if n := flaky.count("put"); n != 1 {
+		t.Errorf("put without retries called %d times", n)
+	}
+}
+
+func TestRetryList(t *testing.T) {
+	r, flaky := newTestRetry(t, context.Background(), 3)
+	for _, k := range []string{"aa11", "bb22", "cc33"} {
+		if err := flaky.Backend.Put(k, []byte(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	list := func() ([]string, error) {
+		var keys []string
+		err := r.List("", func(obj ObjectInfo) error {
+			keys = append(keys, obj.Key)
+			return nil
+		})
+		return keys, err
+	}
+
+	// A listing that fails before passing anything on is retried
+	flaky.fails["list"] = 1
+	if keys, err := list(); err != nil || len(keys) != 3 {
+		t.Fatalf("list after a failed start: %v, %v", keys, err)
+	}
+	if n := flaky.count("list"); n != 2 {
+		t.Errorf("list called %d times, want 2", n)
+	}
+
+	// One that fails after fn saw objects is not, or fn would see them twice
+	flaky.fails["list"] = 1
+	flaky.listAfter = 1
+	keys, err := list()
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("list failing midway returned %v", err)
+	}
+	if len(keys) != 1 {
+		t.Errorf("list passed %v, want only the object before the failure", keys)
+	}
+	if n := flaky.count("list"); n != 3 {
+		t.Errorf("list failing midway was retried (%d calls)", n-2)
+	}
+}
+
+func TestRetryCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	r, flaky := newTestRetry(t, ctx, 1000)
+	r.opts.BaseDelay = time.Hour
+	r.opts.MaxDelay = time.Hour
+
+	flaky.fails["put"] = 1000
+	time.AfterFunc(50*time.Millisecond, cancel)
+	done := make(chan error, 1)
+	go func() { done <- r.Put("aa11", []byte("chunk")) }()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("cancelled put returned %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("backoff did not stop at cancellation")
+	}
+	if n := flaky.count("put"); n > 2 {
+		t.Errorf("put called %d times after cancellation", n)
+	}
+}
@@ -3,24 +3,101 @@ package storage
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"io"
+	"net/http"
+	"os"
+	"strings"
 	"time"
 
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
 )
 
+// s3PartSize is the part size of multipart uploads. Uploads of unknown
+// length buffer one part at a time, so this bounds their memory use (and
+// caps such objects at 10000 parts, i.e. 160GB).
+const s3PartSize = 16 * 1024 * 1024
+
+// S3Config describes a bucket to store objects in
+type S3Config struct {
+	Endpoint string // host[:port], e.g. s3.amazonaws.com
+	Bucket   string
+	Region   string // optional; detected from the bucket if empty
+	UseSSL   bool
+
+	// Static credentials. Without them the AWS chain is used: the
+	// AWS_ACCESS_KEY_ID/AWS_SECRET_ACCESS_KEY/AWS_SESSION_TOKEN variables,
+	// then the shared credentials file, then the instance or task role.
+	AccessKey    string
+	SecretKey    string
+	SessionToken string // for temporary STS credentials
+	// CredentialsFile is the shared credentials file (default
+	// AWS_SHARED_CREDENTIALS_FILE or ~/.aws/credentials) and Profile the
+	// profile in it (default AWS_PROFILE or "default")
+	CredentialsFile string
+	Profile         string
+
+	// AddressingStyle is "path" (endpoint/bucket/key, usual for MinIO),
+	// "virtual" (bucket.endpoint/key) or "auto" (the default)
+	AddressingStyle string
+	// CAFile is a PEM bundle trusted in addition to the system roots, for
+	// servers with a private CA
+	CAFile string
+	// Prefix places all objects under prefix/ in the bucket, so several
+	// repositories can share one
+	Prefix string
+
+	// LockMode ("governance" or "compliance") locks every object written
+	// for LockDays with S3 Object Lock. The bucket must have object lock
+	// enabled; it is created with it if it does not exist.
+	LockMode string
+	LockDays int
+}
+
 type S3Backend struct {
 	client     *minio.Client
 	bucketName string
+	prefix     string          // "" or "dir/" prepended to object names
+	ctx        context.Context // set by WithContext
+
+	locking  bool                // the bucket has object lock enabled
+	lockMode minio.RetentionMode // set on every Put unless empty
+	lockDays int
 }
 
-// NewS3Backend creates a new S3 storage backend
-func NewS3Backend(endpoint, accessKey, secretKey, bucket string, useSSL bool) (*S3Backend, error) {
-	minioClient, err := minio.New(endpoint, &minio.Options{
-		Creds:  credentials.NewStaticV4(accessKey, secretKey, ""),
-		Secure: useSSL,
+// NewS3Backend connects to the bucket of cfg, creating it if it does not
+// exist
+func NewS3Backend(cfg S3Config) (*S3Backend, error) {
+	prefix, err := cleanS3Prefix(cfg.Prefix)
+	if err != nil {
+		return nil, err
+	}
+	lookup, err := cfg.bucketLookup()
+	if err != nil {
+		return nil, err
+	}
+	transport, err := cfg.transport()
+	if err != nil {
+		return nil, err
+	}
+	creds, err := cfg.credentials()
+	if err != nil {
+		return nil, err
+	}
+	lockMode, err := cfg.lockMode()
+	if err != nil {
+		return nil, err
+	}
+
+	minioClient, err := minio.New(cfg.Endpoint, &minio.Options{
+		Creds:        creds,
+		Secure:       cfg.UseSSL,
+		Region:       cfg.Region,
+		BucketLookup: lookup,
+		Transport:    transport,
 	})
 	if err != nil {
 		return nil, err
@@ -30,7 +107,7 @@ func NewS3Backend(endpoint, accessKey, secretKey, bucket string, useSSL bool) (*
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	exists, err := minioClient.BucketExists(ctx, bucket)
+	exists, err := minioClient.BucketExists(ctx, cfg.Bucket)
 	if err != nil {
 		return nil, fmt.Errorf("failed to check bucket existence: %w", err)
 	}
@@ -38,41 +115,168 @@ func NewS3Backend(endpoint, accessKey, secretKey, bucket string, useSSL bool) (*
 		// Auto-create? Policy decision due to permissions.
 		// For now, fail if not exists to be safe/explicit.
 		// Or try to create.
-		if err := minioClient.MakeBucket(ctx, bucket, minio.MakeBucketOptions{}); err != nil {
-			return nil, fmt.Errorf("bucket %s does not exist and creation failed: %w", bucket, err)
+		opts := minio.MakeBucketOptions{Region: cfg.Region, ObjectLocking: lockMode != ""}
+		if err := minioClient.MakeBucket(ctx, cfg.Bucket, opts); err != nil {
+			return nil, fmt.Errorf("bucket %s does not exist and creation failed: %w", cfg.Bucket, err)
 		}
 	}
 
+	// Objects may be locked by the bucket's default retention even without
+	// a lock mode, so find out either way
+	lockStatus, _, _, _, err := minioClient.GetObjectLockConfig(ctx, cfg.Bucket)
+	if minio.ToErrorResponse(err).Code == "ObjectLockConfigurationNotFoundError" {
+		err = nil
+	}
+	locking := err == nil && lockStatus == "Enabled"
+	if lockMode != "" && !locking {
+		if err != nil {
+			return nil, fmt.Errorf("s3: failed to check object lock on bucket %s: %w", cfg.Bucket, err)
+		}
+		return nil, fmt.Errorf("s3: bucket %s does not have object lock enabled", cfg.Bucket)
+	}
+
 	return &S3Backend{
 		client:     minioClient,
-		bucketName: bucket,
+		bucketName: cfg.Bucket,
+		prefix:     prefix,
+		locking:    locking,
+		lockMode:   lockMode,
+		lockDays:   cfg.LockDays,
 	}, nil
 }
 
+// lockMode validates the object lock settings of cfg
+func (cfg S3Config) lockMode() (minio.RetentionMode, error) {
+	var mode minio.RetentionMode
+	switch cfg.LockMode {
+	case "":
+		return "", nil
+	case "governance":
+		mode = minio.Governance
+	case "compliance":
+		mode = minio.Compliance
+	default:
+		return "", fmt.Errorf("s3: unknown lock mode %q (want governance or compliance)", cfg.LockMode)
+	}
+	if cfg.LockDays <= 0 {
+		return "", fmt.Errorf("s3: lock mode %s needs a positive number of lock days", cfg.LockMode)
+	}
+	return mode, nil
+}
+
+// credentials returns the static credentials of cfg, or the AWS chain
+func (cfg S3Config) credentials() (*credentials.Credentials, error) {
+	if cfg.AccessKey != "" || cfg.SecretKey != "" {
+		if cfg.AccessKey == "" || cfg.SecretKey == "" {
+			return nil, fmt.Errorf("s3: access key and secret key must be set together")
+		}
+		return credentials.NewStaticV4(cfg.AccessKey, cfg.SecretKey, cfg.SessionToken), nil
+	}
+	return credentials.NewChainCredentials([]credentials.Provider{
+		&credentials.EnvAWS{},
+		&credentials.FileAWSCredentials{Filename: cfg.CredentialsFile, Profile: cfg.Profile},
+		&credentials.IAM{},
+	}), nil
+}
+
+func (cfg S3Config) bucketLookup() (minio.BucketLookupType, error) {
+	switch cfg.AddressingStyle {
+	case "", "auto":
+		return minio.BucketLookupAuto, nil
+	case "path":
+		return minio.BucketLookupPath, nil
+	case "virtual":
+		return minio.BucketLookupDNS, nil
+	default:
+		return 0, fmt.Errorf("s3: unknown addressing style %q (want auto, path or virtual)", cfg.AddressingStyle)
+	}
+}
+
+// transport returns the HTTP transport, trusting CAFile if it is set
+func (cfg S3Config) transport() (*http.Transport, error) {
+	tr, err := minio.DefaultTransport(cfg.UseSSL)
+	if err != nil || cfg.CAFile == "" {
+		return tr, err
+	}
+	pem, err := os.ReadFile(cfg.CAFile)
+	if err != nil {
+		return nil, err
+	}
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		roots = x509.NewCertPool()
+	}
+	if !roots.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("s3: no certificates found in %s", cfg.CAFile)
+	}
+	if tr.TLSClientConfig == nil {
+		tr.TLSClientConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	tr.TLSClientConfig.RootCAs = roots
+	return tr, nil
+}
+
+// cleanS3Prefix normalises a key prefix to "" or "a/b/"
+func cleanS3Prefix(prefix string) (string, error) {
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "" {
+		return "", nil
+	}
+	for _, part := range strings.Split(prefix, "/") {
+		if part == "" || part == "." || part == ".." {
+			return "", fmt.Errorf("s3: invalid prefix %q", prefix)
+		}
+	}
+	return prefix + "/", nil
+}
+
+// WithContext returns a view of the backend whose requests are cancelled
+// with ctx
+func (s *S3Backend) WithContext(ctx context.Context) Backend {
+	c := *s
+	c.ctx = ctx
+	return &c
+}
+
+// context returns the context requests are made with
+func (s *S3Backend) context() context.Context {
+	if s.ctx != nil {
+		return s.ctx
+	}
+	return context.Background()
+}
+
 func (s *S3Backend) objectKey(key string) string {
-	// Use same hierarchy? objects/ab/cdef...
+	// Same hierarchy as LocalBackend: objects/ab/cdef...
 	// Object storage handles flat namespaces well, but hierarchy is good for structure.
-	if len(key) < 2 {
-		return "objects/" + key
-	}
-	return fmt.Sprintf("objects/%s/%s", key[:2], key[2:])
+	return s.prefix + objectName(key)
 }
 
 func (s *S3Backend) Put(key string, data []byte) error {
-	ctx := context.Background()
+	return s.PutReader(key, bytes.NewReader(data), int64(len(data)))
+}
+
+// PutReader uploads r, switching to a multipart upload for objects larger
+// than one part or of unknown size
+func (s *S3Backend) PutReader(key string, r io.Reader, size int64) error {
+	ctx := s.context()
 	objectName := s.objectKey(key)
 
-	// Upload
-	// PutObject takes an io.Reader
-	reader := bytes.NewReader(data)
-	_, err := s.client.PutObject(ctx, s.bucketName, objectName, reader, int64(len(data)), minio.PutObjectOptions{
+	opts := minio.PutObjectOptions{
 		ContentType: "application/octet-stream",
-	})
+		PartSize:    s3PartSize,
+	}
+	if s.lockMode != "" {
+		opts.Mode = s.lockMode
+		opts.RetainUntilDate = time.Now().UTC().AddDate(0, 0, s.lockDays)
+		opts.SendContentMd5 = true // Required with object lock parameters
+	}
+	_, err := s.client.PutObject(ctx, s.bucketName, objectName, r, size, opts)
 	return err
 }
 
 func (s *S3Backend) Get(key string) ([]byte, error) {
-	ctx := context.Background()
+	ctx := s.context()
 	objectName := s.objectKey(key)
 
 	obj, err := s.client.GetObject(ctx, s.bucketName, objectName, minio.GetObjectOptions{})
@@ -85,8 +289,44 @@ func (s *S3Backend) Get(key string) ([]byte, error) {
 	return io.ReadAll(obj)
 }
 
+// GetReader streams an object. The reader must be closed.
+func (s *S3Backend) GetReader(key string) (io.ReadCloser, error) {
+	obj, err := s.client.GetObject(s.context(), s.bucketName, s.objectKey(key), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	// GetObject is lazy; surface a missing object here rather than on the first Read
+	if _, err := obj.Stat(); err != nil {
+		obj.Close()
+		return nil, err
+	}
+	return obj, nil
+}
+
+func (s *S3Backend) GetRange(key string, offset, length int64) ([]byte, error) {
+	ctx := s.context()
+	objectName := s.objectKey(key)
+
+	opts := minio.GetObjectOptions{}
+	if err := opts.SetRange(offset, offset+length-1); err != nil {
+		return nil, err
+	}
+
+	obj, err := s.client.GetObject(ctx, s.bucketName, objectName, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Close()
+
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(obj, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
 func (s *S3Backend) Has(key string) (bool, error) {
-	ctx := context.Background()
+	ctx := s.context()
 	objectName := s.objectKey(key)
 
 	_, err := s.client.StatObject(ctx, s.bucketName, objectName, minio.StatObjectOptions{})
@@ -99,6 +339,107 @@ func (s *S3Backend) Has(key string) (bool, error) {
 	return true, nil
 }
 
+func (s *S3Backend) List(prefix string, fn func(ObjectInfo) error) error {
+	ctx, cancel := context.WithCancel(s.context())
+	defer cancel() // Stops the listing goroutine if fn bails out early
+
+	for obj := range s.client.ListObjects(ctx, s.bucketName, minio.ListObjectsOptions{
+		Prefix:    s.prefix + listRoot(prefix),
+		Recursive: true,
+	}) {
+		if obj.Err != nil {
+			return obj.Err
+		}
+		key, ok := keyFromObjectName(strings.TrimPrefix(obj.Key, s.prefix))
+		if !ok || !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if err := fn(ObjectInfo{Key: key, Size: obj.Size}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RetainedUntil returns the object lock retention date of the current
+// version of key, or the zero time if it has none
+func (s *S3Backend) RetainedUntil(key string) (time.Time, error) {
+	if !s.locking {
+		return time.Time{}, nil
+	}
+	return s.retention(s.objectKey(key), "")
+}
+
+// ExtendRetention locks the current version of key for the lock days from
+// now, as a Put would. Retention is left alone while it is within a tenth
+// of the lock period (at most a day) of that, so a backup reusing a pack
+// does not rewrite its retention on every run.
+func (s *S3Backend) ExtendRetention(key string) error {
+	if s.lockMode == "" {
+		return nil
+	}
+	objectName := s.objectKey(key)
+	until := time.Now().UTC().AddDate(0, 0, s.lockDays)
+	current, err := s.retention(objectName, "")
+	if err != nil {
+		return err
+	}
+	slack := min(time.Duration(s.lockDays)*24*time.Hour/10, 24*time.Hour)
+	if current.After(until.Add(-slack)) {
+		return nil
+	}
+	mode := s.lockMode
+	return s.client.PutObjectRetention(s.context(), s.bucketName, objectName, minio.PutObjectRetentionOptions{
+		Mode:            &mode,
+		RetainUntilDate: &until,
+	})
+}
+
+func (s *S3Backend) retention(objectName, versionID string) (time.Time, error) {
+	_, until, err := s.client.GetObjectRetention(s.context(), s.bucketName, objectName, versionID)
+	if err != nil {
+		switch minio.ToErrorResponse(err).Code {
+		case "NoSuchKey", "NoSuchVersion", "NoSuchObjectLockConfiguration":
+			return time.Time{}, nil
+		}
+		return time.Time{}, err
+	}
+	if until == nil {
+		return time.Time{}, nil
+	}
+	return *until, nil
+}
+
+// Delete removes key. In a bucket with object lock (which is always
+// versioned) a plain delete only hides the object behind a delete marker,
+// so the current version is removed for good once its retention has
+// passed. A version still under retention is hidden instead and stays
+// stored until a lifecycle rule expires it.
+func (s *S3Backend) Delete(key string) error {
+	ctx := s.context()
+	objectName := s.objectKey(key)
+
+	if !s.locking {
+		return s.client.RemoveObject(ctx, s.bucketName, objectName, minio.RemoveObjectOptions{})
+	}
+	info, err := s.client.StatObject(ctx, s.bucketName, objectName, minio.StatObjectOptions{})
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return nil
+		}
+		return err
+	}
+	until, err := s.retention(objectName, info.VersionID)
+	if err != nil {
+		return err
+	}
+	opts := minio.RemoveObjectOptions{}
+	if !until.After(time.Now()) {
+		opts.VersionID = info.VersionID
+	}
+	return s.client.RemoveObject(ctx, s.bucketName, objectName, opts)
+}
+
 func (s *S3Backend) Close() error {
 	return nil
 }
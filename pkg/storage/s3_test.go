@@ -0,0 +1,31 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/minio/minio-go/v7"
+)
+
+func TestS3LockMode(t *testing.T) {
+	tests := []struct {
+		mode string
+		days int
+		want minio.RetentionMode
+		ok   bool
+	}{
+		{mode: "", ok: true},
+		{mode: "", days: 30, ok: true}, // days alone lock nothing
+		{mode: "governance", days: 30, want: minio.Governance, ok: true},
+		{mode: "compliance", days: 1, want: minio.Compliance, ok: true},
+		{mode: "compliance"},
+		{mode: "governance", days: -1},
+		{mode: "Compliance", days: 30},
+		{mode: "legal-hold", days: 30},
+	}
+	for _, tt := range tests {
+		got, err := S3Config{LockMode: tt.mode, LockDays: tt.days}.lockMode()
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("lock mode %q for %d days: %q, %v", tt.mode, tt.days, got, err)
+		}
+	}
+}
@@ -0,0 +1,358 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// SFTPConfig describes an SSH server to store objects on
+type SFTPConfig struct {
+	Host     string // host:port (port 22 if omitted)
+	User     string
+	BasePath string // remote directory holding objects/
+	KeyFile  string // private key for public key authentication
+	// KeyPassphrase decrypts KeyFile if it is encrypted
+	KeyPassphrase string
+	// KnownHosts is the known_hosts file the server key is verified
+	// against (~/.ssh/known_hosts if empty). Unknown hosts are refused.
+	KnownHosts string
+}
+
+// SFTPBackend implements Backend on an SSH server, with the same
+// objects/ab/cdef layout as LocalBackend. One SSH connection is shared by
+// all operations and re-established once if it drops.
+type SFTPBackend struct {
+	basePath string
+	dial     func() (*ssh.Client, error)
+
+	mu     sync.Mutex
+	conn   *ssh.Client
+	client *sftp.Client
+}
+
+// NewSFTPBackend connects to the server with key-based authentication,
+// verifying its host key against known_hosts
+func NewSFTPBackend(cfg SFTPConfig) (*SFTPBackend, error) {
+	clientConfig, err := cfg.clientConfig()
+	if err != nil {
+		return nil, err
+	}
+	host := cfg.Host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, "22")
+	}
+	return NewSFTPBackendWithDialer(cfg.BasePath, func() (*ssh.Client, error) {
+		return ssh.Dial("tcp", host, clientConfig)
+	})
+}
+
+// NewSFTPBackendWithDialer uses dial to (re)connect, e.g. to an in-process
+// SSH server. The first connection is made right away.
+func NewSFTPBackendWithDialer(basePath string, dial func() (*ssh.Client, error)) (*SFTPBackend, error) {
+	s := &SFTPBackend{basePath: basePath, dial: dial}
+	c, err := s.sftp()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.MkdirAll(path.Join(basePath, "objects")); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// clientConfig builds the SSH client configuration of cfg
+func (cfg SFTPConfig) clientConfig() (*ssh.ClientConfig, error) {
+	if cfg.KeyFile == "" {
+		return nil, fmt.Errorf("sftp: a private key file is required")
+	}
+	pem, err := os.ReadFile(cfg.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	var signer ssh.Signer
+	if cfg.KeyPassphrase != "" {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(pem, []byte(cfg.KeyPassphrase))
+	} else {
+		signer, err = ssh.ParsePrivateKey(pem)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("sftp: invalid private key %s: %w", cfg.KeyFile, err)
+	}
+
+	knownHostsFile := cfg.KnownHosts
+	if knownHostsFile == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		knownHostsFile = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	hostKeyCallback, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("sftp: failed to load known hosts: %w", err)
+	}
+
+	return &ssh.ClientConfig{
+		User:            cfg.User,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         30 * time.Second,
+	}, nil
+}
+
+// sftp returns the shared client, connecting if needed
+func (s *SFTPBackend) sftp() (*sftp.Client, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.client != nil {
+		return s.client, nil
+	}
+	conn, err := s.dial()
+	if err != nil {
+		return nil, fmt.Errorf("sftp: failed to connect: %w", err)
+	}
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("sftp: failed to start session: %w", err)
+	}
+	s.conn, s.client = conn, client
+	return client, nil
+}
+
+// reset drops a broken connection so the next call reconnects
+func (s *SFTPBackend) reset(broken *sftp.Client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.client != broken {
+		return // Someone else reconnected already
+	}
+	s.client.Close()
+	s.conn.Close()
+	s.client, s.conn = nil, nil
+}
+
+// do runs fn with the shared client, reconnecting and retrying once if
+// the connection was lost
+func (s *SFTPBackend) do(fn func(c *sftp.Client) error) error {
+	for attempt := 0; ; attempt++ {
+		c, err := s.sftp()
+		if err != nil {
+			return err
+		}
+		err = fn(c)
+		if attempt == 0 && isConnectionLost(err) {
+			s.reset(c)
+			continue
+		}
+		return err
+	}
+}
+
+func isConnectionLost(err error) bool {
+	return errors.Is(err, sftp.ErrSSHFxConnectionLost) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, net.ErrClosed)
+}
+
+func (s *SFTPBackend) objectPath(key string) string {
+	return path.Join(s.basePath, objectName(key))
+}
+
+func (s *SFTPBackend) Put(key string, data []byte) error {
+	return s.PutReader(key, bytes.NewReader(data), int64(len(data)))
+}
+
+// PutReader writes to a temporary file and renames it into place, so
+// readers never see a partial object. Only seekable readers are retried
+// after a lost connection.
+func (s *SFTPBackend) PutReader(key string, r io.Reader, size int64) error {
+	p := s.objectPath(key)
+	seeker, _ := r.(io.Seeker)
+	var start int64
+	if seeker != nil {
+		var err error
+		if start, err = seeker.Seek(0, io.SeekCurrent); err != nil {
+			seeker = nil
+		}
+	}
+	attempts := 0
+	return s.do(func(c *sftp.Client) error {
+		if attempts++; attempts > 1 {
+			if seeker == nil {
+				return fmt.Errorf("sftp: connection lost while uploading %s", key)
+			}
+			if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+				return err
+			}
+		}
+
+		// Check exist
+		if _, err := c.Stat(p); err == nil {
+			return nil // Already exists
+		}
+
+		// Create dir (e.g. objects/ab/)
+		if err := c.MkdirAll(path.Dir(p)); err != nil {
+			return err
+		}
+
+		suffix := make([]byte, 8)
+		if _, err := rand.Read(suffix); err != nil {
+			return err
+		}
+		tmp := path.Join(path.Dir(p), "."+path.Base(p)+".tmp-"+hex.EncodeToString(suffix))
+		f, err := c.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(f, r); err != nil {
+			f.Close()
+			c.Remove(tmp)
+			return err
+		}
+		if err := f.Close(); err != nil {
+			c.Remove(tmp)
+			return err
+		}
+		if err := c.Chmod(tmp, 0600); err != nil {
+			c.Remove(tmp)
+			return err
+		}
+		if err := c.PosixRename(tmp, p); err != nil {
+			c.Remove(tmp)
+			return err
+		}
+		return nil
+	})
+}
+
+func (s *SFTPBackend) Get(key string) ([]byte, error) {
+	var data []byte
+	err := s.do(func(c *sftp.Client) error {
+		f, err := c.Open(s.objectPath(key))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		data, err = io.ReadAll(f)
+		return err
+	})
+	return data, err
+}
+
+// GetReader streams an object. The reader must be closed.
+func (s *SFTPBackend) GetReader(key string) (io.ReadCloser, error) {
+	var f *sftp.File
+	err := s.do(func(c *sftp.Client) error {
+		var err error
+		f, err = c.Open(s.objectPath(key))
+		return err
+	})
+	return f, err
+}
+
+func (s *SFTPBackend) GetRange(key string, offset, length int64) ([]byte, error) {
+	buf := make([]byte, length)
+	err := s.do(func(c *sftp.Client) error {
+		f, err := c.Open(s.objectPath(key))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = f.ReadAt(buf, offset)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func (s *SFTPBackend) Has(key string) (bool, error) {
+	var exists bool
+	err := s.do(func(c *sftp.Client) error {
+		_, err := c.Stat(s.objectPath(key))
+		if errors.Is(err, os.ErrNotExist) {
+			exists = false
+			return nil
+		}
+		exists = err == nil
+		return err
+	})
+	return exists, err
+}
+
+func (s *SFTPBackend) List(prefix string, fn func(ObjectInfo) error) error {
+	root := path.Join(s.basePath, listRoot(prefix))
+
+	c, err := s.sftp()
+	if err != nil {
+		return err
+	}
+	// Not retried: fn may already have seen part of the listing
+	walker := c.Walk(root)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			if errors.Is(err, os.ErrNotExist) && walker.Path() == root {
+				return nil // Nothing stored under this namespace yet
+			}
+			if isConnectionLost(err) {
+				s.reset(c)
+			}
+			return err
+		}
+		info := walker.Stat()
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".") {
+			continue
+		}
+
+		rel := strings.TrimPrefix(walker.Path(), strings.TrimSuffix(s.basePath, "/")+"/")
+		key, ok := keyFromObjectName(rel)
+		if !ok || !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if err := fn(ObjectInfo{Key: key, Size: info.Size()}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SFTPBackend) Delete(key string) error {
+	return s.do(func(c *sftp.Client) error {
+		err := c.Remove(s.objectPath(key))
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	})
+}
+
+func (s *SFTPBackend) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.client == nil {
+		return nil
+	}
+	err := errors.Join(s.client.Close(), s.conn.Close())
+	s.client, s.conn = nil, nil
+	return err
+}
@@ -0,0 +1,379 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// testSFTPServer is an in-process SSH server with the sftp subsystem,
+// serving the local filesystem
+type testSFTPServer struct {
+	listener net.Listener
+	hostKey  ssh.Signer
+
+	mu    sync.Mutex
+	conns []net.Conn
+	dials int
+}
+
+func newTestSFTPServer(t *testing.T) *testSFTPServer {
+	t.Helper()
+	return newTestSFTPServerWithConfig(t, &ssh.ServerConfig{NoClientAuth: true})
+}
+
+// newTestSFTPServerWithConfig serves with config, which decides how
+// clients authenticate
+func newTestSFTPServerWithConfig(t *testing.T, config *ssh.ServerConfig) *testSFTPServer {
+	t.Helper()
+	hostKey := newTestSigner(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &testSFTPServer{listener: l, hostKey: hostKey}
+	t.Cleanup(func() {
+		l.Close()
+		srv.dropConnections()
+	})
+
+	config.AddHostKey(hostKey)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			srv.mu.Lock()
+			srv.conns = append(srv.conns, conn)
+			srv.mu.Unlock()
+			go srv.serve(conn, config)
+		}
+	}()
+	return srv
+}
+
+func newTestSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func (srv *testSFTPServer) serve(conn net.Conn, config *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	for newCh := range chans {
+		if newCh.ChannelType() != "session" {
+			newCh.Reject(ssh.UnknownChannelType, "only sessions")
+			continue
+		}
+		ch, requests, err := newCh.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			for req := range requests {
+				// Payload is the length-prefixed subsystem name
+				ok := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+			}
+		}()
+		s, err := sftp.NewServer(ch)
+		if err != nil {
+			ch.Close()
+			continue
+		}
+		go func() {
+			s.Serve()
+			ch.Close()
+		}()
+	}
+}
+
+// dial connects a client, verifying the server's host key
+func (srv *testSFTPServer) dial() (*ssh.Client, error) {
+	srv.mu.Lock()
+	srv.dials++
+	srv.mu.Unlock()
+	return ssh.Dial("tcp", srv.listener.Addr().String(), &ssh.ClientConfig{
+		User:            "backup",
+		HostKeyCallback: ssh.FixedHostKey(srv.hostKey.PublicKey()),
+	})
+}
+
+// dropConnections closes every connection from the server side, as a
+// restarted server or a network failure would
+func (srv *testSFTPServer) dropConnections() {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	for _, c := range srv.conns {
+		c.Close()
+	}
+	srv.conns = nil
+}
+
+func (srv *testSFTPServer) dialCount() int {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.dials
+}
+
+func newTestSFTPBackend(t *testing.T) (*SFTPBackend, *testSFTPServer) {
+	t.Helper()
+	srv := newTestSFTPServer(t)
+	b, err := NewSFTPBackendWithDialer(t.TempDir(), srv.dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { b.Close() })
+	return b, srv
+}
+
+func TestSFTPBackendObjects(t *testing.T) {
+	b, _ := newTestSFTPBackend(t)
+
+	objects := map[string][]byte{
+		"aa11":           []byte("loose chunk"),
+		"ab22":           []byte("another chunk"),
+		"packs/cd33":     bytes.Repeat([]byte("pack "), 1000),
+		"snapshots/0001": []byte("snapshot metadata"),
+	}
+	for k, v := range objects {
+		if err := b.Put(k, v); err != nil {
+			t.Fatalf("put %s: %v", k, err)
+		}
+	}
+	for k, v := range objects {
+		got, err := b.Get(k)
+		if err != nil {
+			t.Fatalf("get %s: %v", k, err)
+		}
+		if !bytes.Equal(got, v) {
+			t.Errorf("get %s returned the wrong data", k)
+		}
+	}
+
+	part, err := b.GetRange("packs/cd33", 5, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(part, objects["packs/cd33"][5:15]) {
+		t.Errorf("range read returned %q", part)
+	}
+
+	// Objects are never overwritten
+	if err := b.Put("aa11", []byte("changed")); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := b.Get("aa11"); !bytes.Equal(got, objects["aa11"]) {
+		t.Error("put replaced an existing object")
+	}
+
+	list := func(prefix string) []string {
+		t.Helper()
+		var keys []string
+		err := b.List(prefix, func(obj ObjectInfo) error {
+			if obj.Size != int64(len(objects[obj.Key])) {
+				t.Errorf("%s listed with size %d", obj.Key, obj.Size)
+			}
+			keys = append(keys, obj.Key)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(keys)
+		return keys
+	}
+	if got := list("packs/"); len(got) != 1 || got[0] != "packs/cd33" {
+		t.Errorf("packs/ listed %v", got)
+	}
+	if got := list(""); len(got) != len(objects) {
+		t.Errorf("listed %v, want all %d objects", got, len(objects))
+	}
+	if got := list("parity/"); len(got) != 0 {
+		t.Errorf("empty namespace listed %v", got)
+	}
+
+	if err := b.Delete("ab22"); err != nil {
+		t.Fatal(err)
+	}
+	if exists, err := b.Has("ab22"); err != nil || exists {
+		t.Errorf("deleted object still exists (err %v)", err)
+	}
+	if _, err := b.Get("ab22"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("get of a deleted object returned %v", err)
+	}
+	if err := b.Delete("ab22"); err != nil {
+		t.Errorf("deleting a missing object failed: %v", err)
+	}
+	if exists, err := b.Has("aa11"); err != nil || !exists {
+		t.Errorf("stored object not found (err %v)", err)
+	}
+}
+
+func TestSFTPBackendReconnects(t *testing.T) {
+	b, srv := newTestSFTPBackend(t)
+
+	if err := b.Put("aa11", []byte("before")); err != nil {
+		t.Fatal(err)
+	}
+	srv.dropConnections()
+
+	// Every operation recovers from the dropped connection by itself
+	if got, err := b.Get("aa11"); err != nil || string(got) != "before" {
+		t.Fatalf("get after a dropped connection: %q, %v", got, err)
+	}
+	srv.dropConnections()
+	if err := b.Put("bb22", []byte("after")); err != nil {
+		t.Fatalf("put after a dropped connection: %v", err)
+	}
+	srv.dropConnections()
+	if exists, err := b.Has("bb22"); err != nil || !exists {
+		t.Fatalf("has after a dropped connection: %v, %v", exists, err)
+	}
+	srv.dropConnections()
+	if err := b.Delete("aa11"); err != nil {
+		t.Fatalf("delete after a dropped connection: %v", err)
+	}
+	if exists, _ := b.Has("aa11"); exists {
+		t.Error("delete after a dropped connection left the object")
+	}
+
+	if n := srv.dialCount(); n != 5 {
+		t.Errorf("connected %d times, want once plus once per drop", n)
+	}
+}
+
+// writeClientKey stores a new client key as an OpenSSH private key file,
+// encrypted if passphrase is set
+func writeClientKey(t *testing.T, passphrase string) (string, ssh.PublicKey) {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var block *pem.Block
+	if passphrase != "" {
+		block, err = ssh.MarshalPrivateKeyWithPassphrase(priv, "", []byte(passphrase))
+	} else {
+		block, err = ssh.MarshalPrivateKey(priv, "")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "id_ed25519")
+	if err := os.WriteFile(path, pem.EncodeToMemory(block), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path, sshPub
+}
+
+// writeKnownHosts stores a known_hosts file listing key for addr
+func writeKnownHosts(t *testing.T, addr string, key ssh.PublicKey) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(addr)}, key) + "\n"
+	if err := os.WriteFile(path, []byte(line), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestSFTPBackendAuth(t *testing.T) {
+	keyFile, clientKey := writeClientKey(t, "")
+	encryptedKeyFile, encryptedKey := writeClientKey(t, "key passphrase")
+	strangerKeyFile, _ := writeClientKey(t, "")
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if conn.User() == "backup" && (bytes.Equal(key.Marshal(), clientKey.Marshal()) || bytes.Equal(key.Marshal(), encryptedKey.Marshal())) {
+				return nil, nil
+			}
+			return nil, errors.New("unauthorized key")
+		},
+	}
+	srv := newTestSFTPServerWithConfig(t, config)
+	addr := srv.listener.Addr().String()
+	knownHosts := writeKnownHosts(t, addr, srv.hostKey.PublicKey())
+
+	valid := SFTPConfig{Host: addr, User: "backup", BasePath: t.TempDir(), KeyFile: keyFile, KnownHosts: knownHosts}
+	b, err := NewSFTPBackend(valid)
+	if err != nil {
+		t.Fatalf("connect with an authorized key: %v", err)
+	}
+	if err := b.Put("aa11", []byte("chunk")); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := b.Get("aa11"); err != nil || string(got) != "chunk" {
+		t.Errorf("get over an authenticated connection: %q, %v", got, err)
+	}
+	b.Close()
+
+	encrypted := valid
+	encrypted.KeyFile, encrypted.KeyPassphrase = encryptedKeyFile, "key passphrase"
+	if b, err := NewSFTPBackend(encrypted); err != nil {
+		t.Errorf("connect with an encrypted key: %v", err)
+	} else {
+		b.Close()
+	}
+
+	tests := []struct {
+		name string
+		edit func(cfg *SFTPConfig)
+	}{
+		{"no client key", func(cfg *SFTPConfig) { cfg.KeyFile = "" }},
+		{"missing key file", func(cfg *SFTPConfig) { cfg.KeyFile = filepath.Join(t.TempDir(), "missing") }},
+		{"unauthorized client key", func(cfg *SFTPConfig) { cfg.KeyFile = strangerKeyFile }},
+		{"wrong user", func(cfg *SFTPConfig) { cfg.User = "root" }},
+		{"encrypted key without passphrase", func(cfg *SFTPConfig) { cfg.KeyFile = encryptedKeyFile }},
+		{"wrong passphrase", func(cfg *SFTPConfig) {
+			cfg.KeyFile, cfg.KeyPassphrase = encryptedKeyFile, "guess"
+		}},
+		{"wrong host key", func(cfg *SFTPConfig) {
+			cfg.KnownHosts = writeKnownHosts(t, addr, newTestSigner(t).PublicKey())
+		}},
+		{"unknown host", func(cfg *SFTPConfig) {
+			cfg.KnownHosts = writeKnownHosts(t, "192.0.2.1:22", srv.hostKey.PublicKey())
+		}},
+		{"missing known_hosts", func(cfg *SFTPConfig) { cfg.KnownHosts = filepath.Join(t.TempDir(), "missing") }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := valid
+			tt.edit(&cfg)
+			if b, err := NewSFTPBackend(cfg); err == nil {
+				b.Close()
+				t.Error("connection accepted")
+			}
+		})
+	}
+}
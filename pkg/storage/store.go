@@ -1,11 +1,15 @@
 package storage
 
 import (
+	"bytes"
 	"fmt"
+	"io"
+	"sync"
 
 	"github.com/klauspost/compress/zstd"
 	"github.com/pranavdwivedi/aegis/pkg/crypto"
 	"github.com/pranavdwivedi/aegis/pkg/hash"
+	"github.com/zeebo/blake3"
 )
 
 // ContentAddressableStore implements a simple CAS on disk with Zstd compression
@@ -14,10 +18,36 @@ type ContentAddressableStore struct {
 	encoder *zstd.Encoder
 	decoder *zstd.Decoder
 	key     crypto.MasterKey
+	config  RepoConfig
+	parity  *parityWriter // set by EnableParity
+
+	// Data keys of write-only backups, opened on demand
+	mu       sync.Mutex
+	dataKeys map[crypto.KeyID]crypto.MasterKey
 }
 
-// NewContentAddressableStore creates a new CAS
+// NewContentAddressableStore creates a new CAS, reading the repository config from the backend
 func NewContentAddressableStore(backend Backend, key crypto.MasterKey) (*ContentAddressableStore, error) {
+	s, err := NewContentAddressableStoreWithConfig(backend, key, RepoConfig{})
+	if err != nil {
+		return nil, err
+	}
+	if s.config, err = s.loadConfig(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// NewContentAddressableStoreWithConfig creates a new CAS with a known config,
+// without reading it from the backend (e.g. while the config itself is being re-encrypted)
+func NewContentAddressableStoreWithConfig(backend Backend, key crypto.MasterKey, cfg RepoConfig) (*ContentAddressableStore, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	if err := cfg.CheckFormat(); err != nil {
+		return nil, err
+	}
+
 	enc, err := zstd.NewWriter(nil)
 	if err != nil {
 		return nil, err
@@ -32,26 +62,100 @@ func NewContentAddressableStore(backend Backend, key crypto.MasterKey) (*Content
 		encoder: enc,
 		decoder: dec,
 		key:     key,
+		config:  cfg,
 	}, nil
 }
 
-// Put checks if object exists, if not, compresses, ENCRYPTS and writes it
+// ID returns the chunk id of data: the keyed BLAKE3 hash, or the plain
+// BLAKE3 hash in legacy repositories
+func (s *ContentAddressableStore) ID(data []byte) hash.Hash {
+	if len(s.config.ChunkIDKey) == 0 {
+		return hash.Sum(data)
+	}
+	// The key length is validated with the config, so this cannot fail
+	h, _ := hash.SumKeyed(s.config.ChunkIDKey, data)
+	return h
+}
+
+// seal compresses and encrypts data, binding it to the key it is stored under
+func (s *ContentAddressableStore) seal(key string, data []byte) ([]byte, error) {
+	// 1. Compress, unless it does not help (already compressed media etc.)
+	payload, compression := s.encoder.EncodeAll(data, make([]byte, 0, len(data))), CompressionZstd
+	if len(payload) >= len(data) {
+		payload, compression = data, CompressionNone
+	}
+
+	// 2. Encrypt
+	return sealObject(s.key, key, payload, compression)
+}
+
+// keyFor returns the key that opens a sealed object: the master key, or
+// the data key of the write-only backup that wrote it
+func (s *ContentAddressableStore) keyFor(sealed []byte) (crypto.MasterKey, error) {
+	id, ok := sealedKeyID(sealed)
+	if !ok || id == s.key.ID() {
+		return s.key, nil
+	}
+	return s.dataKey(id)
+}
+
+// open decrypts and decompresses data written by seal under key
+func (s *ContentAddressableStore) open(key string, encrypted []byte) ([]byte, error) {
+	k, err := s.keyFor(encrypted)
+	if err != nil {
+		return nil, err
+	}
+	return s.openWith(k, key, encrypted)
+}
+
+// openWith is open with a known key
+func (s *ContentAddressableStore) openWith(k crypto.MasterKey, key string, encrypted []byte) ([]byte, error) {
+	// 1. Decrypt
+	payload, compression, err := openObject(k, key, encrypted)
+	if err != nil {
+		return nil, err
+	}
+
+	// 2. Decompress
+	if compression == CompressionNone {
+		return payload, nil
+	}
+	return s.decoder.DecodeAll(payload, nil)
+}
+
+// Rekey re-encrypts the object stored under key for another master key,
+// without decompressing it. Objects are rewritten in the current envelope
+// version. Objects sealed with the data key of a write-only backup do not
+// depend on the master key and are returned as they are.
+func (s *ContentAddressableStore) Rekey(key string, sealed []byte, to crypto.MasterKey) ([]byte, error) {
+	if id, ok := sealedKeyID(sealed); ok && id != s.key.ID() {
+		return sealed, nil
+	}
+	payload, compression, err := openObject(s.key, key, sealed)
+	if err != nil {
+		return nil, err
+	}
+	return sealObject(to, key, payload, compression)
+}
+
+// Put checks if object exists, if not, compresses, ENCRYPTS and writes it.
+// It returns the chunk id the data is stored under.
 func (s *ContentAddressableStore) Put(data []byte) (hash.Hash, error) {
-	h := hash.Sum(data)
+	h := s.ID(data)
 	keyStr := h.String()
 
 	// Check exist
 	if exists, _ := s.backend.Has(keyStr); exists {
+		// The stored copy must stay locked as long as what this backup writes
+		if err := ExtendRetention(s.backend, keyStr); err != nil {
+			return hash.Hash{}, err
+		}
 		return h, nil
 	}
 
-	// 1. Compress
-	compressed := s.encoder.EncodeAll(data, make([]byte, 0, len(data)))
-
-	// 2. Encrypt
-	encrypted, err := s.key.Encrypt(compressed)
+	encrypted, err := s.seal(keyStr, data)
 	if err != nil {
-		return hash.Hash{}, fmt.Errorf("encryption failed: %w", err)
+		return hash.Hash{}, err
 	}
 
 	// Write
@@ -59,6 +163,11 @@ func (s *ContentAddressableStore) Put(data []byte) (hash.Hash, error) {
 		return hash.Hash{}, err
 	}
 
+	if s.parity != nil {
+		if err := s.addParity(h, data); err != nil {
+			return hash.Hash{}, err
+		}
+	}
 	return h, nil
 }
 
@@ -72,24 +181,87 @@ func (s *ContentAddressableStore) Get(h hash.Hash) ([]byte, error) {
 		return nil, err
 	}
 
-	// 1. Decrypt
-	compressed, err := s.key.Decrypt(encrypted)
+	data, err := s.open(keyStr, encrypted)
 	if err != nil {
-		return nil, fmt.Errorf("decryption failed (wrong key or data corruption): %w", err)
+		return nil, fmt.Errorf("chunk %s: %w", h, err)
 	}
 
-	// 2. Decompress
-	data, err := s.decoder.DecodeAll(compressed, nil)
+	// Verify integrity. Chunks written before keyed ids stay readable.
+	if s.ID(data) != h && hash.Sum(data) != h {
+		return nil, fmt.Errorf("integrity check failed for chunk %s", h)
+	}
+
+	return data, nil
+}
+
+// GetReader streams the decompressed data of a chunk, so callers such as
+// restore never hold a whole decompressed chunk. The sealed object is read
+// in full, since it must be authenticated before anything is decrypted.
+// The chunk id is checked as the data is read: a mismatch is returned by
+// the final Read instead of io.EOF.
+func (s *ContentAddressableStore) GetReader(h hash.Hash) (io.ReadCloser, error) {
+	keyStr := h.String()
+
+	encrypted, err := s.backend.Get(keyStr)
 	if err != nil {
 		return nil, err
 	}
+	k, err := s.keyFor(encrypted)
+	if err != nil {
+		return nil, fmt.Errorf("chunk %s: %w", h, err)
+	}
+	payload, compression, err := openObject(k, keyStr, encrypted)
+	if err != nil {
+		return nil, fmt.Errorf("chunk %s: %w", h, err)
+	}
 
-	// Verify integrity
-	if hash.Sum(data) != h {
-		return nil, fmt.Errorf("integrity check failed for chunk %s", h)
+	r := &chunkReader{id: h, plain: hash.New()}
+	if len(s.config.ChunkIDKey) > 0 {
+		// The key length is validated with the config, so this cannot fail
+		r.keyed, _ = hash.NewKeyed(s.config.ChunkIDKey)
+	}
+	if compression == CompressionNone {
+		r.src = bytes.NewReader(payload)
+		return r, nil
+	}
+	dec, err := zstd.NewReader(bytes.NewReader(payload), zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	r.src, r.close = dec, dec.Close
+	return r, nil
+}
+
+// chunkReader hashes a chunk as it is read and fails at the end if it does
+// not match its id (keyed, or plain for chunks written before keyed ids)
+type chunkReader struct {
+	id    hash.Hash
+	src   io.Reader
+	close func()
+	plain *blake3.Hasher
+	keyed *blake3.Hasher
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	n, err := r.src.Read(p)
+	r.plain.Write(p[:n])
+	if r.keyed != nil {
+		r.keyed.Write(p[:n])
+	}
+	if err != io.EOF {
+		return n, err
+	}
+	if hash.Hash(r.plain.Sum(nil)) == r.id || (r.keyed != nil && hash.Hash(r.keyed.Sum(nil)) == r.id) {
+		return n, io.EOF
 	}
+	return n, fmt.Errorf("integrity check failed for chunk %s", r.id)
+}
 
-	return data, nil
+func (r *chunkReader) Close() error {
+	if r.close != nil {
+		r.close()
+	}
+	return nil
 }
 
 // Has checks if the chunk exists
@@ -102,3 +274,30 @@ func (s *ContentAddressableStore) Verify(h hash.Hash) error {
 	_, err := s.Get(h)
 	return err
 }
+
+// PutMetadata compresses, encrypts and stores data under a namespaced key
+// (e.g. "snapshots/<id>").
+func (s *ContentAddressableStore) PutMetadata(key string, data []byte) error {
+	if !isNamespaced(key) {
+		return fmt.Errorf("metadata key %q must be namespaced", key)
+	}
+
+	encrypted, err := s.seal(key, data)
+	if err != nil {
+		return err
+	}
+	return s.backend.Put(key, encrypted)
+}
+
+// GetMetadata retrieves, decrypts and decompresses an object written by PutMetadata
+func (s *ContentAddressableStore) GetMetadata(key string) ([]byte, error) {
+	encrypted, err := s.backend.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := s.open(key, encrypted)
+	if err != nil {
+		return nil, fmt.Errorf("metadata %s: %w", key, err)
+	}
+	return data, nil
+}
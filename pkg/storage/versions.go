@@ -0,0 +1,140 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Metadata that changes over time (the repository config, parity group
+// headers, snapshot metadata rewritten by a migration or key rotation) is
+// never deleted before its replacement is stored. Backends may refuse to
+// overwrite, so a replacement is first stored as a new version under
+// "<key>.<n>"; only then is the object moved back to "<key>" and the
+// other versions removed. Whatever step an interrupted replace stopped at,
+// one readable copy remains, and readers take the newest version.
+
+// versionedKey is one stored version of a metadata object
+type versionedKey struct {
+	name    string
+	version int // 0 for the plain key
+}
+
+// MetadataBase returns the key a metadata object was stored for, without
+// the version suffix a replacement may have left on it
+func MetadataBase(name string) string {
+	i := strings.LastIndexByte(name, '.')
+	if i <= strings.LastIndexByte(name, '/') {
+		return name
+	}
+	if n, err := strconv.Atoi(name[i+1:]); err != nil || n < 1 || name[i+1] == '0' {
+		return name
+	}
+	return name[:i]
+}
+
+// metadataVersions returns the stored versions of key, newest first
+func metadataVersions(backend Backend, key string) ([]versionedKey, error) {
+	var versions []versionedKey
+	err := backend.List(key, func(obj ObjectInfo) error {
+		if MetadataBase(obj.Key) != key {
+			return nil // Another object sharing the prefix
+		}
+		v := versionedKey{name: obj.Key}
+		if obj.Key != key {
+			v.version, _ = strconv.Atoi(obj.Key[len(key)+1:])
+		}
+		versions = append(versions, v)
+		return nil
+	})
+	sort.Slice(versions, func(i, j int) bool { return versions[i].version > versions[j].version })
+	return versions, err
+}
+
+// ReplaceMetadata stores data as the new content of a metadata object
+// that may already exist, without a moment where no copy is stored
+func (s *ContentAddressableStore) ReplaceMetadata(key string, data []byte) error {
+	versions, err := metadataVersions(s.backend, key)
+	if err != nil {
+		return err
+	}
+	if len(versions) == 0 {
+		return s.PutMetadata(key, data)
+	}
+
+	// 1. The new version next to the old ones; readers prefer it
+	next := fmt.Sprintf("%s.%d", key, versions[0].version+1)
+	if err := s.PutMetadata(next, data); err != nil {
+		return err
+	}
+	// 2. Move it back to the plain key, which older readers expect
+	if err := s.backend.Delete(key); err != nil {
+		return err
+	}
+	if err := s.PutMetadata(key, data); err != nil {
+		return err
+	}
+	// 3. Drop the versions in between
+	for _, v := range append(versions, versionedKey{name: next}) {
+		if v.name == key {
+			continue
+		}
+		if err := s.backend.Delete(v.name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// HasMetadata checks if a metadata object is stored, in any version
+func (s *ContentAddressableStore) HasMetadata(key string) (bool, error) {
+	versions, err := metadataVersions(s.backend, key)
+	return len(versions) > 0, err
+}
+
+// GetLatestMetadata reads the newest readable version of a metadata object
+// that may have been replaced with ReplaceMetadata
+func (s *ContentAddressableStore) GetLatestMetadata(key string) ([]byte, error) {
+	return s.latestMetadata(key, s.open)
+}
+
+// latestMetadata is GetLatestMetadata with a custom open. A version that
+// does not open (e.g. torn by a crash) falls back to the previous one.
+func (s *ContentAddressableStore) latestMetadata(key string, open func(key string, encrypted []byte) ([]byte, error)) ([]byte, error) {
+	versions, err := metadataVersions(s.backend, key)
+	if err != nil {
+		return nil, err
+	}
+	if len(versions) == 0 {
+		return s.GetMetadata(key) // Reports the backend's not-found error
+	}
+
+	var lastErr error
+	for _, v := range versions {
+		encrypted, err := s.backend.Get(v.name)
+		if err != nil {
+			return nil, err
+		}
+		data, err := open(v.name, encrypted)
+		if err == nil {
+			return data, nil
+		}
+		lastErr = fmt.Errorf("metadata %s: %w", v.name, err)
+	}
+	return nil, lastErr
+}
+
+// DeleteMetadata removes every version of a metadata object
+func (s *ContentAddressableStore) DeleteMetadata(key string) error {
+	versions, err := metadataVersions(s.backend, key)
+	if err != nil {
+		return err
+	}
+	for _, v := range versions {
+		if err := s.backend.Delete(v.name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
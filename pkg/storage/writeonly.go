@@ -0,0 +1,254 @@
+package storage
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pranavdwivedi/aegis/pkg/chunker"
+	"github.com/pranavdwivedi/aegis/pkg/crypto"
+)
+
+// WritePublicKeyConfigKey holds the X25519 public key of a write-only
+// enabled repository, sealed with the master key. The private key is never
+// stored in the repository; the operator keeps it (see EnableWriteOnly).
+const WritePublicKeyConfigKey = ConfigNamespace + "write-public-key"
+
+// ErrPrivateKeyRequired is returned when an object written by a write-only
+// backup is read without the write-only private key
+var ErrPrivateKeyRequired = errors.New("object written by a write-only backup; the write-only private key is required")
+
+// DataKeyNamespace holds the per-snapshot data keys of write-only backups,
+// each sealed to the repository public key and named by its key id
+const DataKeyNamespace = "datakeys/"
+
+// WriteOnlyKey is everything a backup host needs to add snapshots without
+// being able to read the repository: the public key data keys are sealed
+// to, plus the settings new objects must follow. It holds no secret that
+// decrypts existing data.
+type WriteOnlyKey struct {
+	PublicKey crypto.PublicKey `json:"public_key"`
+	Cipher    crypto.Cipher    `json:"cipher"`
+	// ChunkIDKey names chunks so they deduplicate with the rest of the
+	// repository. It reveals whether two chunks are equal, not their content,
+	// but a host holding it can compute the id of any content it guesses and
+	// check whether the repository stores it. Backup hosts must be trusted
+	// not to fingerprint the repository this way.
+	ChunkIDKey []byte `json:"chunk_id_key,omitempty"`
+	Version    int    `json:"version"`
+
+	// Chunker is how the repository splits files, if recorded when the
+	// key was issued
+	Chunker *chunker.Params `json:"chunker,omitempty"`
+}
+
+// Config returns the repository config a write-only store operates with
+func (wk *WriteOnlyKey) Config() RepoConfig {
+	return RepoConfig{Version: wk.Version, ChunkIDKey: wk.ChunkIDKey, Chunker: wk.Chunker}
+}
+
+// Save writes the write-only key to a file readable only by its owner
+func (wk *WriteOnlyKey) Save(path string) error {
+	data, err := json.MarshalIndent(wk, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+// LoadWriteOnlyKey reads a write-only key written by Save
+func LoadWriteOnlyKey(path string) (*WriteOnlyKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var wk WriteOnlyKey
+	if err := json.Unmarshal(data, &wk); err != nil {
+		return nil, fmt.Errorf("corrupt write-only key: %w", err)
+	}
+	if err := wk.Config().validate(); err != nil {
+		return nil, fmt.Errorf("corrupt write-only key: %w", err)
+	}
+	if err := wk.Config().CheckFormat(); err != nil {
+		return nil, err
+	}
+	return &wk, nil
+}
+
+// SavePrivateKey writes the write-only private key to a new file readable
+// only by its owner. It refuses to overwrite an existing file.
+func SavePrivateKey(path string, sk crypto.PrivateKey) error {
+	text, err := sk.MarshalText()
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(text, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// LoadPrivateKey reads a write-only private key written by SavePrivateKey
+func LoadPrivateKey(path string) (crypto.PrivateKey, error) {
+	var sk crypto.PrivateKey
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return sk, err
+	}
+	if err := sk.UnmarshalText([]byte(strings.TrimSpace(string(data)))); err != nil {
+		return sk, fmt.Errorf("%s: %w", path, err)
+	}
+	return sk, nil
+}
+
+// NewDataKey generates a key for one write-only backup and stores it sealed
+// to the repository public key. The caller should forget it after the backup.
+func NewDataKey(backend Backend, wk *WriteOnlyKey) (crypto.MasterKey, error) {
+	dk, err := crypto.NewMasterKey()
+	if err != nil {
+		return crypto.MasterKey{}, err
+	}
+	dk = dk.WithCipher(wk.Cipher)
+
+	sealed, err := wk.PublicKey.Seal(dk)
+	if err != nil {
+		return crypto.MasterKey{}, err
+	}
+	if err := backend.Put(dataKeyName(dk.ID()), sealed); err != nil {
+		return crypto.MasterKey{}, fmt.Errorf("failed to store data key: %w", err)
+	}
+	return dk, nil
+}
+
+func dataKeyName(id crypto.KeyID) string {
+	return DataKeyNamespace + hex.EncodeToString(id[:])
+}
+
+// EnableWriteOnly creates the repository key pair on first use and returns
+// the write-only key to install on backup hosts. The private key is saved
+// to privateKeyPath, which must not exist, and only the public key is
+// stored in the repository; restoring or auditing snapshots of write-only
+// hosts needs the private key (see crypto.MasterKey.WithPrivateKey). Once
+// enabled, privateKeyPath is not used.
+func (s *ContentAddressableStore) EnableWriteOnly(privateKeyPath string) (*WriteOnlyKey, error) {
+	pk, err := s.writePublicKey()
+	if err != nil {
+		return nil, err
+	}
+
+	if pk == nil {
+		sk, err := crypto.GenerateKeyPair()
+		if err != nil {
+			return nil, err
+		}
+		// The operator's copy first, so the key is never lost
+		if err := SavePrivateKey(privateKeyPath, sk); err != nil {
+			return nil, fmt.Errorf("failed to save write-only private key: %w", err)
+		}
+		public, err := sk.Public()
+		if err != nil {
+			return nil, err
+		}
+		if err := s.PutMetadata(WritePublicKeyConfigKey, public[:]); err != nil {
+			return nil, fmt.Errorf("failed to store write-only public key: %w", err)
+		}
+		pk = &public
+	}
+
+	return &WriteOnlyKey{
+		PublicKey:  *pk,
+		Cipher:     s.key.Cipher(),
+		ChunkIDKey: s.config.ChunkIDKey,
+		Version:    max(s.config.Version, FormatVersion),
+		Chunker:    s.config.Chunker,
+	}, nil
+}
+
+// CheckPrivateKey checks that sk is the private key of this repository's
+// write-only key pair
+func (s *ContentAddressableStore) CheckPrivateKey(sk crypto.PrivateKey) error {
+	pk, err := s.writePublicKey()
+	if err != nil {
+		return err
+	}
+	if pk == nil {
+		return fmt.Errorf("write-only backups are not enabled in this repository")
+	}
+	public, err := sk.Public()
+	if err != nil {
+		return err
+	}
+	if public != *pk {
+		return fmt.Errorf("private key does not belong to this repository")
+	}
+	return nil
+}
+
+// writePublicKey loads the public key of a write-only enabled repository,
+// or nil. It is always sealed with the master key, so it is opened without
+// keyFor.
+func (s *ContentAddressableStore) writePublicKey() (*crypto.PublicKey, error) {
+	data, err := s.masterKeyMetadata(WritePublicKeyConfigKey)
+	if err != nil || data == nil {
+		return nil, err
+	}
+	var pk crypto.PublicKey
+	if len(data) != len(pk) {
+		return nil, fmt.Errorf("corrupt write-only public key")
+	}
+	copy(pk[:], data)
+	return &pk, nil
+}
+
+// masterKeyMetadata reads a metadata object sealed with the master key, or
+// nil if it is not stored
+func (s *ContentAddressableStore) masterKeyMetadata(key string) ([]byte, error) {
+	exists, err := s.HasMetadata(key)
+	if err != nil || !exists {
+		return nil, err
+	}
+	return s.latestMetadata(key, func(key string, encrypted []byte) ([]byte, error) {
+		return s.openWith(s.key, key, encrypted)
+	})
+}
+
+// dataKey returns the data key with the given id, opened with the
+// write-only private key held with the master key. Keys are cached once
+// opened.
+func (s *ContentAddressableStore) dataKey(id crypto.KeyID) (crypto.MasterKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if k, ok := s.dataKeys[id]; ok {
+		return k, nil
+	}
+
+	sealed, err := s.backend.Get(dataKeyName(id))
+	if err != nil {
+		return crypto.MasterKey{}, fmt.Errorf("%w (key id %x, no data key: %v)", ErrKeyMismatch, id[:], err)
+	}
+	sk := s.key.PrivateKey()
+	if sk == nil {
+		return crypto.MasterKey{}, fmt.Errorf("%w (data key %x)", ErrPrivateKeyRequired, id[:])
+	}
+	k, err := sk.Open(sealed)
+	if err != nil {
+		return crypto.MasterKey{}, fmt.Errorf("data key %x: %w", id[:], err)
+	}
+	if k.ID() != id {
+		return crypto.MasterKey{}, fmt.Errorf("%w (data key %x stored under another id)", ErrObjectMismatch, id[:])
+	}
+	if s.dataKeys == nil {
+		s.dataKeys = make(map[crypto.KeyID]crypto.MasterKey)
+	}
+	s.dataKeys[id] = k
+	return k, nil
+}